@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"os"
+	"strconv"
 
 	"turbo-query/internal/embed"
 	"turbo-query/internal/server"
@@ -11,6 +13,14 @@ func main() {
 	if err := embed.Init(); err != nil {
 		log.Fatalf("failed to init embedding model: %v", err)
 	}
+	// the cross-encoder is optional: without it reranking requests fall
+	// back to the hybrid order
+	if path := os.Getenv("RERANK_MODEL"); path != "" {
+		batch, _ := strconv.Atoi(os.Getenv("RERANK_BATCH"))
+		if err := embed.InitReranker(path, batch); err != nil {
+			log.Printf("failed to init reranker, reranking disabled: %v", err)
+		}
+	}
 
 	srv := server.NewServer()
 
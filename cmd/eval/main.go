@@ -0,0 +1,349 @@
+// Command eval measures ranking quality against graded relevance
+// judgments. It runs every query through a coordinator, over HTTP or in
+// process, for each configuration in a sweep, and prints nDCG@k, MRR,
+// recall@k and MAP side by side.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"turbo-query/internal/embed"
+	"turbo-query/internal/eval"
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/server"
+)
+
+// config is one point of the sweep.
+type config struct {
+	label    string
+	fusion   *fusion.Params
+	pipeline string
+}
+
+// searcher posts a request to a coordinator endpoint.
+type searcher func(ctx context.Context, method, path string, body []byte) (int, []byte, error)
+
+func main() {
+	queries := flag.String("queries", "queries.tsv", "queries, one qid<TAB>query per line")
+	qrelsPath := flag.String("qrels", "qrels.txt", "TREC qrels: qid iteration docid grade")
+	url := flag.String("url", "", "coordinator URL; empty runs the coordinator in process")
+	k := flag.Int("k", 10, "cutoff for nDCG and recall")
+	depth := flag.Int("depth", 100, "results fetched per query, for MRR and MAP (at most 100)")
+	alphas := flag.String("alpha", "", "comma-separated BM25 weights to sweep; the vector weight is 1 - alpha")
+	windows := flag.String("window", "", "comma-separated fusion windows to sweep")
+	methods := flag.String("method", "", "comma-separated fusion methods to sweep (linear, rrf, ltr)")
+	pipelines := flag.String("pipeline", "", "comma-separated pipelines to sweep")
+	parallel := flag.Int("parallel", 4, "queries in flight")
+	flag.Parse()
+
+	topics, err := readTopics(*queries)
+	if err != nil {
+		log.Fatalf("read queries: %v", err)
+	}
+	qrels, err := readQrels(*qrelsPath)
+	if err != nil {
+		log.Fatalf("read qrels: %v", err)
+	}
+	judged := topics[:0]
+	for _, t := range topics {
+		if qrels.Relevant(t.ID) > 0 {
+			judged = append(judged, t)
+		}
+	}
+	if len(judged) == 0 {
+		log.Fatal("no query has a relevant judgment")
+	}
+	configs, err := sweep(*alphas, *windows, *methods, *pipelines)
+	if err != nil {
+		log.Fatal(err)
+	}
+	*depth = min(max(*depth, *k), 100)
+
+	search, wait := httpSearcher(*url), 30*time.Second
+	if *url == "" {
+		// an in-process coordinator probes its shards once while it is
+		// built, so its health won't change by waiting
+		search, wait = inProcess(), 0
+	}
+	if err := waitReady(search, wait); err != nil {
+		log.Fatalf("coordinator not ready: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "config\tnDCG@%d\tMRR\tR@%d\tMAP\tqueries\terrors\n", *k, *k)
+	for i, c := range configs {
+		log.Printf("[%d/%d] %s", i+1, len(configs), c.label)
+		ms, failed := run(search, c, judged, qrels, *k, *depth, *parallel)
+		m := eval.Mean(ms)
+		fmt.Fprintf(tw, "%s\t%.4f\t%.4f\t%.4f\t%.4f\t%d\t%d\n", c.label, m.NDCG, m.MRR, m.Recall, m.MAP, len(ms), failed)
+	}
+	tw.Flush()
+}
+
+func readTopics(path string) ([]eval.Topic, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return eval.ReadTopics(f)
+}
+
+func readQrels(path string) (eval.Qrels, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return eval.ReadQrels(f)
+}
+
+// sweep is every combination of the listed values; an empty list keeps the
+// coordinator's default for that parameter. The coordinator merges swept
+// fusion settings over a pipeline's, so the rest of its fusion stage
+// stands.
+func sweep(alphas, windows, methods, pipelines string) ([]config, error) {
+	configs := []config{{}}
+	var err error
+	configs, err = product(configs, "method", methods, func(c *config, v string) error {
+		c.fusion.Method = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	configs, err = product(configs, "alpha", alphas, func(c *config, v string) error {
+		alpha, err := strconv.ParseFloat(v, 64)
+		if err != nil || alpha < 0 || alpha > 1 {
+			return fmt.Errorf("alpha %q must be between 0 and 1", v)
+		}
+		vec := 1 - alpha
+		c.fusion.WeightBM25, c.fusion.WeightVector = &alpha, &vec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	configs, err = product(configs, "window", windows, func(c *config, v string) error {
+		window, err := strconv.Atoi(v)
+		c.fusion.Window = window
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	configs, err = product(configs, "pipeline", pipelines, func(c *config, v string) error {
+		c.pipeline = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range configs {
+		c := &configs[i]
+		if c.fusion != nil && *c.fusion == (fusion.Params{}) {
+			c.fusion = nil
+		}
+		if err := c.fusion.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.label, err)
+		}
+		if c.label = strings.TrimSpace(c.label); c.label == "" {
+			c.label = "default"
+		}
+	}
+	return configs, nil
+}
+
+// product crosses configs with the values of one parameter. Each copy gets
+// its own fusion params, so set can change them freely.
+func product(configs []config, name, list string, set func(*config, string) error) ([]config, error) {
+	values := split(list)
+	if len(values) == 0 {
+		return configs, nil
+	}
+	out := make([]config, 0, len(configs)*len(values))
+	for _, c := range configs {
+		for _, v := range values {
+			nc := c
+			nc.fusion = withFusion(c.fusion)
+			if err := set(&nc, v); err != nil {
+				return nil, err
+			}
+			nc.label += " " + name + "=" + v
+			out = append(out, nc)
+		}
+	}
+	return out, nil
+}
+
+func withFusion(p *fusion.Params) *fusion.Params {
+	if p == nil {
+		return new(fusion.Params)
+	}
+	cp := *p
+	return &cp
+}
+
+func split(list string) []string {
+	var out []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// run evaluates one configuration over every topic. A query that fails
+// scores 0, so configurations stay comparable, and is counted in failed.
+func run(search searcher, c config, topics []eval.Topic, qrels eval.Qrels, k, depth, parallel int) ([]eval.Metrics, int) {
+	ms := make([]eval.Metrics, len(topics))
+	failed := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(parallel, 1))
+	for i, t := range topics {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t eval.Topic) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ranked, err := rank(search, c, t.Query, depth)
+			if err != nil {
+				log.Printf("%s: query %s: %v", c.label, t.ID, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			ms[i] = eval.Score(ranked, qrels[t.ID], k)
+		}(i, t)
+	}
+	wg.Wait()
+	return ms, failed
+}
+
+// rank runs one query and returns the global IDs of its hits in order. A
+// search whose stored fields couldn't all be fetched is an error, and a
+// hit that still comes back without an ID keeps its rank as "", so later
+// hits never move up.
+func rank(search searcher, c config, query string, depth int) ([]string, error) {
+	body, err := json.Marshal(server.SearchRequest{
+		Query:    query,
+		TopK:     depth,
+		Fields:   []string{"wiki_id"},
+		Fusion:   c.fusion,
+		Pipeline: c.pipeline,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	status, out, err := search(ctx, http.MethodPost, "/search", body)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", status, bytes.TrimSpace(out))
+	}
+	var resp server.SearchResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, err
+	}
+	if failed := resp.Shards.FetchFailed; len(failed) > 0 {
+		return nil, fmt.Errorf("fields not fetched from shards %s", strings.Join(failed, ","))
+	}
+	ranked := make([]string, len(resp.Hits))
+	missing := 0
+	for i, h := range resp.Hits {
+		ranked[i], _ = h.Fields["wiki_id"].(string)
+		if ranked[i] == "" {
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Printf("query %q: %d hits without a wiki_id ranked as unjudged", query, missing)
+	}
+	return ranked, nil
+}
+
+func httpSearcher(base string) searcher {
+	client := &http.Client{Timeout: time.Minute}
+	base = strings.TrimRight(base, "/")
+	return func(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+		req, err := http.NewRequestWithContext(ctx, method, base+path, bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		out, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, out, err
+	}
+}
+
+// inProcess builds an eval coordinator from the environment, as cmd/api
+// builds its coordinator, and serves requests through its handler without
+// listening. Shards are still reached over the network. Eval runs neither
+// read nor fill the result cache and don't feed LTR feature logs.
+func inProcess() searcher {
+	if err := embed.Init(); err != nil {
+		log.Fatalf("failed to init embedding model: %v", err)
+	}
+	if path := os.Getenv("RERANK_MODEL"); path != "" {
+		batch, _ := strconv.Atoi(os.Getenv("RERANK_BATCH"))
+		if err := embed.InitReranker(path, batch); err != nil {
+			log.Printf("failed to init reranker, reranking disabled: %v", err)
+		}
+	}
+	h := server.NewEvalServer().Handler
+	return func(ctx context.Context, method, path string, body []byte) (int, []byte, error) {
+		req := httptest.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.Bytes(), nil
+	}
+}
+
+// waitReady waits up to wait for the coordinator's cluster health to be
+// out of the red, checking at least once.
+func waitReady(search searcher, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		status, _, err := search(ctx, http.MethodGet, "/cluster/health", nil)
+		cancel()
+		if err == nil && status == http.StatusOK {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = errors.New("cluster health is red")
+			}
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -1,17 +1,40 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"turbo-query/internal/shardnode"
 )
 
 func main() {
-	srv := shardnode.NewServer()
+	srv, node := shardnode.NewServer()
+	defer node.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		// leave the registry first so the coordinator stops routing here
+		node.Leave()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
 
 	log.Println("starting shard server on", srv.Addr)
 
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
-}
\ No newline at end of file
+	// wait for in-flight searches before unmapping vectors
+	<-stopped
+}
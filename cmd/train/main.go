@@ -0,0 +1,51 @@
+// Command train fits a linear LTR model from an event log with logged
+// features and clicks, and writes it in the format shards load from
+// LTR_MODEL.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"turbo-query/internal/ltr"
+)
+
+func main() {
+	events := flag.String("events", "events.jsonl", "event log to read (EVENT_LOG)")
+	out := flag.String("out", "model.json", "where to write the model")
+	features := flag.String("features", "", "comma-separated features to use (default all)")
+	epochs := flag.Int("epochs", 20, "passes over the training pairs")
+	lr := flag.Float64("lr", 0.05, "learning rate")
+	l2 := flag.Float64("l2", 1e-4, "L2 regularisation")
+	flag.Parse()
+
+	f, err := os.Open(*events)
+	if err != nil {
+		log.Fatalf("open events: %v", err)
+	}
+	queries, err := ltr.ReadEvents(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("read events: %v", err)
+	}
+
+	opts := ltr.TrainOptions{Epochs: *epochs, LearningRate: *lr, L2: *l2}
+	if *features != "" {
+		opts.Features = strings.Split(*features, ",")
+	}
+	model, stats, err := ltr.Train(queries, opts)
+	if err != nil {
+		log.Fatalf("train: %v", err)
+	}
+	log.Printf("trained on %d searches, %d pairs; %.1f%% of pairs ordered correctly",
+		stats.Queries, stats.Pairs, 100*stats.Accuracy)
+
+	data, _ := json.MarshalIndent(model, "", "  ")
+	if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+		log.Fatalf("write model: %v", err)
+	}
+	log.Println("wrote", *out)
+}
@@ -0,0 +1,39 @@
+// Package deadline carries a request's remaining time budget between the
+// coordinator and shards. The budget travels as a relative timeout rather
+// than an absolute time so clock skew between hosts doesn't matter.
+package deadline
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header holds the remaining budget in milliseconds.
+const Header = "X-Timeout-Ms"
+
+// Set writes the time left on ctx, minus margin for the return trip, into
+// the request header. It does nothing when ctx has no deadline.
+func Set(req *http.Request, ctx context.Context, margin time.Duration) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	left := time.Until(d) - margin
+	if left < time.Millisecond {
+		left = time.Millisecond
+	}
+	req.Header.Set(Header, strconv.FormatInt(left.Milliseconds(), 10))
+}
+
+// FromRequest derives a context bounded by the budget in the request header,
+// if any. It is always derived from r.Context(), so a client that hangs up
+// cancels it too.
+func FromRequest(r *http.Request) (context.Context, context.CancelFunc) {
+	ms, err := strconv.ParseInt(r.Header.Get(Header), 10, 64)
+	if err != nil || ms <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+}
@@ -0,0 +1,308 @@
+// Package dsl is the JSON query language accepted on the coordinator's
+// /search. The coordinator validates a query and forwards it unchanged;
+// each shard translates it into Bleve query objects.
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// MaxFuzziness is the largest edit distance Bleve supports.
+const MaxFuzziness = 2
+
+// Query is one node of the DSL; exactly one member must be set.
+type Query struct {
+	Bool        *Bool        `json:"bool,omitempty"`
+	Match       *Match       `json:"match,omitempty"`
+	MatchPhrase *MatchPhrase `json:"match_phrase,omitempty"`
+	Prefix      *Prefix      `json:"prefix,omitempty"`
+	Fuzzy       *Fuzzy       `json:"fuzzy,omitempty"`
+	Term        *Term        `json:"term,omitempty"`
+	QueryString *QueryString `json:"query_string,omitempty"`
+}
+
+// Bool combines clauses. Filter clauses must match but don't score.
+type Bool struct {
+	Must               []Query `json:"must,omitempty"`
+	Should             []Query `json:"should,omitempty"`
+	MustNot            []Query `json:"must_not,omitempty"`
+	Filter             []Query `json:"filter,omitempty"`
+	MinimumShouldMatch int     `json:"minimum_should_match,omitempty"`
+	Boost              float64 `json:"boost,omitempty"`
+}
+
+// Match analyses Query and matches any (or, with Operator "and", all) of
+// its terms. An empty Field searches every field.
+type Match struct {
+	Field     string  `json:"field,omitempty"`
+	Query     string  `json:"query"`
+	Operator  string  `json:"operator,omitempty"`
+	Fuzziness int     `json:"fuzziness,omitempty"`
+	Boost     float64 `json:"boost,omitempty"`
+}
+
+type MatchPhrase struct {
+	Field string  `json:"field,omitempty"`
+	Query string  `json:"query"`
+	Boost float64 `json:"boost,omitempty"`
+}
+
+type Prefix struct {
+	Field string  `json:"field,omitempty"`
+	Value string  `json:"value"`
+	Boost float64 `json:"boost,omitempty"`
+}
+
+// Fuzzy matches terms within Fuzziness edits of Value; the first
+// PrefixLength characters must match exactly.
+type Fuzzy struct {
+	Field        string  `json:"field,omitempty"`
+	Value        string  `json:"value"`
+	Fuzziness    int     `json:"fuzziness,omitempty"`
+	PrefixLength int     `json:"prefix_length,omitempty"`
+	Boost        float64 `json:"boost,omitempty"`
+}
+
+// Term matches Value exactly, without analysis.
+type Term struct {
+	Field string  `json:"field,omitempty"`
+	Value string  `json:"value"`
+	Boost float64 `json:"boost,omitempty"`
+}
+
+// QueryString is Bleve's query-string syntax, e.g. `+title:byzantine -ottoman`.
+type QueryString struct {
+	Query string  `json:"query"`
+	Boost float64 `json:"boost,omitempty"`
+}
+
+// Validate reports the first structural problem in q, so the coordinator
+// can reject a bad query before fanning it out.
+func (q *Query) Validate() error {
+	_, err := q.Bleve()
+	return err
+}
+
+// Bleve translates q into a Bleve query.
+func (q *Query) Bleve() (query.Query, error) {
+	set := 0
+	for _, ok := range []bool{q.Bool != nil, q.Match != nil, q.MatchPhrase != nil,
+		q.Prefix != nil, q.Fuzzy != nil, q.Term != nil, q.QueryString != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("dsl: each clause must have exactly one query type")
+	}
+
+	switch {
+	case q.Bool != nil:
+		return q.Bool.bleve()
+
+	case q.Match != nil:
+		m := q.Match
+		if m.Query == "" {
+			return nil, errors.New("dsl: match needs a query")
+		}
+		if m.Fuzziness < 0 || m.Fuzziness > MaxFuzziness {
+			return nil, fmt.Errorf("dsl: fuzziness must be 0-%d", MaxFuzziness)
+		}
+		mq := bleve.NewMatchQuery(m.Query)
+		mq.SetField(m.Field)
+		mq.SetFuzziness(m.Fuzziness)
+		switch strings.ToLower(m.Operator) {
+		case "", "or":
+		case "and":
+			mq.SetOperator(query.MatchQueryOperatorAnd)
+		default:
+			return nil, fmt.Errorf("dsl: unknown match operator %q", m.Operator)
+		}
+		setBoost(mq, m.Boost)
+		return mq, nil
+
+	case q.MatchPhrase != nil:
+		m := q.MatchPhrase
+		if m.Query == "" {
+			return nil, errors.New("dsl: match_phrase needs a query")
+		}
+		pq := bleve.NewMatchPhraseQuery(m.Query)
+		pq.SetField(m.Field)
+		setBoost(pq, m.Boost)
+		return pq, nil
+
+	case q.Prefix != nil:
+		p := q.Prefix
+		if p.Value == "" {
+			return nil, errors.New("dsl: prefix needs a value")
+		}
+		pq := bleve.NewPrefixQuery(strings.ToLower(p.Value))
+		pq.SetField(p.Field)
+		setBoost(pq, p.Boost)
+		return pq, nil
+
+	case q.Fuzzy != nil:
+		f := q.Fuzzy
+		if f.Value == "" {
+			return nil, errors.New("dsl: fuzzy needs a value")
+		}
+		fuzziness := f.Fuzziness
+		if fuzziness == 0 {
+			fuzziness = 1
+		}
+		if fuzziness < 0 || fuzziness > MaxFuzziness {
+			return nil, fmt.Errorf("dsl: fuzziness must be 1-%d", MaxFuzziness)
+		}
+		fq := bleve.NewFuzzyQuery(strings.ToLower(f.Value))
+		fq.SetField(f.Field)
+		fq.SetFuzziness(fuzziness)
+		fq.SetPrefix(f.PrefixLength)
+		setBoost(fq, f.Boost)
+		return fq, nil
+
+	case q.Term != nil:
+		t := q.Term
+		if t.Value == "" {
+			return nil, errors.New("dsl: term needs a value")
+		}
+		tq := bleve.NewTermQuery(t.Value)
+		tq.SetField(t.Field)
+		setBoost(tq, t.Boost)
+		return tq, nil
+
+	default:
+		return ParseQueryString(q.QueryString.Query, q.QueryString.Boost)
+	}
+}
+
+func (b *Bool) bleve() (query.Query, error) {
+	if len(b.Must)+len(b.Should)+len(b.MustNot)+len(b.Filter) == 0 {
+		return nil, errors.New("dsl: bool needs at least one clause")
+	}
+	if len(b.Must)+len(b.Should)+len(b.Filter) == 0 {
+		return nil, errors.New("dsl: bool with only must_not matches nothing")
+	}
+
+	must, err := translate(b.Must)
+	if err != nil {
+		return nil, err
+	}
+	should, err := translate(b.Should)
+	if err != nil {
+		return nil, err
+	}
+	mustNot, err := translate(b.MustNot)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := translate(b.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	bq := bleve.NewBooleanQuery()
+	bq.AddMust(must...)
+	bq.AddShould(should...)
+	bq.AddMustNot(mustNot...)
+	switch len(filter) {
+	case 0:
+	case 1:
+		bq.AddFilter(filter[0])
+	default:
+		bq.AddFilter(bleve.NewConjunctionQuery(filter...))
+	}
+	if b.MinimumShouldMatch > 0 {
+		if b.MinimumShouldMatch > len(should) {
+			return nil, errors.New("dsl: minimum_should_match exceeds should clauses")
+		}
+		bq.SetMinShould(float64(b.MinimumShouldMatch))
+	}
+	setBoost(bq, b.Boost)
+	return bq, nil
+}
+
+func translate(qs []Query) ([]query.Query, error) {
+	out := make([]query.Query, 0, len(qs))
+	for i := range qs {
+		bq, err := qs[i].Bleve()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, bq)
+	}
+	return out, nil
+}
+
+// ParseQueryString parses Bleve query-string syntax eagerly so syntax errors
+// surface as request errors rather than search failures.
+func ParseQueryString(qs string, boost float64) (query.Query, error) {
+	if qs == "" {
+		return nil, errors.New("dsl: query_string needs a query")
+	}
+	q := bleve.NewQueryStringQuery(qs)
+	if _, err := q.Parse(); err != nil {
+		return nil, fmt.Errorf("dsl: %w", err)
+	}
+	setBoost(q, boost)
+	return q, nil
+}
+
+func setBoost(q query.BoostableQuery, boost float64) {
+	if boost > 0 {
+		q.SetBoost(boost)
+	}
+}
+
+// Text collects the free text of the positive clauses, for embedding a
+// query that was given only as DSL.
+func (q *Query) Text() string {
+	var parts []string
+	q.collect(&parts)
+	return strings.Join(parts, " ")
+}
+
+func (q *Query) collect(parts *[]string) {
+	switch {
+	case q.Bool != nil:
+		for _, list := range [][]Query{q.Bool.Must, q.Bool.Should, q.Bool.Filter} {
+			for i := range list {
+				list[i].collect(parts)
+			}
+		}
+	case q.Match != nil:
+		*parts = append(*parts, q.Match.Query)
+	case q.MatchPhrase != nil:
+		*parts = append(*parts, q.MatchPhrase.Query)
+	case q.Prefix != nil:
+		*parts = append(*parts, q.Prefix.Value)
+	case q.Fuzzy != nil:
+		*parts = append(*parts, q.Fuzzy.Value)
+	case q.Term != nil:
+		*parts = append(*parts, q.Term.Value)
+	case q.QueryString != nil:
+		*parts = append(*parts, q.QueryString.Query)
+	}
+}
+
+// SyntaxQueryString asks for a search's text to be read as Bleve
+// query-string syntax rather than plain words.
+const SyntaxQueryString = "query_string"
+
+// Build returns the Bleve query for a search: the DSL when given, else the
+// text in query-string syntax when requested, else a match query on it.
+func Build(text, syntax string, q *Query) (query.Query, error) {
+	switch {
+	case q != nil:
+		return q.Bleve()
+	case syntax == SyntaxQueryString:
+		return ParseQueryString(text, 0)
+	case syntax != "":
+		return nil, fmt.Errorf("dsl: unknown syntax %q", syntax)
+	}
+	return bleve.NewMatchQuery(text), nil
+}
@@ -0,0 +1,138 @@
+package dsl
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func parse(t *testing.T, in string) *Query {
+	t.Helper()
+	var q Query
+	if err := json.Unmarshal([]byte(in), &q); err != nil {
+		t.Fatalf("%s: %v", in, err)
+	}
+	return &q
+}
+
+func TestBleve(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"match scoped to a field", `{"match": {"field": "title", "query": "Rome Empire", "operator": "AND", "fuzziness": 1, "boost": 2}}`,
+			`{"match":"Rome Empire","field":"title","boost":2,"prefix_length":0,"fuzziness":1,"operator":"and"}`},
+		{"match on every field", `{"match": {"query": "rome", "operator": "or"}}`,
+			`{"match":"rome","prefix_length":0,"fuzziness":0}`},
+		{"phrase", `{"match_phrase": {"field": "text", "query": "holy roman empire"}}`,
+			`{"match_phrase":"holy roman empire","field":"text","fuzziness":0}`},
+		{"prefix is lowercased", `{"prefix": {"field": "title", "value": "Byz"}}`,
+			`{"prefix":"byz","field":"title"}`},
+		{"fuzzy defaults to one edit", `{"fuzzy": {"value": "Konstantinople"}}`,
+			`{"term":"konstantinople","prefix_length":0,"fuzziness":1}`},
+		{"fuzzy", `{"fuzzy": {"field": "title", "value": "rome", "fuzziness": 2, "prefix_length": 1}}`,
+			`{"term":"rome","prefix_length":1,"fuzziness":2,"field":"title"}`},
+		{"term keeps its case", `{"term": {"field": "category", "value": "History"}}`,
+			`{"term":"History","field":"category"}`},
+		{"query string", `{"query_string": {"query": "+title:byzantine -ottoman", "boost": 1.5}}`,
+			`{"query":"+title:byzantine -ottoman","boost":1.5}`},
+		{"bool", `{"bool": {
+			"must": [{"match": {"query": "rome"}}],
+			"should": [{"term": {"value": "a"}}, {"term": {"value": "b"}}],
+			"must_not": [{"term": {"value": "c"}}],
+			"filter": [{"term": {"field": "x", "value": "1"}}, {"term": {"field": "y", "value": "2"}}],
+			"minimum_should_match": 1}}`,
+			`{"must":{"conjuncts":[{"match":"rome","prefix_length":0,"fuzziness":0}]},` +
+				`"should":{"disjuncts":[{"term":"a"},{"term":"b"}],"min":1},` +
+				`"must_not":{"disjuncts":[{"term":"c"}],"min":0},` +
+				`"filter":{"conjuncts":[{"term":"1","field":"x"},{"term":"2","field":"y"}]}}`},
+		{"single filter isn't wrapped", `{"bool": {"filter": [{"term": {"field": "x", "value": "1"}}], "boost": 3}}`,
+			`{"must":{"conjuncts":[]},"should":{"disjuncts":[],"min":0},"must_not":{"disjuncts":[],"min":0},` +
+				`"filter":{"term":"1","field":"x"},"boost":3}`},
+	} {
+		bq, err := parse(t, tc.in).Bleve()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(bq); string(got) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBleveRejects(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		wantErr string
+	}{
+		{`{}`, "exactly one query type"},
+		{`{"match": {"query": "a"}, "term": {"value": "a"}}`, "exactly one query type"},
+		{`{"match": {"query": ""}}`, "match needs a query"},
+		{`{"match": {"query": "a", "fuzziness": 3}}`, "fuzziness must be 0-2"},
+		{`{"match": {"query": "a", "operator": "xor"}}`, `unknown match operator "xor"`},
+		{`{"match_phrase": {"field": "title"}}`, "match_phrase needs a query"},
+		{`{"prefix": {"value": ""}}`, "prefix needs a value"},
+		{`{"fuzzy": {"value": "a", "fuzziness": -1}}`, "fuzziness must be 1-2"},
+		{`{"fuzzy": {"value": "a", "fuzziness": 3}}`, "fuzziness must be 1-2"},
+		{`{"term": {"field": "title"}}`, "term needs a value"},
+		{`{"query_string": {"query": ""}}`, "query_string needs a query"},
+		{`{"query_string": {"query": "\"unterminated"}}`, "dsl: parse error: unterminated quote"},
+		{`{"query_string": {"query": "title:rome^x"}}`, "invalid boost value"},
+		{`{"query_string": {"query": "+"}}`, "dsl: syntax error"},
+		{`{"bool": {}}`, "bool needs at least one clause"},
+		{`{"bool": {"must_not": [{"term": {"value": "a"}}]}}`, "only must_not matches nothing"},
+		{`{"bool": {"should": [{"term": {"value": "a"}}], "minimum_should_match": 2}}`, "minimum_should_match exceeds"},
+		// errors deep in a tree surface as they are
+		{`{"bool": {"must": [{"bool": {"filter": [{"match": {"query": "a", "operator": "nand"}}]}}]}}`, `unknown match operator "nand"`},
+	} {
+		err := parse(t, tc.in).Validate()
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want %q", tc.in, err, tc.wantErr)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	q := parse(t, `{"bool": {
+		"must": [{"match": {"query": "roman"}}, {"match_phrase": {"query": "holy see"}}],
+		"should": [{"prefix": {"value": "emp"}}, {"fuzzy": {"value": "konstantin"}}],
+		"must_not": [{"term": {"value": "ottoman"}}],
+		"filter": [{"term": {"value": "history"}}, {"query_string": {"query": "title:rome"}}]}}`)
+	if got, want := q.Text(), "roman holy see emp konstantin history title:rome"; got != want {
+		t.Errorf("Text = %q, want %q", got, want)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		text    string
+		syntax  string
+		q       *Query
+		want    string
+		wantErr string
+	}{
+		{"plain text", "Rome empire", "", nil, `{"match":"Rome empire","prefix_length":0,"fuzziness":0}`, ""},
+		{"query string", "+title:rome", SyntaxQueryString, nil, `{"query":"+title:rome"}`, ""},
+		{"dsl wins over text", "ignored", SyntaxQueryString, &Query{Term: &Term{Value: "Rome"}}, `{"term":"Rome"}`, ""},
+		{"bad query string", `"rome`, SyntaxQueryString, nil, "", "unterminated quote"},
+		{"unknown syntax", "rome", "lucene", nil, "", `unknown syntax "lucene"`},
+	} {
+		bq, err := Build(tc.text, tc.syntax, tc.q)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: error %v, want %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(bq); string(got) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
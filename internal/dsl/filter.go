@@ -0,0 +1,189 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// Filter restricts a search to docs whose metadata matches; it never
+// changes scores. Exactly one member must be set.
+type Filter struct {
+	Term  *TermFilter  `json:"term,omitempty"`
+	Terms *TermsFilter `json:"terms,omitempty"`
+	Range *RangeFilter `json:"range,omitempty"`
+}
+
+type TermFilter struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// TermsFilter matches docs with any of Values.
+type TermsFilter struct {
+	Field  string   `json:"field"`
+	Values []string `json:"values"`
+}
+
+// RangeFilter bounds a numeric or date field. Bounds given as numbers make
+// a numeric range; bounds given as RFC 3339 strings make a date range.
+type RangeFilter struct {
+	Field string      `json:"field"`
+	GT    interface{} `json:"gt,omitempty"`
+	GTE   interface{} `json:"gte,omitempty"`
+	LT    interface{} `json:"lt,omitempty"`
+	LTE   interface{} `json:"lte,omitempty"`
+}
+
+// Filters combines filters into one query that every doc must match, or
+// nil when there are none.
+func Filters(fs []Filter) (query.Query, error) {
+	if len(fs) == 0 {
+		return nil, nil
+	}
+	qs := make([]query.Query, 0, len(fs))
+	for i := range fs {
+		q, err := fs[i].bleve()
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, q)
+	}
+	if len(qs) == 1 {
+		return qs[0], nil
+	}
+	return bleve.NewConjunctionQuery(qs...), nil
+}
+
+// WithFilters wraps q so that only docs matching the filters are returned,
+// scored by q alone.
+func WithFilters(q query.Query, fs []Filter) (query.Query, error) {
+	f, err := Filters(fs)
+	if err != nil || f == nil {
+		return q, err
+	}
+	b := bleve.NewBooleanQuery()
+	b.AddMust(q)
+	b.AddFilter(f)
+	return b, nil
+}
+
+func (f *Filter) bleve() (query.Query, error) {
+	set := 0
+	for _, ok := range []bool{f.Term != nil, f.Terms != nil, f.Range != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("dsl: a filter takes one of term, terms or range")
+	}
+
+	switch {
+	case f.Term != nil:
+		if f.Term.Field == "" {
+			return nil, errors.New("dsl: term filter needs a field")
+		}
+		q := bleve.NewTermQuery(f.Term.Value)
+		q.SetField(f.Term.Field)
+		return q, nil
+
+	case f.Terms != nil:
+		if f.Terms.Field == "" || len(f.Terms.Values) == 0 {
+			return nil, errors.New("dsl: terms filter needs a field and values")
+		}
+		dis := bleve.NewDisjunctionQuery()
+		for _, v := range f.Terms.Values {
+			q := bleve.NewTermQuery(v)
+			q.SetField(f.Terms.Field)
+			dis.AddQuery(q)
+		}
+		return dis, nil
+
+	case f.Range != nil:
+		return f.Range.bleve()
+	}
+	return nil, errors.New("dsl: filter needs term, terms or range")
+}
+
+func (r *RangeFilter) bleve() (query.Query, error) {
+	if r.Field == "" {
+		return nil, errors.New("dsl: range filter needs a field")
+	}
+	if (r.GT != nil && r.GTE != nil) || (r.LT != nil && r.LTE != nil) {
+		return nil, errors.New("dsl: range filter takes one lower and one upper bound")
+	}
+	lo, loIncl := r.GTE, true
+	if lo == nil {
+		lo, loIncl = r.GT, false
+	}
+	hi, hiIncl := r.LTE, true
+	if hi == nil {
+		hi, hiIncl = r.LT, false
+	}
+	if lo == nil && hi == nil {
+		return nil, errors.New("dsl: range filter needs a bound")
+	}
+
+	_, loStr := lo.(string)
+	_, hiStr := hi.(string)
+	if loStr || hiStr {
+		var start, end time.Time
+		var err error
+		if lo != nil {
+			if start, err = parseDate(lo); err != nil {
+				return nil, err
+			}
+		}
+		if hi != nil {
+			if end, err = parseDate(hi); err != nil {
+				return nil, err
+			}
+		}
+		if lo != nil && hi != nil && end.Before(start) {
+			return nil, errors.New("dsl: range filter bounds are reversed")
+		}
+		q := bleve.NewDateRangeInclusiveQuery(start, end, &loIncl, &hiIncl)
+		q.SetField(r.Field)
+		return q, nil
+	}
+
+	var min, max *float64
+	if lo != nil {
+		v, ok := lo.(float64)
+		if !ok {
+			return nil, fmt.Errorf("dsl: bad range bound %v", lo)
+		}
+		min = &v
+	}
+	if hi != nil {
+		v, ok := hi.(float64)
+		if !ok {
+			return nil, fmt.Errorf("dsl: bad range bound %v", hi)
+		}
+		max = &v
+	}
+	if min != nil && max != nil && *max < *min {
+		return nil, errors.New("dsl: range filter bounds are reversed")
+	}
+	q := bleve.NewNumericRangeInclusiveQuery(min, max, &loIncl, &hiIncl)
+	q.SetField(r.Field)
+	return q, nil
+}
+
+func parseDate(v interface{}) (time.Time, error) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("dsl: mixed number and date bounds")
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", s); err != nil {
+			return time.Time{}, fmt.Errorf("dsl: bad date %q", s)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,73 @@
+package dsl
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFilters(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"none", `[]`, `null`},
+		{"one filter isn't wrapped", `[{"term": {"field": "category", "value": "History"}}]`,
+			`{"term":"History","field":"category"}`},
+		{"all must match", `[{"terms": {"field": "lang", "values": ["en", "de"]}}, {"range": {"field": "year", "gte": 1900, "lt": 2000}}]`,
+			`{"conjuncts":[{"disjuncts":[{"term":"en","field":"lang"},{"term":"de","field":"lang"}],"min":0},` +
+				`{"min":1900,"max":2000,"inclusive_min":true,"inclusive_max":false,"field":"year"}]}`},
+		{"upper bound only", `[{"range": {"field": "year", "lte": 5}}]`,
+			`{"max":5,"inclusive_min":false,"inclusive_max":true,"field":"year"}`},
+		{"equal bounds", `[{"range": {"field": "year", "gte": 5, "lte": 5}}]`,
+			`{"min":5,"max":5,"inclusive_min":true,"inclusive_max":true,"field":"year"}`},
+		{"dates", `[{"range": {"field": "modified", "gt": "2020-01-01", "lte": "2021-06-30T12:00:00Z"}}]`,
+			`{"start":"2020-01-01T00:00:00Z","end":"2021-06-30T12:00:00Z","inclusive_start":false,"inclusive_end":true,"field":"modified"}`},
+	} {
+		var fs []Filter
+		if err := json.Unmarshal([]byte(tc.in), &fs); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		q, err := Filters(fs)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got, _ := json.Marshal(q); string(got) != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFiltersReject(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		wantErr string
+	}{
+		{`[{}]`, "filter needs term, terms or range"},
+		{`[{"term": {"field": "a", "value": "b"}, "range": {"field": "year", "gt": 1}}]`, "one of term, terms or range"},
+		{`[{"term": {"value": "b"}}]`, "term filter needs a field"},
+		{`[{"terms": {"field": "lang"}}]`, "terms filter needs a field and values"},
+		{`[{"terms": {"values": ["en"]}}]`, "terms filter needs a field and values"},
+		{`[{"range": {"gt": 1}}]`, "range filter needs a field"},
+		{`[{"range": {"field": "year"}}]`, "range filter needs a bound"},
+		{`[{"range": {"field": "year", "gt": 1, "gte": 2}}]`, "one lower and one upper bound"},
+		{`[{"range": {"field": "year", "lt": 1, "lte": 2}}]`, "one lower and one upper bound"},
+		{`[{"range": {"field": "year", "gte": 2000, "lt": 1900}}]`, "bounds are reversed"},
+		{`[{"range": {"field": "modified", "gte": "2021-01-01", "lte": "2020-01-01"}}]`, "bounds are reversed"},
+		{`[{"range": {"field": "year", "gte": true}}]`, "bad range bound true"},
+		{`[{"range": {"field": "modified", "gte": "2020-01-01", "lt": 2021}}]`, "mixed number and date bounds"},
+		{`[{"range": {"field": "modified", "gte": "last year"}}]`, `bad date "last year"`},
+		// a bad filter anywhere in the list fails the whole set
+		{`[{"term": {"field": "a", "value": "b"}}, {"range": {"field": "year"}}]`, "range filter needs a bound"},
+	} {
+		var fs []Filter
+		if err := json.Unmarshal([]byte(tc.in), &fs); err != nil {
+			t.Fatalf("%s: %v", tc.in, err)
+		}
+		if _, err := Filters(fs); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want %q", tc.in, err, tc.wantErr)
+		}
+	}
+}
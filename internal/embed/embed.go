@@ -1,6 +1,7 @@
 package embed
 
 import (
+	"context"
 	"math"
 	"sync"
 
@@ -12,19 +13,24 @@ import (
 const Dim = 384
 
 var (
+	// session is shared by every pipeline the process loads
+	session  *hugot.Session
 	pipeline *pipelines.FeatureExtractionPipeline
-	mu       sync.Mutex
+	// sem serialises pipeline calls; unlike a mutex, waiting on it can be
+	// abandoned when the caller's context ends
+	sem      = make(chan struct{}, 1)
 	initOnce sync.Once
 )
 func Init() error {
     var err error
     initOnce.Do(func() {
-        session, e := hugot.NewORTSession(
+        s, e := hugot.NewORTSession(
             options.WithIntraOpNumThreads(8),
             options.WithInterOpNumThreads(4),
             options.WithExecutionMode(true),
         )
         if e != nil { err = e; return }
+        session = s
         pipeline, err = hugot.NewPipeline(session, hugot.FeatureExtractionConfig{
             ModelPath: "./models/all-MiniLM-L6-v2",
             Name:      "all-MiniLM-L6-v2",
@@ -34,13 +40,49 @@ func Init() error {
 }
 
 func GetEmbedding(query string) ([]float32, error) {
-    mu.Lock()
-    defer mu.Unlock()
+    return GetEmbeddingContext(context.Background(), query)
+}
+
+// GetEmbeddingContext is GetEmbedding, but gives up if ctx ends while
+// waiting for the model.
+func GetEmbeddingContext(ctx context.Context, query string) ([]float32, error) {
+    select {
+    case sem <- struct{}{}:
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+    defer func() { <-sem }()
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
     result, err := pipeline.RunPipeline([]string{query})
     if err != nil { return nil, err }
     return normalize(result.Embeddings[0]), nil
 }
 
+// GetEmbeddingsContext embeds texts in a single batched pipeline run.
+func GetEmbeddingsContext(ctx context.Context, texts []string) ([][]float32, error) {
+    if len(texts) == 0 {
+        return nil, nil
+    }
+    select {
+    case sem <- struct{}{}:
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+    defer func() { <-sem }()
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    result, err := pipeline.RunPipeline(texts)
+    if err != nil { return nil, err }
+    out := make([][]float32, len(result.Embeddings))
+    for i, e := range result.Embeddings {
+        out[i] = normalize(e)
+    }
+    return out, nil
+}
+
 func normalize(v []float32) []float32 {
 	var sum float32
 	for _, x := range v {
@@ -0,0 +1,93 @@
+package embed
+
+import (
+	"context"
+	"errors"
+
+	"github.com/knights-analytics/hugot"
+	"github.com/knights-analytics/hugot/pipelines"
+)
+
+var (
+	reranker    *pipelines.CrossEncoderPipeline
+	rerankBatch int
+	// rerankSem serialises cross-encoder runs, like sem does for embeddings
+	rerankSem = make(chan struct{}, 1)
+)
+
+// InitReranker loads a cross-encoder model into the session Init created.
+// Passages are scored batchSize at a time.
+func InitReranker(modelPath string, batchSize int) error {
+	if session == nil {
+		return errors.New("embed: Init must run before InitReranker")
+	}
+	if batchSize <= 0 {
+		batchSize = 8
+	}
+	p, err := hugot.NewPipeline(session, hugot.CrossEncoderConfig{
+		ModelPath: modelPath,
+		Name:      "cross-encoder",
+		Options:   []hugot.CrossEncoderOption{pipelines.WithBatchSize(batchSize)},
+	})
+	if err != nil {
+		return err
+	}
+	reranker, rerankBatch = p, batchSize
+	return nil
+}
+
+// RerankerReady reports whether a cross-encoder model is loaded.
+func RerankerReady() bool {
+	return reranker != nil
+}
+
+// ScorePairs scores each passage against query with the cross-encoder and
+// returns the scores, between 0 and 1, in passage order. If ctx ends first
+// it returns ctx.Err() at once; the run in progress stops after its
+// current batch.
+func ScorePairs(ctx context.Context, query string, passages []string) ([]float32, error) {
+	if reranker == nil {
+		return nil, errors.New("embed: no reranker loaded")
+	}
+	if len(passages) == 0 {
+		return nil, nil
+	}
+	select {
+	case rerankSem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	type result struct {
+		scores []float32
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-rerankSem }()
+		scores := make([]float32, len(passages))
+		for start := 0; start < len(passages); start += rerankBatch {
+			if err := ctx.Err(); err != nil {
+				done <- result{err: err}
+				return
+			}
+			end := min(start+rerankBatch, len(passages))
+			out, err := reranker.RunPipeline(query, passages[start:end])
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			for _, r := range out.Results {
+				scores[start+r.Index] = r.Score
+			}
+		}
+		done <- result{scores: scores}
+	}()
+
+	select {
+	case r := <-done:
+		return r.scores, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
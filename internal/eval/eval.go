@@ -0,0 +1,159 @@
+// Package eval reads relevance judgments and measures rankings against
+// them.
+package eval
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Qrels are graded judgments: query ID, then doc ID, to grade. Grade 0 is
+// judged not relevant.
+type Qrels map[string]map[string]int
+
+// Relevant counts the docs judged relevant to the query.
+func (q Qrels) Relevant(qid string) int {
+	n := 0
+	for _, g := range q[qid] {
+		if g > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// ReadQrels reads TREC qrels lines: "qid iteration docid grade".
+func ReadQrels(r io.Reader) (Qrels, error) {
+	qrels := make(Qrels)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 4 {
+			return nil, fmt.Errorf("qrels line %d: want 4 fields, got %d", n, len(f))
+		}
+		grade, err := strconv.Atoi(f[3])
+		if err != nil {
+			return nil, fmt.Errorf("qrels line %d: %w", n, err)
+		}
+		if qrels[f[0]] == nil {
+			qrels[f[0]] = make(map[string]int)
+		}
+		qrels[f[0]][f[2]] = grade
+	}
+	return qrels, sc.Err()
+}
+
+// Topic is one query to evaluate.
+type Topic struct {
+	ID    string
+	Query string
+}
+
+// ReadTopics reads "qid<TAB>query" lines. Blank lines and lines starting
+// with # are skipped.
+func ReadTopics(r io.Reader) ([]Topic, error) {
+	var topics []Topic
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, q, ok := strings.Cut(line, "\t")
+		if !ok || strings.TrimSpace(q) == "" {
+			return nil, fmt.Errorf("queries line %d: want qid<TAB>query", n)
+		}
+		topics = append(topics, Topic{ID: strings.TrimSpace(id), Query: strings.TrimSpace(q)})
+	}
+	return topics, sc.Err()
+}
+
+// Metrics for one ranking, or their mean over queries. NDCG and Recall are
+// at the cutoff k; MRR and MAP use the whole ranking.
+type Metrics struct {
+	NDCG   float64
+	MRR    float64
+	Recall float64
+	MAP    float64
+}
+
+// Score measures a ranking of doc IDs against the query's judgments.
+// Gains are 2^grade − 1 with a log2 discount, and the ideal ranking is
+// built from every judged doc, retrieved or not. A doc ranked more than
+// once counts only at its first position; later copies take up their
+// places but count as not relevant.
+func Score(ranked []string, judged map[string]int, k int) Metrics {
+	var m Metrics
+	relevant := 0
+	grades := make([]int, 0, len(judged))
+	for _, g := range judged {
+		if g > 0 {
+			relevant++
+			grades = append(grades, g)
+		}
+	}
+	if relevant == 0 {
+		return m
+	}
+
+	var dcg, precisionSum float64
+	found := 0
+	seen := make(map[string]bool, len(ranked))
+	for i, id := range ranked {
+		g := judged[id]
+		if g <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if i < k {
+			dcg += gain(g) / math.Log2(float64(i+2))
+			m.Recall++
+		}
+		if found == 0 {
+			m.MRR = 1 / float64(i+1)
+		}
+		found++
+		precisionSum += float64(found) / float64(i+1)
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(grades)))
+	var idcg float64
+	for i := 0; i < len(grades) && i < k; i++ {
+		idcg += gain(grades[i]) / math.Log2(float64(i+2))
+	}
+
+	m.NDCG = dcg / idcg
+	m.Recall /= float64(relevant)
+	m.MAP = precisionSum / float64(relevant)
+	return m
+}
+
+func gain(grade int) float64 { return math.Exp2(float64(grade)) - 1 }
+
+// Mean averages per-query metrics.
+func Mean(ms []Metrics) Metrics {
+	var out Metrics
+	if len(ms) == 0 {
+		return out
+	}
+	for _, m := range ms {
+		out.NDCG += m.NDCG
+		out.MRR += m.MRR
+		out.Recall += m.Recall
+		out.MAP += m.MAP
+	}
+	n := float64(len(ms))
+	out.NDCG /= n
+	out.MRR /= n
+	out.Recall /= n
+	out.MAP /= n
+	return out
+}
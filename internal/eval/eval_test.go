@@ -0,0 +1,67 @@
+package eval
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	// gains 7, 3 and 1; c is judged not relevant
+	judged := map[string]int{"a": 3, "b": 1, "c": 0, "d": 2}
+	l3 := math.Log2(3)
+	idcg := 7 + 3/l3 + 1.0/2
+	for _, tc := range []struct {
+		name   string
+		ranked []string
+		judged map[string]int
+		k      int
+		want   Metrics
+	}{
+		{"ideal", []string{"a", "d", "b"}, judged, 3, Metrics{NDCG: 1, MRR: 1, Recall: 1, MAP: 1}},
+		{"relevant past k", []string{"c", "a", "x", "b"}, judged, 3,
+			Metrics{NDCG: 7 / l3 / idcg, MRR: 0.5, Recall: 1.0 / 3, MAP: (1.0/2 + 2.0/4) / 3}},
+		{"cutoff 1", []string{"d", "a"}, judged, 1,
+			Metrics{NDCG: 3.0 / 7, MRR: 1, Recall: 1.0 / 3, MAP: (1 + 2.0/2) / 3}},
+		{"unresolved hit keeps its rank", []string{"", "a"}, judged, 10,
+			Metrics{NDCG: 7 / l3 / idcg, MRR: 0.5, Recall: 1.0 / 3, MAP: 0.5 / 3}},
+		{"repeat counted once", []string{"a", "a", "d"}, judged, 3,
+			Metrics{NDCG: (7 + 3.0/2) / idcg, MRR: 1, Recall: 2.0 / 3, MAP: (1 + 2.0/3) / 3}},
+		{"nothing retrieved", nil, judged, 10, Metrics{}},
+		{"nothing relevant", []string{"c"}, map[string]int{"c": 0}, 10, Metrics{}},
+	} {
+		got := Score(tc.ranked, tc.judged, tc.k)
+		if !near(got, tc.want) {
+			t.Errorf("%s: Score = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMean(t *testing.T) {
+	got := Mean([]Metrics{{NDCG: 1, MRR: 1, Recall: 0.5, MAP: 0.25}, {}})
+	if want := (Metrics{NDCG: 0.5, MRR: 0.5, Recall: 0.25, MAP: 0.125}); !near(got, want) {
+		t.Errorf("Mean = %+v, want %+v", got, want)
+	}
+	if got := Mean(nil); got != (Metrics{}) {
+		t.Errorf("Mean(nil) = %+v", got)
+	}
+}
+
+func TestReadQrels(t *testing.T) {
+	q, err := ReadQrels(strings.NewReader("1 0 a 2\n1 0 b 0\n\n2 0 c 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q["1"]["a"] != 2 || q.Relevant("1") != 1 || q.Relevant("2") != 1 {
+		t.Errorf("ReadQrels = %v", q)
+	}
+	if _, err := ReadQrels(strings.NewReader("1 a 2\n")); err == nil {
+		t.Error("ReadQrels accepted a 3-field line")
+	}
+}
+
+func near(a, b Metrics) bool {
+	const eps = 1e-12
+	return math.Abs(a.NDCG-b.NDCG) < eps && math.Abs(a.MRR-b.MRR) < eps &&
+		math.Abs(a.Recall-b.Recall) < eps && math.Abs(a.MAP-b.MAP) < eps
+}
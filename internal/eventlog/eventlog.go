@@ -0,0 +1,70 @@
+// Package eventlog appends JSON events to a file, one per line, off the
+// request path.
+package eventlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	bufferEvents  = 4096
+	flushInterval = time.Second
+)
+
+var dropped = expvar.NewInt("eventlog_dropped")
+
+// Log is an append-only JSONL file. A nil Log discards events.
+type Log struct {
+	ch chan []byte
+}
+
+// Open appends to the file at path, creating it if needed.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{ch: make(chan []byte, bufferEvents)}
+	go l.run(f)
+	return l, nil
+}
+
+func (l *Log) run(f *os.File) {
+	w := bufio.NewWriter(f)
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case line := <-l.ch:
+			w.Write(line)
+			w.WriteByte('\n')
+		case <-t.C:
+			if err := w.Flush(); err != nil {
+				log.Println("eventlog: flush:", err)
+			}
+		}
+	}
+}
+
+// Write queues v as one line. Events are dropped, and counted in
+// eventlog_dropped, when the writer falls behind, so logging never slows a
+// search.
+func (l *Log) Write(v interface{}) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	select {
+	case l.ch <- line:
+	default:
+		dropped.Add(1)
+	}
+}
@@ -0,0 +1,243 @@
+// Package experiment assigns search traffic to the arms of ranking
+// experiments and interleaves the rankings of two arms.
+package experiment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"turbo-query/internal/filewatch"
+)
+
+// Units an experiment can assign by.
+const (
+	UnitUser    = "user"
+	UnitSession = "session"
+)
+
+// buckets is the resolution of traffic and arm weights.
+const buckets = 10000
+
+// File is the experiments file.
+type File struct {
+	Experiments []Experiment `json:"experiments"`
+}
+
+// Experiment splits the share Traffic (default all) of units between its
+// arms by weight. Unit picks whether the user or the session ID keeps a
+// visitor in one arm. With Interleave, enrolled searches instead run both
+// of exactly two arms and show a team-draft interleaving of their results.
+type Experiment struct {
+	Name       string   `json:"name"`
+	Unit       string   `json:"unit,omitempty"`
+	Traffic    *float64 `json:"traffic,omitempty"`
+	Interleave bool     `json:"interleave,omitempty"`
+	Arms       []Arm    `json:"arms"`
+}
+
+// Arm runs the named pipeline; an empty Pipeline is the server default.
+type Arm struct {
+	Name     string `json:"name"`
+	Weight   int    `json:"weight,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+}
+
+// Set is a compiled experiments file. Experiments are tried in file order
+// and a search joins at most one.
+type Set struct {
+	experiments []Experiment
+}
+
+// Assignment is the experiment a search joined and its arm. Interleaved
+// searches have no single arm.
+type Assignment struct {
+	Experiment string
+	Unit       string
+	Arm        Arm
+	Interleave bool
+	Arms       [2]Arm
+}
+
+// Parse compiles the contents of an experiments file.
+func Parse(data []byte) (*Set, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for i := range f.Experiments {
+		e := &f.Experiments[i]
+		if e.Name == "" || seen[e.Name] {
+			return nil, fmt.Errorf("experiment %d: needs a unique name", i)
+		}
+		seen[e.Name] = true
+		if e.Unit == "" {
+			e.Unit = UnitUser
+		}
+		if e.Unit != UnitUser && e.Unit != UnitSession {
+			return nil, fmt.Errorf("experiment %q: unknown unit %q", e.Name, e.Unit)
+		}
+		if e.Traffic != nil && (*e.Traffic < 0 || *e.Traffic > 1) {
+			return nil, fmt.Errorf("experiment %q: traffic must be between 0 and 1", e.Name)
+		}
+		if e.Interleave && len(e.Arms) != 2 {
+			return nil, fmt.Errorf("experiment %q: interleaving needs exactly two arms", e.Name)
+		}
+		if len(e.Arms) < 2 {
+			return nil, fmt.Errorf("experiment %q: needs at least two arms", e.Name)
+		}
+		arms := make(map[string]bool)
+		for j := range e.Arms {
+			a := &e.Arms[j]
+			if a.Name == "" || arms[a.Name] {
+				return nil, fmt.Errorf("experiment %q: arm %d needs a unique name", e.Name, j)
+			}
+			arms[a.Name] = true
+			if a.Weight < 0 {
+				return nil, fmt.Errorf("experiment %q: arm %q has a negative weight", e.Name, a.Name)
+			}
+			if a.Weight == 0 {
+				a.Weight = 1
+			}
+		}
+	}
+	return &Set{experiments: f.Experiments}, nil
+}
+
+// Experiments returns the experiments in file order.
+func (s *Set) Experiments() []Experiment {
+	if s == nil {
+		return nil
+	}
+	return s.experiments
+}
+
+// Assign returns the first experiment the visitor is enrolled in, or nil.
+// The same IDs always get the same answer for a given file.
+func (s *Set) Assign(userID, sessionID string) *Assignment {
+	if s == nil {
+		return nil
+	}
+	for _, e := range s.experiments {
+		unit := userID
+		if e.Unit == UnitSession {
+			unit = sessionID
+		}
+		if unit == "" {
+			continue
+		}
+		traffic := 1.0
+		if e.Traffic != nil {
+			traffic = *e.Traffic
+		}
+		if bucket(e.Name, "traffic", unit) >= int(traffic*buckets) {
+			continue
+		}
+		a := &Assignment{Experiment: e.Name, Unit: unit}
+		if e.Interleave {
+			a.Interleave = true
+			a.Arms = [2]Arm{e.Arms[0], e.Arms[1]}
+			return a
+		}
+		a.Arm = pick(e.Arms, bucket(e.Name, "arm", unit))
+		return a
+	}
+	return nil
+}
+
+// pick maps a bucket onto arms in proportion to their weights.
+func pick(arms []Arm, b int) Arm {
+	total := 0
+	for _, a := range arms {
+		total += a.Weight
+	}
+	x := b * total / buckets
+	for _, a := range arms {
+		if x < a.Weight {
+			return a
+		}
+		x -= a.Weight
+	}
+	return arms[len(arms)-1]
+}
+
+// bucket hashes a unit into [0, buckets). The salt keeps the traffic and
+// arm splits independent, and the experiment name keeps experiments
+// independent of each other.
+func bucket(experiment, salt, unit string) int {
+	return int(Hash(experiment, salt, unit) % buckets)
+}
+
+// Hash is a stable 64-bit hash of the parts.
+func Hash(parts ...string) uint64 {
+	h := fnv.New64a()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// TeamDraft interleaves two rankings. In each round the team with fewer
+// picks, or a coin flip on a tie, adds its best result not already shown.
+// It returns up to k keys and, for each, the team (0 or 1) that picked it.
+// The coin flips come from seed, so the same seed gives the same list.
+func TeamDraft(a, b []string, k int, seed uint64) ([]string, []int) {
+	lists := [2][]string{a, b}
+	next := [2]int{}
+	picks := [2]int{}
+	shown := make(map[string]bool, k)
+	var out []string
+	var teams []int
+
+	// advance skips results the other team already showed
+	advance := func(t int) bool {
+		for next[t] < len(lists[t]) && shown[lists[t][next[t]]] {
+			next[t]++
+		}
+		return next[t] < len(lists[t])
+	}
+	for len(out) < k {
+		okA, okB := advance(0), advance(1)
+		if !okA && !okB {
+			break
+		}
+		t := 1
+		switch {
+		case !okB:
+			t = 0
+		case !okA:
+			t = 1
+		case picks[0] < picks[1]:
+			t = 0
+		case picks[0] == picks[1]:
+			seed = seed*6364136223846793005 + 1442695040888963407
+			if seed>>63 == 0 {
+				t = 0
+			}
+		}
+		key := lists[t][next[t]]
+		shown[key] = true
+		out = append(out, key)
+		teams = append(teams, t)
+		picks[t]++
+		next[t]++
+	}
+	return out, teams
+}
+
+// Watch loads the experiments file now and again whenever it changes,
+// passing each successful load to apply.
+func Watch(ctx context.Context, path string, interval time.Duration, apply func(*Set)) {
+	filewatch.Poll(ctx, path, interval, func(data []byte) error {
+		set, err := Parse(data)
+		if err != nil {
+			return err
+		}
+		apply(set)
+		return nil
+	})
+}
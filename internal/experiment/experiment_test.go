@@ -0,0 +1,61 @@
+package experiment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTeamDraft(t *testing.T) {
+	// seed 0 flips team 0, 0, then 1
+	for _, tc := range []struct {
+		name      string
+		a, b      []string
+		k         int
+		want      []string
+		wantTeams []int
+	}{
+		{"disjoint", []string{"a1", "a2", "a3"}, []string{"b1", "b2", "b3"}, 6,
+			[]string{"a1", "b1", "a2", "b2", "b3", "a3"}, []int{0, 1, 0, 1, 1, 0}},
+		{"shared results shown once", []string{"x", "y", "z"}, []string{"y", "x", "w"}, 4,
+			[]string{"x", "y", "z", "w"}, []int{0, 1, 0, 1}},
+		{"cut at k", []string{"a1", "a2", "a3"}, []string{"b1"}, 2,
+			[]string{"a1", "b1"}, []int{0, 1}},
+		{"one team runs out", []string{"a1", "a2", "a3"}, []string{"b1"}, 4,
+			[]string{"a1", "b1", "a2", "a3"}, []int{0, 1, 0, 0}},
+		{"one team empty", []string{"a1", "a2"}, nil, 5,
+			[]string{"a1", "a2"}, []int{0, 0}},
+		{"both empty", nil, nil, 3, nil, nil},
+	} {
+		got, teams := TeamDraft(tc.a, tc.b, tc.k, 0)
+		if !reflect.DeepEqual(got, tc.want) || !reflect.DeepEqual(teams, tc.wantTeams) {
+			t.Errorf("%s: TeamDraft = %v %v, want %v %v", tc.name, got, teams, tc.want, tc.wantTeams)
+		}
+	}
+}
+
+func TestTeamDraftSeed(t *testing.T) {
+	a, b := []string{"a1", "a2", "a3"}, []string{"b1", "b2", "b3"}
+	first := make(map[string]bool)
+	for seed := uint64(0); seed < 64; seed++ {
+		got, teams := TeamDraft(a, b, 6, seed)
+		again, againTeams := TeamDraft(a, b, 6, seed)
+		if !reflect.DeepEqual(got, again) || !reflect.DeepEqual(teams, againTeams) {
+			t.Fatalf("seed %d: TeamDraft not deterministic", seed)
+		}
+		first[got[0]] = true
+		// each team keeps its own order and neither gets ahead by two
+		var picks [2]int
+		for i, k := range got {
+			picks[teams[i]]++
+			if want := [2][]string{a, b}[teams[i]][picks[teams[i]]-1]; k != want {
+				t.Fatalf("seed %d: pick %d = %s, want %s", seed, i, k, want)
+			}
+			if d := picks[0] - picks[1]; d > 1 || d < -1 {
+				t.Fatalf("seed %d: picks %v after %d rounds", seed, picks, i+1)
+			}
+		}
+	}
+	if !first["a1"] || !first["b1"] {
+		t.Errorf("first pick over 64 seeds: %v, want both teams", first)
+	}
+}
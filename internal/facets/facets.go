@@ -0,0 +1,186 @@
+// Package facets describes facet requests and results shared by the
+// coordinator and the shards, and merges per-shard counts.
+package facets
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+const (
+	defaultSize = 10
+	maxSize     = 100
+	maxFacets   = 10
+)
+
+// ErrTooMany is returned when a request asks for more than maxFacets facets.
+var ErrTooMany = errors.New("too many facets")
+
+// Request asks for counts over one field: the most frequent terms, or the
+// number of docs in each numeric or date range.
+type Request struct {
+	Field         string         `json:"field"`
+	Size          int            `json:"size,omitempty"`
+	NumericRanges []NumericRange `json:"numeric_ranges,omitempty"`
+	DateRanges    []DateRange    `json:"date_ranges,omitempty"`
+}
+
+type NumericRange struct {
+	Name string   `json:"name"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+}
+
+// DateRange bounds are RFC 3339 strings.
+type DateRange struct {
+	Name  string  `json:"name"`
+	Start *string `json:"start,omitempty"`
+	End   *string `json:"end,omitempty"`
+}
+
+type Result struct {
+	Field   string  `json:"field"`
+	Total   int     `json:"total"`
+	Missing int     `json:"missing"`
+	Other   int     `json:"other"`
+	Terms   []Count `json:"terms,omitempty"`
+	Ranges  []Count `json:"ranges,omitempty"`
+}
+
+type Count struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Normalize fills in defaults and checks every request.
+func Normalize(reqs map[string]Request) error {
+	if len(reqs) > maxFacets {
+		return ErrTooMany
+	}
+	for name, r := range reqs {
+		if r.Field == "" {
+			return fmt.Errorf("facet %q needs a field", name)
+		}
+		if len(r.NumericRanges) > 0 && len(r.DateRanges) > 0 {
+			return fmt.Errorf("facet %q mixes numeric and date ranges", name)
+		}
+		if r.Size <= 0 {
+			r.Size = defaultSize
+		}
+		if r.Size > maxSize {
+			r.Size = maxSize
+		}
+		if err := r.bleve().Validate(); err != nil {
+			return fmt.Errorf("facet %q: %w", name, err)
+		}
+		reqs[name] = r
+	}
+	return nil
+}
+
+// shardSize is how many terms each shard returns. Asking for more than the
+// final size keeps the merged top terms close to exact.
+func (r Request) shardSize() int {
+	return r.Size + r.Size/2 + 10
+}
+
+func (r Request) bleve() *bleve.FacetRequest {
+	fr := bleve.NewFacetRequest(r.Field, r.shardSize())
+	for _, nr := range r.NumericRanges {
+		fr.AddNumericRange(nr.Name, nr.Min, nr.Max)
+	}
+	for _, dr := range r.DateRanges {
+		fr.AddDateTimeRangeString(dr.Name, dr.Start, dr.End)
+	}
+	return fr
+}
+
+// AddTo adds the facet requests to a Bleve search.
+func AddTo(sr *bleve.SearchRequest, reqs map[string]Request) {
+	for name, r := range reqs {
+		sr.AddFacet(name, r.bleve())
+	}
+}
+
+// FromBleve converts a shard's Bleve facet results.
+func FromBleve(fs search.FacetResults) map[string]Result {
+	if len(fs) == 0 {
+		return nil
+	}
+	out := make(map[string]Result, len(fs))
+	for name, f := range fs {
+		r := Result{Field: f.Field, Total: f.Total, Missing: f.Missing, Other: f.Other}
+		if f.Terms != nil {
+			for _, t := range f.Terms.Terms() {
+				r.Terms = append(r.Terms, Count{Value: t.Term, Count: t.Count})
+			}
+		}
+		for _, nr := range f.NumericRanges {
+			r.Ranges = append(r.Ranges, Count{Value: nr.Name, Count: nr.Count})
+		}
+		for _, dr := range f.DateRanges {
+			r.Ranges = append(r.Ranges, Count{Value: dr.Name, Count: dr.Count})
+		}
+		out[name] = r
+	}
+	return out
+}
+
+// Merge sums per-shard results. Terms are re-ranked by total count and cut
+// to the requested size, with the remainder folded into Other; ranges keep
+// the order they were requested in.
+func Merge(reqs map[string]Request, shards []map[string]Result) map[string]Result {
+	if len(reqs) == 0 {
+		return nil
+	}
+	out := make(map[string]Result, len(reqs))
+	for name, req := range reqs {
+		merged := Result{Field: req.Field}
+		terms := make(map[string]int)
+		ranges := make(map[string]int)
+		for _, shard := range shards {
+			r, ok := shard[name]
+			if !ok {
+				continue
+			}
+			merged.Total += r.Total
+			merged.Missing += r.Missing
+			merged.Other += r.Other
+			for _, t := range r.Terms {
+				terms[t.Value] += t.Count
+			}
+			for _, c := range r.Ranges {
+				ranges[c.Value] += c.Count
+			}
+		}
+
+		for v, n := range terms {
+			merged.Terms = append(merged.Terms, Count{Value: v, Count: n})
+		}
+		sort.Slice(merged.Terms, func(i, j int) bool {
+			if merged.Terms[i].Count != merged.Terms[j].Count {
+				return merged.Terms[i].Count > merged.Terms[j].Count
+			}
+			return merged.Terms[i].Value < merged.Terms[j].Value
+		})
+		if len(merged.Terms) > req.Size {
+			for _, t := range merged.Terms[req.Size:] {
+				merged.Other += t.Count
+			}
+			merged.Terms = merged.Terms[:req.Size]
+		}
+
+		for _, nr := range req.NumericRanges {
+			merged.Ranges = append(merged.Ranges, Count{Value: nr.Name, Count: ranges[nr.Name]})
+		}
+		for _, dr := range req.DateRanges {
+			merged.Ranges = append(merged.Ranges, Count{Value: dr.Name, Count: ranges[dr.Name]})
+		}
+		out[name] = merged
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package facets
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	one, ten := 1.0, 10.0
+	reqs := map[string]Request{
+		"lang": {Field: "lang", Size: 3},
+		"year": {Field: "year", NumericRanges: []NumericRange{{Name: "old", Max: &one}, {Name: "mid", Min: &one, Max: &ten}, {Name: "new", Min: &ten}}},
+		"none": {Field: "missing_everywhere", Size: 5},
+	}
+	shards := []map[string]Result{
+		{
+			"lang": {Field: "lang", Total: 10, Missing: 1, Other: 2, Terms: []Count{{"en", 5}, {"de", 2}, {"fr", 1}}},
+			"year": {Field: "year", Total: 7, Ranges: []Count{{"new", 4}, {"old", 3}}},
+		},
+		{
+			"lang": {Field: "lang", Total: 9, Other: 1, Terms: []Count{{"de", 4}, {"es", 3}, {"fr", 1}}},
+			"year": {Field: "year", Total: 2, Missing: 1, Ranges: []Count{{"mid", 2}}},
+		},
+		// a shard that returned no facets, say because it had no hits
+		nil,
+	}
+	want := map[string]Result{
+		// de 6, en 5, es 3, fr 2: fr is cut and folded into Other
+		"lang": {Field: "lang", Total: 19, Missing: 1, Other: 3 + 2, Terms: []Count{{"de", 6}, {"en", 5}, {"es", 3}}},
+		// ranges in request order, zero where no shard counted any
+		"year": {Field: "year", Total: 9, Missing: 1, Ranges: []Count{{"old", 3}, {"mid", 2}, {"new", 4}}},
+		"none": {Field: "missing_everywhere"},
+	}
+	if got := Merge(reqs, shards); !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge =\n%+v\nwant\n%+v", got, want)
+	}
+
+	if got := Merge(nil, shards); got != nil {
+		t.Errorf("Merge without requests = %+v, want nil", got)
+	}
+}
+
+func TestMergeTies(t *testing.T) {
+	reqs := map[string]Request{"cat": {Field: "cat", Size: 2}}
+	shards := []map[string]Result{
+		{"cat": {Terms: []Count{{"zoology", 2}, {"art", 1}}}},
+		{"cat": {Terms: []Count{{"music", 2}, {"art", 1}}}},
+	}
+	// art, music and zoology all total 2: equal counts go in term order
+	got := Merge(reqs, shards)["cat"]
+	if want := []Count{{"art", 2}, {"music", 2}}; !reflect.DeepEqual(got.Terms, want) || got.Other != 2 {
+		t.Errorf("Merge ties = %+v other %d, want %+v other 2", got.Terms, got.Other, want)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	reqs := map[string]Request{
+		"a": {Field: "lang"},
+		"b": {Field: "lang", Size: 1000},
+		"c": {Field: "lang", Size: 4},
+	}
+	if err := Normalize(reqs); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"a": defaultSize, "b": maxSize, "c": 4} {
+		if reqs[name].Size != want {
+			t.Errorf("%s: size %d, want %d", name, reqs[name].Size, want)
+		}
+	}
+
+	start := "2020-01-01T00:00:00Z"
+	one := 1.0
+	too := make(map[string]Request)
+	for i := 0; i <= maxFacets; i++ {
+		too[strings.Repeat("f", i+1)] = Request{Field: "lang"}
+	}
+	for _, tc := range []struct {
+		name    string
+		reqs    map[string]Request
+		wantErr string
+	}{
+		{"no field", map[string]Request{"x": {}}, `facet "x" needs a field`},
+		{"mixed ranges", map[string]Request{"x": {Field: "year",
+			NumericRanges: []NumericRange{{Name: "n", Min: &one}},
+			DateRanges:    []DateRange{{Name: "d", Start: &start}}}}, "mixes numeric and date ranges"},
+		{"too many", too, "too many facets"},
+	} {
+		if err := Normalize(tc.reqs); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
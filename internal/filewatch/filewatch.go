@@ -0,0 +1,48 @@
+// Package filewatch reloads a config file when it changes.
+package filewatch
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Poll reads the file now and again whenever its modification time
+// changes, passing the contents to load. If load fails the error is
+// logged and the caller keeps whatever it loaded before.
+func Poll(ctx context.Context, path string, interval time.Duration, load func([]byte) error) {
+	var last time.Time
+	check := func() {
+		st, err := os.Stat(path)
+		if err != nil {
+			log.Printf("filewatch: %s: %v", path, err)
+			return
+		}
+		if st.ModTime().Equal(last) {
+			return
+		}
+		last = st.ModTime()
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = load(data)
+		}
+		if err != nil {
+			log.Printf("filewatch: keeping previous %s: %v", path, err)
+			return
+		}
+		log.Println("filewatch: loaded", path)
+	}
+
+	check()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package fusion combines a candidate's BM25 and vector evidence into the
+// hybrid score. Shards fuse; the coordinator only validates and forwards
+// the parameters.
+package fusion
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Methods.
+const (
+	// Linear is WeightBM25 × BM25/max BM25 + WeightVector × (cosine+1)/2.
+	Linear = "linear"
+	// RRF is weighted reciprocal rank fusion: WeightBM25/(RRFK + BM25
+	// rank) + WeightVector/(RRFK + cosine rank among the candidates).
+	RRF = "rrf"
+	// LTR scores candidates with the shard's learned model; a shard
+	// without one scores them as Linear.
+	LTR = "ltr"
+)
+
+// Both methods add WeightPopularity × the doc's popularity prior (0 to 1).
+// Under RRF the prior is scaled by 1/(RRFK+1), so a prior of 1 counts as
+// much as a first rank would at the same weight. Shards pass a prior of 0
+// for vector-only fallback hits, so popularity can't lift them over
+// lexical ones.
+
+// Defaults, matching the original hard-wired ranking. Popularity is off
+// unless a request or pipeline sets its weight.
+const (
+	DefaultWeightBM25       = 0.7
+	DefaultWeightVector     = 0.3
+	DefaultWeightPopularity = 0.0
+	DefaultRRFK             = 60
+	DefaultWindow           = 100
+	MaxWindow               = 1000
+)
+
+// Params are the fusion settings for a request. Window is how many BM25
+// candidates are scored against the query vector.
+type Params struct {
+	Method           string   `json:"method,omitempty"`
+	WeightBM25       *float64 `json:"weight_bm25,omitempty"`
+	WeightVector     *float64 `json:"weight_vector,omitempty"`
+	WeightPopularity *float64 `json:"weight_popularity,omitempty"`
+	RRFK             int      `json:"rrf_k,omitempty"`
+	Window           int      `json:"window,omitempty"`
+}
+
+// Validate checks p; a nil Params is the default.
+func (p *Params) Validate() error {
+	if p == nil {
+		return nil
+	}
+	switch p.Method {
+	case "", Linear, RRF, LTR:
+	default:
+		return fmt.Errorf("unknown fusion method %q", p.Method)
+	}
+	for _, w := range []*float64{p.WeightBM25, p.WeightVector, p.WeightPopularity} {
+		if w != nil && *w < 0 {
+			return errors.New("fusion weights must not be negative")
+		}
+	}
+	if p.RRFK < 0 {
+		return errors.New("rrf_k must not be negative")
+	}
+	if p.Window < 0 || p.Window > MaxWindow {
+		return fmt.Errorf("fusion window must be between 0 and %d", MaxWindow)
+	}
+	return nil
+}
+
+// Over returns p with the fields it leaves unset taken from base, so a
+// request can change one setting of its pipeline's fusion. Either may be
+// nil.
+func (p *Params) Over(base *Params) *Params {
+	if base == nil {
+		return p
+	}
+	if p == nil {
+		return base
+	}
+	r := *p
+	if r.Method == "" {
+		r.Method = base.Method
+	}
+	if r.WeightBM25 == nil {
+		r.WeightBM25 = base.WeightBM25
+	}
+	if r.WeightVector == nil {
+		r.WeightVector = base.WeightVector
+	}
+	if r.WeightPopularity == nil {
+		r.WeightPopularity = base.WeightPopularity
+	}
+	if r.RRFK == 0 {
+		r.RRFK = base.RRFK
+	}
+	if r.Window == 0 {
+		r.Window = base.Window
+	}
+	return &r
+}
+
+// Resolved returns p with every unset field at its default.
+func (p *Params) Resolved() Params {
+	var r Params
+	if p != nil {
+		r = *p
+	}
+	if r.Method == "" {
+		r.Method = Linear
+	}
+	if r.WeightBM25 == nil {
+		w := DefaultWeightBM25
+		r.WeightBM25 = &w
+	}
+	if r.WeightVector == nil {
+		w := DefaultWeightVector
+		r.WeightVector = &w
+	}
+	if r.WeightPopularity == nil {
+		w := DefaultWeightPopularity
+		r.WeightPopularity = &w
+	}
+	if r.RRFK == 0 {
+		r.RRFK = DefaultRRFK
+	}
+	if r.Window == 0 {
+		r.Window = DefaultWindow
+	}
+	return r
+}
+
+// Score fuses one candidate. bm25Norm and cosNorm are the normalised
+// scores used by Linear; bm25Rank and vecRank are 1-based ranks used by
+// RRF, with 0 meaning the candidate has no BM25 or vector evidence. prior
+// is the doc's popularity prior.
+func (p Params) Score(bm25Norm, cosNorm float64, bm25Rank, vecRank int, prior float64) float64 {
+	if p.Method != RRF {
+		return *p.WeightBM25*bm25Norm + *p.WeightVector*cosNorm + *p.WeightPopularity*prior
+	}
+	s := *p.WeightPopularity * prior / float64(p.RRFK+1)
+	if bm25Rank > 0 {
+		s += *p.WeightBM25 / float64(p.RRFK+bm25Rank)
+	}
+	if vecRank > 0 {
+		s += *p.WeightVector / float64(p.RRFK+vecRank)
+	}
+	return s
+}
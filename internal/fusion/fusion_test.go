@@ -0,0 +1,88 @@
+package fusion
+
+import (
+	"math"
+	"testing"
+)
+
+func weights(bm25, vector, popularity float64) *Params {
+	return &Params{WeightBM25: &bm25, WeightVector: &vector, WeightPopularity: &popularity}
+}
+
+func TestScore(t *testing.T) {
+	rrf := weights(0.7, 0.3, 0.61)
+	rrf.Method = RRF
+	ltr := weights(0.5, 0.5, 0)
+	ltr.Method = LTR
+	for _, tc := range []struct {
+		name              string
+		p                 *Params
+		bm25Norm, cosNorm float64
+		bm25Rank, vecRank int
+		prior             float64
+		want              float64
+	}{
+		{"linear default", nil, 1, 0.5, 1, 1, 1, 0.7 + 0.15},
+		{"linear with popularity", weights(0.7, 0.3, 0.2), 0.5, 1, 3, 1, 0.5, 0.35 + 0.3 + 0.1},
+		{"ltr falls back to linear", ltr, 0.4, 0.8, 2, 1, 1, 0.2 + 0.4},
+		{"rrf both ranks", &Params{Method: RRF}, 0, 0, 1, 1, 0, 0.7/61 + 0.3/61},
+		{"rrf vector only", &Params{Method: RRF}, 0, 0, 0, 2, 0, 0.3 / 62},
+		{"rrf lexical only", &Params{Method: RRF, RRFK: 10}, 0, 0, 5, 0, 0, 0.7 / 15},
+		{"rrf prior counts as a first rank", rrf, 0, 0, 0, 0, 1, 0.61 / 61},
+		{"rrf prior and ranks", rrf, 0, 0, 1, 0, 0.5, 0.7/61 + 0.305/61},
+	} {
+		got := tc.p.Resolved().Score(tc.bm25Norm, tc.cosNorm, tc.bm25Rank, tc.vecRank, tc.prior)
+		if math.Abs(got-tc.want) > 1e-12 {
+			t.Errorf("%s: Score = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResolved(t *testing.T) {
+	r := (*Params)(nil).Resolved()
+	if r.Method != Linear || *r.WeightBM25 != DefaultWeightBM25 || *r.WeightVector != DefaultWeightVector ||
+		*r.WeightPopularity != 0 || r.RRFK != DefaultRRFK || r.Window != DefaultWindow {
+		t.Errorf("nil Resolved = %+v", r)
+	}
+	// a weight set to 0 stays 0
+	r = weights(0, 1, 0).Resolved()
+	if *r.WeightBM25 != 0 || *r.WeightVector != 1 {
+		t.Errorf("Resolved changed explicit weights: %v %v", *r.WeightBM25, *r.WeightVector)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	neg := -0.1
+	for _, tc := range []struct {
+		p    *Params
+		want bool
+	}{
+		{nil, true},
+		{&Params{Method: RRF, RRFK: 60, Window: MaxWindow}, true},
+		{&Params{Method: "bm25"}, false},
+		{&Params{WeightPopularity: &neg}, false},
+		{&Params{RRFK: -1}, false},
+		{&Params{Window: MaxWindow + 1}, false},
+	} {
+		if err := tc.p.Validate(); (err == nil) != tc.want {
+			t.Errorf("Validate(%+v) = %v, want ok %v", tc.p, err, tc.want)
+		}
+	}
+}
+
+func TestOver(t *testing.T) {
+	base := weights(0.5, 0.5, 0.1)
+	base.Method, base.RRFK, base.Window = RRF, 30, 200
+	bm25 := 0.9
+	got := (&Params{WeightBM25: &bm25, Window: 400}).Over(base)
+	if got.Method != RRF || *got.WeightBM25 != 0.9 || *got.WeightVector != 0.5 ||
+		*got.WeightPopularity != 0.1 || got.RRFK != 30 || got.Window != 400 {
+		t.Errorf("Over = %+v", got)
+	}
+	if *base.WeightBM25 != 0.5 || base.Window != 200 {
+		t.Errorf("Over changed base: %+v", base)
+	}
+	if (*Params)(nil).Over(base) != base || base.Over(nil) != base {
+		t.Errorf("Over with nil should return the other side")
+	}
+}
@@ -0,0 +1,222 @@
+// Package ltr scores search candidates with a learned model over a fixed
+// feature vector, and trains linear models from logged features and
+// clicks.
+package ltr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"turbo-query/internal/filewatch"
+)
+
+// Features, in vector order. Models name the features they use, so new
+// ones can be appended without breaking existing model files.
+const (
+	FeatureBM25        = "bm25"         // BM25 of the request's query
+	FeatureBM25Title   = "bm25_title"   // BM25 of the query text on title
+	FeatureBM25Text    = "bm25_text"    // BM25 of the query text on text
+	FeatureCosine      = "cosine"       // query-doc cosine
+	FeatureTitleMatch  = "title_match"  // share of query terms in the title
+	FeatureExactTitle  = "exact_title"  // 1 if the normalised title is the query
+	FeatureDocLength   = "doc_length"   // characters of text
+	FeaturePopularity  = "popularity"   // popularity prior, 0 to 1
+	FeatureQueryLength = "query_length" // terms in the normalised query
+)
+
+// FeatureNames lists every feature in vector order.
+var FeatureNames = []string{
+	FeatureBM25,
+	FeatureBM25Title,
+	FeatureBM25Text,
+	FeatureCosine,
+	FeatureTitleMatch,
+	FeatureExactTitle,
+	FeatureDocLength,
+	FeaturePopularity,
+	FeatureQueryLength,
+}
+
+var featureIndex = func() map[string]int {
+	m := make(map[string]int, len(FeatureNames))
+	for i, name := range FeatureNames {
+		m[name] = i
+	}
+	return m
+}()
+
+// Vector is a feature vector laid out as FeatureNames.
+type Vector []float64
+
+// NewVector returns a zero vector.
+func NewVector() Vector { return make(Vector, len(FeatureNames)) }
+
+// Set sets the named feature.
+func (v Vector) Set(name string, x float64) { v[featureIndex[name]] = x }
+
+// Named returns the features by name, for explanations.
+func (v Vector) Named() map[string]float64 {
+	m := make(map[string]float64, len(v))
+	for i, x := range v {
+		if i < len(FeatureNames) {
+			m[FeatureNames[i]] = x
+		}
+	}
+	return m
+}
+
+// Model types.
+const (
+	TypeLinear = "linear"
+	TypeGBDT   = "gbdt"
+)
+
+// File is the JSON model format. A linear model is Bias plus Weights
+// times Features, in order. A gbdt model is BaseScore plus the sum of its
+// trees' leaves.
+type File struct {
+	Type      string    `json:"type"`
+	Features  []string  `json:"features"`
+	Weights   []float64 `json:"weights,omitempty"`
+	Bias      float64   `json:"bias,omitempty"`
+	BaseScore float64   `json:"base_score,omitempty"`
+	Trees     []Tree    `json:"trees,omitempty"`
+}
+
+// Tree is a regression tree as a node list with the root first. A split
+// sends a value below Threshold to Left and the rest to Right; Feature
+// indexes the model's Features.
+type Tree struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// Node is a split, or a leaf when Leaf is set.
+type Node struct {
+	Feature   int      `json:"feature,omitempty"`
+	Threshold float64  `json:"threshold,omitempty"`
+	Left      int      `json:"left,omitempty"`
+	Right     int      `json:"right,omitempty"`
+	Leaf      *float64 `json:"leaf,omitempty"`
+}
+
+// Model is a compiled model file.
+type Model struct {
+	f File
+	// cols maps the model's features to feature vector positions
+	cols []int
+	// version identifies the file contents, so scores from different
+	// models aren't merged
+	version string
+}
+
+// Version is a hash of the model file the model was parsed from.
+func (m *Model) Version() string { return m.version }
+
+// Parse compiles the contents of a model file.
+func Parse(data []byte) (*Model, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if len(f.Features) == 0 {
+		return nil, errors.New("model lists no features")
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	m := &Model{f: f, cols: make([]int, len(f.Features)), version: fmt.Sprintf("%016x", h.Sum64())}
+	for i, name := range f.Features {
+		col, ok := featureIndex[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		m.cols[i] = col
+	}
+
+	switch f.Type {
+	case TypeLinear:
+		if len(f.Weights) != len(f.Features) {
+			return nil, fmt.Errorf("%d weights for %d features", len(f.Weights), len(f.Features))
+		}
+	case TypeGBDT:
+		if len(f.Trees) == 0 {
+			return nil, errors.New("gbdt model has no trees")
+		}
+		for i, t := range f.Trees {
+			if err := t.validate(len(f.Features)); err != nil {
+				return nil, fmt.Errorf("tree %d: %w", i, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown model type %q", f.Type)
+	}
+	return m, nil
+}
+
+// validate checks that every split points forward to nodes that exist, so
+// evaluation always ends at a leaf.
+func (t Tree) validate(features int) error {
+	if len(t.Nodes) == 0 {
+		return errors.New("no nodes")
+	}
+	for i, n := range t.Nodes {
+		if n.Leaf != nil {
+			continue
+		}
+		if n.Feature < 0 || n.Feature >= features {
+			return fmt.Errorf("node %d: feature %d out of range", i, n.Feature)
+		}
+		for _, child := range []int{n.Left, n.Right} {
+			if child <= i || child >= len(t.Nodes) {
+				return fmt.Errorf("node %d: child %d must come after it", i, child)
+			}
+		}
+	}
+	return nil
+}
+
+// Score scores one feature vector.
+func (m *Model) Score(features Vector) float64 {
+	x := func(i int) float64 {
+		if c := m.cols[i]; c < len(features) {
+			return features[c]
+		}
+		return 0
+	}
+	if m.f.Type == TypeLinear {
+		s := m.f.Bias
+		for i, w := range m.f.Weights {
+			s += w * x(i)
+		}
+		return s
+	}
+	s := m.f.BaseScore
+	for _, t := range m.f.Trees {
+		n := t.Nodes[0]
+		for n.Leaf == nil {
+			if x(n.Feature) < n.Threshold {
+				n = t.Nodes[n.Left]
+			} else {
+				n = t.Nodes[n.Right]
+			}
+		}
+		s += *n.Leaf
+	}
+	return s
+}
+
+// Watch loads the model file now and again whenever it changes, passing
+// each successful load to apply.
+func Watch(ctx context.Context, path string, interval time.Duration, apply func(*Model)) {
+	filewatch.Poll(ctx, path, interval, func(data []byte) error {
+		m, err := Parse(data)
+		if err != nil {
+			return err
+		}
+		apply(m)
+		return nil
+	})
+}
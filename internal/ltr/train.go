@@ -0,0 +1,247 @@
+package ltr
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// EventFeatures is the event log type of a search whose features were
+// logged. Clicks are joined to it by search ID and position.
+const EventFeatures = "features"
+
+// FeatureEvent records the results of one search and their features.
+type FeatureEvent struct {
+	Type     string         `json:"type"`
+	Time     time.Time      `json:"time"`
+	SearchID string         `json:"search_id"`
+	Query    string         `json:"query"`
+	Results  []LoggedResult `json:"results"`
+}
+
+// LoggedResult is one shown result. Features are laid out as
+// FeatureNames; pinned results have none.
+type LoggedResult struct {
+	Position int       `json:"position"`
+	ShardID  string    `json:"shard_id"`
+	DocID    string    `json:"doc_id"`
+	Features []float64 `json:"features,omitempty"`
+}
+
+// Sample is a shown result's features and whether it was clicked.
+type Sample struct {
+	Features []float64
+	Clicked  bool
+}
+
+// Query is the samples of one logged search.
+type Query struct {
+	SearchID string
+	Samples  []Sample
+}
+
+// ReadEvents joins the feature events in an event log with the clicks on
+// them. Searches without a click carry no preference and are dropped.
+func ReadEvents(r io.Reader) ([]Query, error) {
+	type line struct {
+		Type     string `json:"type"`
+		SearchID string `json:"search_id"`
+		Position int    `json:"position"`
+	}
+	var events []FeatureEvent
+	clicks := make(map[string]map[int]bool)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for n := 1; sc.Scan(); n++ {
+		var l line
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch l.Type {
+		case EventFeatures:
+			var ev FeatureEvent
+			if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			events = append(events, ev)
+		case "click":
+			if clicks[l.SearchID] == nil {
+				clicks[l.SearchID] = make(map[int]bool)
+			}
+			clicks[l.SearchID][l.Position] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []Query
+	for _, ev := range events {
+		clicked := clicks[ev.SearchID]
+		if len(clicked) == 0 {
+			continue
+		}
+		q := Query{SearchID: ev.SearchID}
+		for _, res := range ev.Results {
+			if len(res.Features) != len(FeatureNames) {
+				continue
+			}
+			q.Samples = append(q.Samples, Sample{Features: res.Features, Clicked: clicked[res.Position]})
+		}
+		out = append(out, q)
+	}
+	return out, nil
+}
+
+// TrainOptions tune Train. Zero values take the defaults.
+type TrainOptions struct {
+	// Features to use; default all
+	Features     []string
+	Epochs       int     // default 20
+	LearningRate float64 // default 0.05
+	L2           float64 // default 1e-4
+	Seed         int64
+}
+
+// TrainStats describe a training run. Accuracy is the share of training
+// pairs the model orders correctly.
+type TrainStats struct {
+	Queries  int
+	Pairs    int
+	Accuracy float64
+}
+
+// Train fits a linear model with pairwise logistic loss: within each
+// search, every clicked result should outscore every unclicked one.
+// Features are standardised while training and the weights mapped back,
+// so the model takes raw feature values.
+func Train(queries []Query, opts TrainOptions) (*File, TrainStats, error) {
+	if len(opts.Features) == 0 {
+		opts.Features = FeatureNames
+	}
+	if opts.Epochs <= 0 {
+		opts.Epochs = 20
+	}
+	if opts.LearningRate <= 0 {
+		opts.LearningRate = 0.05
+	}
+	if opts.L2 < 0 {
+		return nil, TrainStats{}, errors.New("l2 must not be negative")
+	}
+	if opts.L2 == 0 {
+		opts.L2 = 1e-4
+	}
+	cols := make([]int, len(opts.Features))
+	for i, name := range opts.Features {
+		c, ok := featureIndex[name]
+		if !ok {
+			return nil, TrainStats{}, fmt.Errorf("unknown feature %q", name)
+		}
+		cols[i] = c
+	}
+	dim := len(cols)
+
+	// mean and standard deviation of each feature over all samples
+	mean := make([]float64, dim)
+	std := make([]float64, dim)
+	n := 0
+	for _, q := range queries {
+		for _, s := range q.Samples {
+			for i, c := range cols {
+				mean[i] += s.Features[c]
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, TrainStats{}, errors.New("no clicked searches with features")
+	}
+	for i := range mean {
+		mean[i] /= float64(n)
+	}
+	for _, q := range queries {
+		for _, s := range q.Samples {
+			for i, c := range cols {
+				d := s.Features[c] - mean[i]
+				std[i] += d * d
+			}
+		}
+	}
+	for i := range std {
+		std[i] = math.Sqrt(std[i] / float64(n))
+		if std[i] == 0 {
+			std[i] = 1
+		}
+	}
+
+	// pairs hold the standardised difference clicked − unclicked
+	var pairs [][]float64
+	stats := TrainStats{}
+	for _, q := range queries {
+		before := len(pairs)
+		for _, pos := range q.Samples {
+			if !pos.Clicked {
+				continue
+			}
+			for _, neg := range q.Samples {
+				if neg.Clicked {
+					continue
+				}
+				d := make([]float64, dim)
+				for i, c := range cols {
+					d[i] = (pos.Features[c] - neg.Features[c]) / std[i]
+				}
+				pairs = append(pairs, d)
+			}
+		}
+		if len(pairs) > before {
+			stats.Queries++
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, TrainStats{}, errors.New("no clicked/unclicked pairs to learn from")
+	}
+	stats.Pairs = len(pairs)
+
+	w := make([]float64, dim)
+	rng := rand.New(rand.NewSource(opts.Seed))
+	for epoch := 0; epoch < opts.Epochs; epoch++ {
+		rng.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		for _, d := range pairs {
+			// gradient of log(1 + e^−w·d)
+			g := 1 / (1 + math.Exp(dotf(w, d)))
+			for i := range w {
+				w[i] += opts.LearningRate * (g*d[i] - opts.L2*w[i])
+			}
+		}
+	}
+
+	correct := 0
+	for _, d := range pairs {
+		if dotf(w, d) > 0 {
+			correct++
+		}
+	}
+	stats.Accuracy = float64(correct) / float64(len(pairs))
+
+	f := &File{Type: TypeLinear, Features: opts.Features, Weights: make([]float64, dim)}
+	for i := range w {
+		f.Weights[i] = w[i] / std[i]
+		f.Bias -= w[i] * mean[i] / std[i]
+	}
+	return f, stats, nil
+}
+
+func dotf(a, b []float64) float64 {
+	var s float64
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
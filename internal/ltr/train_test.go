@@ -0,0 +1,92 @@
+package ltr
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func sample(bm25, cosine, length float64, clicked bool) Sample {
+	v := NewVector()
+	v.Set(FeatureBM25, bm25)
+	v.Set(FeatureCosine, cosine)
+	v.Set(FeatureQueryLength, length)
+	return Sample{Features: v, Clicked: clicked}
+}
+
+func TestTrain(t *testing.T) {
+	// the clicked result always has the higher cosine; BM25 is noise and
+	// query length is the same for every result of a search
+	queries := []Query{
+		{SearchID: "a", Samples: []Sample{sample(9, 0.9, 2, true), sample(12, 0.2, 2, false), sample(3, 0.1, 2, false)}},
+		{SearchID: "b", Samples: []Sample{sample(2, 0.3, 1, false), sample(1, 0.8, 1, true)}},
+		{SearchID: "c", Samples: []Sample{sample(5, 0.7, 3, true), sample(6, 0.6, 3, true), sample(7, 0.4, 3, false)}},
+		{SearchID: "no clicks", Samples: []Sample{sample(4, 0.5, 1, false), sample(2, 0.4, 1, false)}},
+	}
+	features := []string{FeatureBM25, FeatureCosine, FeatureQueryLength}
+	f, stats, err := Train(queries, TrainOptions{Features: features, Epochs: 50, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queries != 3 || stats.Pairs != 2+1+2 {
+		t.Errorf("stats = %+v, want 3 queries and 5 pairs", stats)
+	}
+	if stats.Accuracy != 1 {
+		t.Errorf("accuracy = %v, want 1", stats.Accuracy)
+	}
+	if f.Type != TypeLinear || strings.Join(f.Features, ",") != strings.Join(features, ",") {
+		t.Fatalf("model = %+v", f)
+	}
+	if f.Weights[1] <= 0 {
+		t.Errorf("cosine weight = %v, want positive", f.Weights[1])
+	}
+	if f.Weights[2] != 0 {
+		t.Errorf("query_length weight = %v, want 0: it never differs within a search", f.Weights[2])
+	}
+
+	// the file parses and, on raw features, ranks every click first
+	raw, _ := json.Marshal(f)
+	m, err := Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		for _, pos := range q.Samples {
+			for _, neg := range q.Samples {
+				if pos.Clicked && !neg.Clicked && m.Score(pos.Features) <= m.Score(neg.Features) {
+					t.Errorf("search %s: clicked %v scores %v, unclicked %v scores %v", q.SearchID,
+						pos.Features, m.Score(pos.Features), neg.Features, m.Score(neg.Features))
+				}
+			}
+		}
+	}
+
+	// the same seed gives the same model
+	again, _, _ := Train(queries, TrainOptions{Features: features, Epochs: 50, Seed: 1})
+	for i := range f.Weights {
+		if f.Weights[i] != again.Weights[i] {
+			t.Errorf("weights differ between runs: %v, %v", f.Weights, again.Weights)
+			break
+		}
+	}
+}
+
+func TestTrainErrors(t *testing.T) {
+	clicked := []Query{{Samples: []Sample{sample(1, 0.5, 1, true), sample(2, 0.1, 1, false)}}}
+	for _, tc := range []struct {
+		name    string
+		queries []Query
+		opts    TrainOptions
+		want    string
+	}{
+		{"unknown feature", clicked, TrainOptions{Features: []string{"pagerank"}}, "unknown feature"},
+		{"negative l2", clicked, TrainOptions{L2: -1}, "l2 must not be negative"},
+		{"no samples", nil, TrainOptions{}, "no clicked searches"},
+		{"no pairs", []Query{{Samples: []Sample{sample(1, 0.5, 1, true), sample(2, 0.1, 1, true)}}}, TrainOptions{}, "no clicked/unclicked pairs"},
+	} {
+		_, _, err := Train(tc.queries, tc.opts)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
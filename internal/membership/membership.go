@@ -0,0 +1,57 @@
+package membership
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	StatusUp       = "up"
+	StatusDraining = "draining"
+)
+
+// Member is one shard replica as advertised in the registry.
+type Member struct {
+	ShardID    string    `json:"shard_id"`
+	Addr       string    `json:"addr"`
+	Generation int64     `json:"generation"`
+	DocCount   uint64    `json:"doc_count"`
+	Status     string    `json:"status"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Registry stores shard membership. Entries expire unless refreshed by
+// Register within ttl, so a node that dies drops out on its own.
+type Registry interface {
+	Register(ctx context.Context, m Member, ttl time.Duration) error
+	Deregister(ctx context.Context, m Member) error
+	List(ctx context.Context) ([]Member, error)
+	// Watch signals whenever membership may have changed.
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// Heartbeat registers the member returned by current and refreshes it every
+// interval until ctx is cancelled, then deregisters it.
+func Heartbeat(ctx context.Context, reg Registry, current func() Member, interval time.Duration) {
+	ttl := 3 * interval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m := current()
+		if err := reg.Register(ctx, m, ttl); err != nil && ctx.Err() == nil {
+			log.Println("membership heartbeat failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			dctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			if err := reg.Deregister(dctx, current()); err != nil {
+				log.Println("membership deregister failed:", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
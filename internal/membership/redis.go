@@ -0,0 +1,110 @@
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	redisclient "turbo-query/internal/redis"
+)
+
+const (
+	keyPrefix     = "members:"
+	changeChannel = "members:changed"
+)
+
+// RedisRegistry keeps each member under its own expiring key and publishes
+// on a channel when members join or leave. Expirations are not published,
+// so Watch also ticks every pollInterval.
+type RedisRegistry struct {
+	client       *redisclient.Client
+	pollInterval time.Duration
+}
+
+func NewRedisRegistry(client *redisclient.Client, pollInterval time.Duration) *RedisRegistry {
+	return &RedisRegistry{client: client, pollInterval: pollInterval}
+}
+
+func memberKey(m Member) string {
+	return fmt.Sprintf("%s%s:%s", keyPrefix, m.ShardID, m.Addr)
+}
+
+func (r *RedisRegistry) Register(ctx context.Context, m Member, ttl time.Duration) error {
+	m.UpdatedAt = time.Now()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	key := memberKey(m)
+	prev, _ := r.client.Get(ctx, key)
+	if err := r.client.Set(ctx, key, data, ttl); err != nil {
+		return err
+	}
+
+	// only announce joins and state changes, not plain heartbeats
+	var old Member
+	if prev == nil || json.Unmarshal(prev, &old) != nil ||
+		old.Status != m.Status || old.Generation != m.Generation {
+		return r.client.Publish(ctx, changeChannel, []byte(key))
+	}
+	return nil
+}
+
+func (r *RedisRegistry) Deregister(ctx context.Context, m Member) error {
+	key := memberKey(m)
+	if err := r.client.Del(ctx, key); err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, changeChannel, []byte(key))
+}
+
+func (r *RedisRegistry) List(ctx context.Context) ([]Member, error) {
+	keys, err := r.client.Keys(ctx, keyPrefix+"*")
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	vals, err := r.client.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]Member, 0, len(vals))
+	for _, v := range vals {
+		var m Member
+		if v == nil || json.Unmarshal(v, &m) != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (r *RedisRegistry) Watch(ctx context.Context) <-chan struct{} {
+	out := make(chan struct{}, 1)
+	msgs := r.client.Subscribe(ctx, changeChannel)
+
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(r.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-msgs:
+				if !ok {
+					// subscription dropped; keep polling
+					msgs = nil
+				}
+			case <-ticker.C:
+			}
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return out
+}
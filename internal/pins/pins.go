@@ -0,0 +1,172 @@
+// Package pins holds editorial result rules: documents pinned to the top
+// for particular queries and documents blocked from every result.
+package pins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"turbo-query/internal/filewatch"
+	"turbo-query/internal/textnorm"
+)
+
+// maxPinned bounds how many documents one rule can pin.
+const maxPinned = 10
+
+// File is the rules file. IDs are global (wiki) doc IDs.
+type File struct {
+	Pins    []Pin    `json:"pins"`
+	Blocked []string `json:"blocked"`
+}
+
+// Pin puts IDs, in order, at the top of the results for a query. Query
+// matches the whole normalised query; Pattern is a Go regexp matched
+// against it. Exact rules win over patterns, and patterns are tried in
+// file order.
+type Pin struct {
+	Query   string   `json:"query,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	IDs     []string `json:"ids"`
+}
+
+// Rules is a compiled rules file.
+type Rules struct {
+	exact    map[string][]string
+	patterns []pattern
+	blocked  []string
+	isBlock  map[string]bool
+	version  string
+}
+
+type pattern struct {
+	re  *regexp.Regexp
+	ids []string
+}
+
+// Parse compiles the contents of a rules file.
+func Parse(data []byte) (*Rules, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	r, err := Compile(f)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	r.version = hex.EncodeToString(sum[:8])
+	return r, nil
+}
+
+func Compile(f File) (*Rules, error) {
+	r := &Rules{exact: make(map[string][]string), isBlock: make(map[string]bool)}
+	for _, id := range f.Blocked {
+		if id != "" && !r.isBlock[id] {
+			r.isBlock[id] = true
+			r.blocked = append(r.blocked, id)
+		}
+	}
+	sort.Strings(r.blocked)
+
+	for i, p := range f.Pins {
+		ids := r.allowed(p.IDs)
+		if len(ids) > maxPinned {
+			return nil, fmt.Errorf("pin %d: more than %d ids", i, maxPinned)
+		}
+		switch {
+		case p.Query != "" && p.Pattern != "":
+			return nil, fmt.Errorf("pin %d: set query or pattern, not both", i)
+		case p.Query != "":
+			norm := textnorm.Title(p.Query)
+			if norm == "" {
+				return nil, fmt.Errorf("pin %d: empty query", i)
+			}
+			r.exact[norm] = ids
+		case p.Pattern != "":
+			re, err := regexp.Compile(p.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("pin %d: %w", i, err)
+			}
+			r.patterns = append(r.patterns, pattern{re: re, ids: ids})
+		default:
+			return nil, fmt.Errorf("pin %d: needs query or pattern", i)
+		}
+	}
+	return r, nil
+}
+
+// allowed drops blocked and repeated IDs, keeping order.
+func (r *Rules) allowed(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id == "" || seen[id] || r.isBlock[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	return out
+}
+
+// Pinned returns the IDs pinned for q, best first. A nil Rules pins
+// nothing.
+func (r *Rules) Pinned(q string) []string {
+	if r == nil {
+		return nil
+	}
+	norm := textnorm.Title(q)
+	if norm == "" {
+		return nil
+	}
+	if ids, ok := r.exact[norm]; ok {
+		return ids
+	}
+	for _, p := range r.patterns {
+		if p.re.MatchString(norm) {
+			return p.ids
+		}
+	}
+	return nil
+}
+
+// Blocked returns the sorted block list.
+func (r *Rules) Blocked() []string {
+	if r == nil {
+		return nil
+	}
+	return r.blocked
+}
+
+// IsBlocked reports whether id is on the block list.
+func (r *Rules) IsBlocked(id string) bool {
+	return r != nil && r.isBlock[id]
+}
+
+// Version identifies the rules file contents, so caches keyed on it miss
+// once the rules change.
+func (r *Rules) Version() string {
+	if r == nil {
+		return ""
+	}
+	return r.version
+}
+
+// Watch loads the rules file now and again whenever it changes, passing
+// each successful load to apply.
+func Watch(ctx context.Context, path string, interval time.Duration, apply func(*Rules)) {
+	filewatch.Poll(ctx, path, interval, func(data []byte) error {
+		rules, err := Parse(data)
+		if err != nil {
+			return err
+		}
+		apply(rules)
+		return nil
+	})
+}
@@ -0,0 +1,83 @@
+package pins
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestCompileAndPinned(t *testing.T) {
+	rules, err := Compile(File{
+		Blocked: []string{"666", "13", "666", ""},
+		Pins: []Pin{
+			{Query: "Python!", IDs: []string{"23862", "666", "23862", "1"}},
+			{Pattern: `^python\b`, IDs: []string{"9"}},
+			{Pattern: `^py`, IDs: []string{"8"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q    string
+		want []string
+	}{
+		// exact rules match the normalised query and drop blocked and
+		// repeated IDs
+		{"python", []string{"23862", "1"}},
+		{"  PYTHON ", []string{"23862", "1"}},
+		// exact beats pattern; patterns go in file order
+		{"python tutorial", []string{"9"}},
+		{"pygame", []string{"8"}},
+		{"java", nil},
+		{"?!", nil},
+	} {
+		if got := rules.Pinned(tc.q); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Pinned(%q) = %v, want %v", tc.q, got, tc.want)
+		}
+	}
+
+	if got, want := rules.Blocked(), []string{"13", "666"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Blocked() = %v, want %v", got, want)
+	}
+	if !rules.IsBlocked("13") || rules.IsBlocked("1") {
+		t.Error("IsBlocked disagrees with the block list")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tooMany := make([]string, maxPinned+1)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i)
+	}
+	for name, f := range map[string]File{
+		"query and pattern": {Pins: []Pin{{Query: "a", Pattern: "a", IDs: []string{"1"}}}},
+		"neither":           {Pins: []Pin{{IDs: []string{"1"}}}},
+		"empty query":       {Pins: []Pin{{Query: "!!", IDs: []string{"1"}}}},
+		"bad pattern":       {Pins: []Pin{{Pattern: "(", IDs: []string{"1"}}}},
+		"too many ids":      {Pins: []Pin{{Query: "a", IDs: tooMany}}},
+	} {
+		if _, err := Compile(f); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestNilRules(t *testing.T) {
+	var r *Rules
+	if r.Pinned("python") != nil || r.Blocked() != nil || r.IsBlocked("1") || r.Version() != "" {
+		t.Fatal("nil rules should pin and block nothing")
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	a, err := Parse([]byte(`{"blocked":["1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Parse([]byte(`{"blocked":["2"]}`))
+	if a.Version() == "" || a.Version() == b.Version() {
+		t.Fatalf("versions %q and %q should differ", a.Version(), b.Version())
+	}
+}
@@ -0,0 +1,229 @@
+// Package pipeline reads named retrieval pipelines from config. A pipeline
+// is an ordered list of stages whose parameters become the ranking options
+// of the requests that select it.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/filewatch"
+	"turbo-query/internal/fusion"
+)
+
+// Stage types, grouped by the step of the search they configure. Stages
+// must be listed in step order, since that is the order they run in.
+const (
+	StageLexical      = "lexical"       // retriever: BM25 window fused with cosine
+	StageVector       = "vector"        // retriever: nearest vectors only
+	StageFusion       = "fusion"        // how BM25 and cosine combine
+	StageFilter       = "filter"        // metadata filters
+	StageFallback     = "fallback"      // vector top-up for thin results
+	StageCrossEncoder = "cross_encoder" // reranker
+	StageMMR          = "mmr"           // diversifier
+)
+
+var stageStep = map[string]int{
+	StageLexical:      0,
+	StageVector:       0,
+	StageFusion:       1,
+	StageFilter:       2,
+	StageFallback:     2,
+	StageCrossEncoder: 3,
+	StageMMR:          4,
+}
+
+// File is the pipelines file: pipeline definitions by name.
+type File struct {
+	Pipelines map[string]struct {
+		Stages []json.RawMessage `json:"stages"`
+	} `json:"pipelines"`
+}
+
+// Lexical retrieves the Window best BM25 matches, optionally spread over
+// weighted fields, and reranks them with the query vector.
+type Lexical struct {
+	Window          int                `json:"window,omitempty"`
+	Boosts          map[string]float64 `json:"boosts,omitempty"`
+	ExactTitleBoost *float64           `json:"exact_title_boost,omitempty"`
+}
+
+// Filter restricts candidates by metadata.
+type Filter struct {
+	Filters []dsl.Filter `json:"filters"`
+}
+
+// Fallback tops up results with nearest vectors below MinHits.
+type Fallback struct {
+	MinHits int `json:"min_hits"`
+}
+
+// CrossEncoder reranks the merged top TopN.
+type CrossEncoder struct {
+	TopN     int `json:"top_n,omitempty"`
+	BudgetMs int `json:"budget_ms,omitempty"`
+}
+
+// MMR diversifies the merged hits.
+type MMR struct {
+	Lambda     *float64 `json:"lambda,omitempty"`
+	Collapse   string   `json:"collapse,omitempty"`
+	Candidates int      `json:"candidates,omitempty"`
+}
+
+// Pipeline is a compiled definition. Unset stages leave the request's own
+// options, or the server defaults, in effect.
+type Pipeline struct {
+	Name string
+	// Mode is "hybrid" for a lexical retriever, "semantic" for vector
+	Mode         string
+	Lexical      *Lexical
+	Fusion       *fusion.Params
+	Filters      []dsl.Filter
+	Fallback     *Fallback
+	CrossEncoder *CrossEncoder
+	MMR          *MMR
+}
+
+// Set is every pipeline in a file, by name.
+type Set struct {
+	byName map[string]*Pipeline
+}
+
+// Get returns the named pipeline. A nil Set has none.
+func (s *Set) Get(name string) (*Pipeline, bool) {
+	if s == nil {
+		return nil, false
+	}
+	p, ok := s.byName[name]
+	return p, ok
+}
+
+// Parse compiles the contents of a pipelines file.
+func Parse(data []byte) (*Set, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	set := &Set{byName: make(map[string]*Pipeline, len(f.Pipelines))}
+	for name, def := range f.Pipelines {
+		p, err := compile(name, def.Stages)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %q: %w", name, err)
+		}
+		set.byName[name] = p
+	}
+	return set, nil
+}
+
+func compile(name string, stages []json.RawMessage) (*Pipeline, error) {
+	p := &Pipeline{Name: name}
+	if len(stages) == 0 {
+		return nil, errors.New("no stages")
+	}
+	step := -1
+	seen := make(map[string]bool)
+	for i, raw := range stages {
+		var head struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &head); err != nil {
+			return nil, fmt.Errorf("stage %d: %w", i, err)
+		}
+		st, ok := stageStep[head.Type]
+		if !ok {
+			return nil, fmt.Errorf("stage %d: unknown type %q", i, head.Type)
+		}
+		if i == 0 && st != 0 {
+			return nil, errors.New("the first stage must be a retriever (lexical or vector)")
+		}
+		if i > 0 && st == 0 {
+			return nil, fmt.Errorf("stage %d: only one retriever is allowed", i)
+		}
+		if st < step {
+			return nil, fmt.Errorf("stage %d: %s must come before the stages above it", i, head.Type)
+		}
+		if seen[head.Type] {
+			return nil, fmt.Errorf("stage %d: %s is listed twice", i, head.Type)
+		}
+		step = st
+		seen[head.Type] = true
+
+		var err error
+		switch head.Type {
+		case StageLexical:
+			p.Mode = "hybrid"
+			p.Lexical = new(Lexical)
+			err = decode(raw, p.Lexical)
+		case StageVector:
+			p.Mode = "semantic"
+			err = decode(raw, new(struct{}))
+		case StageFusion:
+			if p.Mode != "hybrid" {
+				return nil, fmt.Errorf("stage %d: fusion needs a lexical retriever", i)
+			}
+			p.Fusion = new(fusion.Params)
+			if err = decode(raw, p.Fusion); err == nil {
+				err = p.Fusion.Validate()
+			}
+		case StageFilter:
+			var f Filter
+			err = decode(raw, &f)
+			p.Filters = f.Filters
+		case StageFallback:
+			p.Fallback = new(Fallback)
+			err = decode(raw, p.Fallback)
+		case StageCrossEncoder:
+			p.CrossEncoder = new(CrossEncoder)
+			err = decode(raw, p.CrossEncoder)
+		case StageMMR:
+			p.MMR = new(MMR)
+			err = decode(raw, p.MMR)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stage %d (%s): %w", i, head.Type, err)
+		}
+	}
+	if p.Lexical != nil && p.Lexical.Window != 0 {
+		if p.Fusion == nil {
+			p.Fusion = new(fusion.Params)
+		}
+		p.Fusion.Window = p.Lexical.Window
+		if err := p.Fusion.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// decode reads a stage's parameters, rejecting unknown ones so a typo
+// doesn't silently fall back to a default.
+func decode(raw json.RawMessage, v interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+	delete(fields, "type")
+	rest, _ := json.Marshal(fields)
+	dec := json.NewDecoder(bytes.NewReader(rest))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Watch loads the pipelines file now and again whenever it changes,
+// passing each successful load to apply.
+func Watch(ctx context.Context, path string, interval time.Duration, apply func(*Set)) {
+	filewatch.Poll(ctx, path, interval, func(data []byte) error {
+		set, err := Parse(data)
+		if err != nil {
+			return err
+		}
+		apply(set)
+		return nil
+	})
+}
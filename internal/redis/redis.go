@@ -31,3 +31,118 @@ func (c *Client) Set(ctx context.Context, key string, value []byte, ttl time.Dur
 func (c *Client) Close() error {
 	return c.rdb.Close()
 }
+
+func (c *Client) Del(ctx context.Context, keys ...string) error {
+	return c.rdb.Del(ctx, keys...).Err()
+}
+
+// Keys returns every key matching pattern, using SCAN so large keyspaces
+// don't block the server.
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := c.rdb.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// MGet returns the values for keys; missing keys come back as nil.
+func (c *Client) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	vals, err := c.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(vals))
+	for i, v := range vals {
+		if s, ok := v.(string); ok {
+			out[i] = []byte(s)
+		}
+	}
+	return out, nil
+}
+
+func (c *Client) Publish(ctx context.Context, channel string, msg []byte) error {
+	return c.rdb.Publish(ctx, channel, msg).Err()
+}
+
+// Subscribe delivers messages published on channel until ctx is cancelled.
+func (c *Client) Subscribe(ctx context.Context, channel string) <-chan []byte {
+	out := make(chan []byte, 16)
+	sub := c.rdb.Subscribe(ctx, channel)
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case out <- []byte(msg.Payload):
+				default:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// HIncrBy adds n to a hash field and returns the new value.
+func (c *Client) HIncrBy(ctx context.Context, key, field string, n int64) (int64, error) {
+	return c.rdb.HIncrBy(ctx, key, field, n).Result()
+}
+
+// HSetNX sets a hash field unless it exists, reporting whether it did.
+func (c *Client) HSetNX(ctx context.Context, key, field, value string) (bool, error) {
+	return c.rdb.HSetNX(ctx, key, field, value).Result()
+}
+
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return c.rdb.HGetAll(ctx, key).Result()
+}
+
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return c.rdb.Expire(ctx, key, ttl).Err()
+}
+
+// ZIncrBy adds n to a member's score in a sorted set.
+func (c *Client) ZIncrBy(ctx context.Context, key, member string, n float64) error {
+	return c.rdb.ZIncrBy(ctx, key, n, member).Err()
+}
+
+// ScoredMember is a sorted set member and its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZTop returns the n highest-scored members, best first.
+func (c *Client) ZTop(ctx context.Context, key string, n int64) ([]ScoredMember, error) {
+	zs, err := c.rdb.ZRevRangeWithScores(ctx, key, 0, n-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ScoredMember, len(zs))
+	for i, z := range zs {
+		out[i].Member, _ = z.Member.(string)
+		out[i].Score = z.Score
+	}
+	return out, nil
+}
+
+// Script is a Lua script that runs atomically on the server.
+type Script = redis.Script
+
+func NewScript(src string) *Script {
+	return redis.NewScript(src)
+}
+
+// Run runs script with keys and args, loading it on first use.
+func (c *Client) Run(ctx context.Context, script *Script, keys []string, args ...interface{}) (interface{}, error) {
+	return script.Run(ctx, c.rdb, keys, args...).Result()
+}
@@ -0,0 +1,207 @@
+// Package rewrite applies curated synonyms and query rewrite rules to the
+// lexical query, and reloads them when the rules file changes.
+package rewrite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"turbo-query/internal/filewatch"
+	"turbo-query/internal/textnorm"
+)
+
+// File is the rules file. Synonyms with Terms are equivalent: any one of
+// them expands to the rest. Synonyms with From and To are one-way: From
+// expands to To but not back. Rewrites run first, then removals, then
+// synonym expansion.
+type File struct {
+	Synonyms []Synonym `json:"synonyms"`
+	Rewrites []Rule    `json:"rewrites"`
+	Remove   []string  `json:"remove"`
+}
+
+type Synonym struct {
+	Name  string   `json:"name,omitempty"`
+	Terms []string `json:"terms,omitempty"`
+	From  string   `json:"from,omitempty"`
+	To    []string `json:"to,omitempty"`
+}
+
+// Rule replaces every match of Pattern (a Go regexp) with Replacement.
+type Rule struct {
+	Name        string `json:"name,omitempty"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// Rules is a compiled rules file.
+type Rules struct {
+	synonyms []synonym
+	rewrites []rule
+	remove   map[string]bool
+}
+
+type synonym struct {
+	name string
+	from []string // normalised terms that trigger the expansion
+	to   []string
+}
+
+type rule struct {
+	name string
+	re   *regexp.Regexp
+	repl string
+}
+
+// Result is the rewritten lexical query, the phrases to match as
+// alternatives, and the names of the rules that fired.
+type Result struct {
+	Query      string   `json:"query"`
+	Expansions []string `json:"expansions,omitempty"`
+	Fired      []string `json:"fired"`
+}
+
+// Load reads and compiles a rules file.
+func Load(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse compiles the contents of a rules file.
+func Parse(data []byte) (*Rules, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return Compile(f)
+}
+
+func Compile(f File) (*Rules, error) {
+	r := &Rules{remove: make(map[string]bool)}
+	for i, rw := range f.Rewrites {
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %d: %w", i, err)
+		}
+		name := rw.Name
+		if name == "" {
+			name = "rewrite:" + rw.Pattern
+		}
+		r.rewrites = append(r.rewrites, rule{name: name, re: re, repl: rw.Replacement})
+	}
+	for _, w := range f.Remove {
+		if n := textnorm.Title(w); n != "" {
+			r.remove[n] = true
+		}
+	}
+	for i, syn := range f.Synonyms {
+		switch {
+		case len(syn.Terms) > 1:
+			terms := normAll(syn.Terms)
+			name := syn.Name
+			if name == "" {
+				name = "synonym:" + strings.Join(terms, "|")
+			}
+			r.synonyms = append(r.synonyms, synonym{name: name, from: terms, to: terms})
+		case syn.From != "" && len(syn.To) > 0:
+			name := syn.Name
+			if name == "" {
+				name = "synonym:" + textnorm.Title(syn.From)
+			}
+			r.synonyms = append(r.synonyms, synonym{name: name, from: normAll([]string{syn.From}), to: normAll(syn.To)})
+		default:
+			return nil, fmt.Errorf("synonym %d: needs terms, or from and to", i)
+		}
+	}
+	return r, nil
+}
+
+func normAll(ss []string) []string {
+	out := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if n := textnorm.Title(s); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// Apply rewrites q. A nil Rules leaves the query unchanged. If the rules
+// would remove every word, the original query is kept.
+func (r *Rules) Apply(q string) Result {
+	res := Result{Query: q}
+	if r == nil {
+		return res
+	}
+
+	out := q
+	for _, rw := range r.rewrites {
+		if rw.re.MatchString(out) {
+			out = rw.re.ReplaceAllString(out, rw.repl)
+			res.Fired = append(res.Fired, rw.name)
+		}
+	}
+
+	if len(r.remove) > 0 {
+		words := strings.Fields(out)
+		kept := words[:0]
+		for _, w := range words {
+			if n := textnorm.Title(w); r.remove[n] {
+				res.Fired = append(res.Fired, "remove:"+n)
+				continue
+			}
+			kept = append(kept, w)
+		}
+		out = strings.Join(kept, " ")
+	}
+	out = strings.Join(strings.Fields(out), " ")
+	if out == "" {
+		return Result{Query: q}
+	}
+	res.Query = out
+
+	// match whole words on the normalised query
+	padded := " " + textnorm.Title(out) + " "
+	seen := make(map[string]bool)
+	for _, syn := range r.synonyms {
+		fired := false
+		for _, from := range syn.from {
+			if !strings.Contains(padded, " "+from+" ") {
+				continue
+			}
+			fired = true
+			for _, to := range syn.to {
+				if to == from || seen[to] || strings.Contains(padded, " "+to+" ") {
+					continue
+				}
+				seen[to] = true
+				res.Expansions = append(res.Expansions, to)
+			}
+		}
+		if fired {
+			res.Fired = append(res.Fired, syn.name)
+		}
+	}
+	return res
+}
+
+// Watch loads the rules file now and again whenever it changes, passing
+// each successful load to apply.
+func Watch(ctx context.Context, path string, interval time.Duration, apply func(*Rules)) {
+	filewatch.Poll(ctx, path, interval, func(data []byte) error {
+		rules, err := Parse(data)
+		if err != nil {
+			return err
+		}
+		apply(rules)
+		return nil
+	})
+}
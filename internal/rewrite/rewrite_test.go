@@ -0,0 +1,86 @@
+package rewrite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	rules, err := Compile(File{
+		Rewrites: []Rule{{Name: "strip-wiki", Pattern: `(?i)\bwikipedia\b`, Replacement: ""}},
+		Remove:   []string{"please", "the"},
+		Synonyms: []Synonym{
+			{Name: "usa", Terms: []string{"usa", "United States", "america"}},
+			{From: "NYC", To: []string{"new york city"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    string
+		want Result
+	}{
+		{"no rule fires", "byzantine empire", Result{Query: "byzantine empire"}},
+		{
+			"regex rewrite",
+			"Wikipedia byzantine empire",
+			Result{Query: "byzantine empire", Fired: []string{"strip-wiki"}},
+		},
+		{
+			"removal is case-insensitive",
+			"Please history of rome",
+			Result{Query: "history of rome", Fired: []string{"remove:please"}},
+		},
+		{
+			"equivalent group expands to the other members",
+			"usa history",
+			Result{Query: "usa history", Expansions: []string{"united states", "america"}, Fired: []string{"usa"}},
+		},
+		{
+			"members already in the query are not expanded",
+			"america usa",
+			Result{Query: "america usa", Expansions: []string{"united states"}, Fired: []string{"usa"}},
+		},
+		{
+			"one-way synonym",
+			"nyc subway",
+			Result{Query: "nyc subway", Expansions: []string{"new york city"}, Fired: []string{"synonym:nyc"}},
+		},
+		{"one-way synonym does not expand back", "new york city subway", Result{Query: "new york city subway"}},
+		{"synonyms match whole words", "usability", Result{Query: "usability"}},
+		{"removing every word keeps the original", "please the", Result{Query: "please the"}},
+		{
+			"whitespace is collapsed",
+			"  wikipedia   nyc  ",
+			Result{Query: "nyc", Expansions: []string{"new york city"}, Fired: []string{"strip-wiki", "synonym:nyc"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rules.Apply(tc.q); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Apply(%q) = %+v, want %+v", tc.q, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyNilRules(t *testing.T) {
+	var r *Rules
+	if got := r.Apply("anything"); !reflect.DeepEqual(got, Result{Query: "anything"}) {
+		t.Fatalf("nil rules changed the query: %+v", got)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, f := range []File{
+		{Rewrites: []Rule{{Pattern: "("}}},
+		{Synonyms: []Synonym{{Terms: []string{"alone"}}}},
+		{Synonyms: []Synonym{{From: "x"}}},
+	} {
+		if _, err := Compile(f); err == nil {
+			t.Errorf("Compile(%+v): no error", f)
+		}
+	}
+}
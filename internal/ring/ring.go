@@ -0,0 +1,66 @@
+// Package ring maps global doc IDs to shards with a consistent hash ring.
+// The indexer uses it to place docs, and the coordinator to find them.
+package ring
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// Defaults used by the indexer; the coordinator must be configured to
+// match.
+const (
+	DefaultShards = 4
+	DefaultVNodes = 128
+)
+
+type HashRing struct {
+	positions []uint32       // sorted
+	shardMap  map[uint32]int // position -> shardID
+}
+
+func hash32(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func NewHashRing(numShards int, vnodes int) *HashRing {
+	r := &HashRing{
+		shardMap: make(map[uint32]int),
+	}
+
+	for shardID := 0; shardID < numShards; shardID++ {
+		for v := 0; v < vnodes; v++ {
+
+			key := fmt.Sprintf("shard-%d-vnode-%d", shardID, v)
+			pos := hash32(key)
+
+			r.positions = append(r.positions, pos)
+			r.shardMap[pos] = shardID
+		}
+	}
+
+	sort.Slice(r.positions, func(i, j int) bool {
+		return r.positions[i] < r.positions[j]
+	})
+
+	return r
+}
+func (r *HashRing) ShardFor(key string) int {
+	h := hash32(key)
+
+	// binary search
+	idx := sort.Search(len(r.positions), func(i int) bool {
+		return r.positions[i] >= h
+	})
+
+	// wrap around ring
+	if idx == len(r.positions) {
+		idx = 0
+	}
+
+	pos := r.positions[idx]
+	return r.shardMap[pos]
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (st breakerState) String() string {
+	switch st {
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type breakerConfig struct {
+	threshold int
+	cooldown  time.Duration
+}
+
+func loadBreakerConfig() breakerConfig {
+	cfg := breakerConfig{threshold: 5, cooldown: 10 * time.Second}
+	if v, err := strconv.Atoi(os.Getenv("BREAKER_THRESHOLD")); err == nil && v > 0 {
+		cfg.threshold = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("BREAKER_COOLDOWN")); err == nil {
+		cfg.cooldown = v
+	}
+	return cfg
+}
+
+// breaker is a per-endpoint circuit breaker. It opens after threshold
+// consecutive failures, lets a single trial request through once cooldown
+// has passed (half-open), and closes again when that trial succeeds.
+type breaker struct {
+	cfg breakerConfig
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	trial     bool
+	lastErr   string
+	lastProbe time.Time
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cfg.cooldown {
+			return false
+		}
+		b.state = stateHalfOpen
+		b.trial = true
+		return true
+	case stateHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.trial = false
+		b.state = stateClosed
+		return
+	}
+
+	b.lastErr = err.Error()
+	b.failures++
+	b.trial = false
+	if b.state == stateHalfOpen || b.failures >= b.cfg.threshold {
+		b.state = stateOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release hands back a half-open trial whose request was cancelled before
+// it had an outcome, so the next request can try the endpoint instead.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == stateHalfOpen {
+		b.trial = false
+	}
+}
+
+// recordProbe feeds an active health check result. A failed probe opens the
+// breaker at once, whatever the threshold: probes aren't user traffic, so
+// there is no reason to let requests keep failing on a replica the probe
+// found down. A successful probe on an open breaker moves it to half-open
+// rather than closing it outright, so real traffic still has to confirm the
+// endpoint before it is fully trusted. It also frees a half-open trial, in
+// case that request never reported back.
+func (b *breaker) recordProbe(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastProbe = time.Now()
+
+	if err != nil {
+		b.lastErr = err.Error()
+		b.failures++
+		b.trial = false
+		b.state = stateOpen
+		b.openedAt = b.lastProbe
+		return
+	}
+
+	switch b.state {
+	case stateOpen, stateHalfOpen:
+		b.state = stateHalfOpen
+		b.trial = false
+	case stateClosed:
+		b.failures = 0
+	}
+}
+
+func (b *breaker) snapshot() replicaHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return replicaHealth{
+		Breaker:   b.state.String(),
+		Healthy:   b.state != stateOpen,
+		Failures:  b.failures,
+		LastError: b.lastErr,
+		LastProbe: b.lastProbe,
+	}
+}
+
+func (s *Server) breakerFor(url string) *breaker {
+	s.breakersMu.Lock()
+	defer s.breakersMu.Unlock()
+
+	b, ok := s.breakers[url]
+	if !ok {
+		b = &breaker{cfg: s.breakerCfg}
+		s.breakers[url] = b
+	}
+	return b
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func openBreaker(t *testing.T) *breaker {
+	t.Helper()
+	b := &breaker{cfg: breakerConfig{threshold: 1, cooldown: time.Nanosecond}}
+	b.record(errors.New("down"))
+	time.Sleep(time.Millisecond)
+	if !b.allow() {
+		t.Fatal("cooled-down breaker refused its trial")
+	}
+	return b
+}
+
+func TestBreakerReleaseFreesTrial(t *testing.T) {
+	b := openBreaker(t)
+	if b.allow() {
+		t.Fatal("second request allowed while the trial is out")
+	}
+	b.release()
+	if !b.allow() {
+		t.Fatal("released trial not handed to the next request")
+	}
+	b.record(nil)
+	if b.state != stateClosed {
+		t.Fatalf("state = %v after a successful trial, want closed", b.state)
+	}
+}
+
+func TestBreakerProbeFreesStuckTrial(t *testing.T) {
+	b := openBreaker(t)
+	b.recordProbe(nil)
+	if b.state != stateHalfOpen {
+		t.Fatalf("state = %v, want half-open", b.state)
+	}
+	if !b.allow() {
+		t.Fatal("successful probe left the trial taken")
+	}
+}
+
+func TestBreakerReleaseKeepsClosed(t *testing.T) {
+	b := &breaker{cfg: breakerConfig{threshold: 3, cooldown: time.Second}}
+	b.release()
+	if b.state != stateClosed || !b.allow() {
+		t.Fatal("release changed a closed breaker")
+	}
+}
+
+func TestBreakerFailedProbeOpens(t *testing.T) {
+	b := &breaker{cfg: breakerConfig{threshold: 5, cooldown: time.Minute}}
+	b.recordProbe(errors.New("connection refused"))
+	if b.state != stateOpen || b.allow() {
+		t.Fatalf("state = %v after one failed probe, want open", b.state)
+	}
+	if h := b.snapshot(); h.Healthy || h.LastError != "connection refused" {
+		t.Fatalf("snapshot = %+v, want unhealthy with the probe error", h)
+	}
+}
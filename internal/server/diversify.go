@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Collapse keys for Diversify.
+const (
+	collapseID    = "id"
+	collapseTitle = "title"
+)
+
+// Diversify re-orders the merged hits with Maximal Marginal Relevance:
+// each pick maximises Lambda*relevance - (1-Lambda)*similarity to the hits
+// already picked, so 1 keeps the hybrid order and lower values trade
+// relevance for variety. Collapse first folds hits sharing a global ID
+// ("id") or a title key ("title": the normalised title without a trailing
+// qualifier such as "(disambiguation)") into the best of them. Candidates
+// is how many merged hits are considered (default 3 × top_k).
+type Diversify struct {
+	Lambda     *float64 `json:"lambda,omitempty"`
+	Collapse   string   `json:"collapse,omitempty"`
+	Candidates int      `json:"candidates,omitempty"`
+}
+
+func (d *Diversify) validate() error {
+	if d.Lambda != nil && (*d.Lambda < 0 || *d.Lambda > 1) {
+		return errors.New("diversify lambda must be between 0 and 1")
+	}
+	switch d.Collapse {
+	case "", collapseID, collapseTitle:
+	default:
+		return fmt.Errorf("unknown collapse key %q", d.Collapse)
+	}
+	if d.Candidates < 0 {
+		return errors.New("diversify candidates must not be negative")
+	}
+	return nil
+}
+
+// candidates is how many hits to ask the shards for and merge: enough
+// for diversification and reranking to choose from.
+func (req *SearchRequest) candidates() int {
+	n := req.TopK
+	if d := req.Diversify; d != nil {
+		if d.Candidates > 0 {
+			n = max(n, d.Candidates)
+		} else {
+			n = 3 * req.TopK
+		}
+	}
+	if o := req.Rerank; o != nil {
+		n = max(n, o.TopN)
+	}
+	return min(n, maxTopK)
+}
+
+// mmr reports whether the request re-orders by MMR and so needs vectors.
+func (req *SearchRequest) mmr() bool {
+	return req.Diversify != nil && *req.Diversify.Lambda < 1
+}
+
+// diversify collapses duplicates and applies MMR to the merged candidates,
+// returning at most k hits. The vectors and keys the shards attached are
+// cleared afterwards.
+func diversify(hits []Result, k int, d *Diversify) []Result {
+	if d.Collapse != "" {
+		hits = collapse(hits, d.Collapse)
+	}
+	if *d.Lambda < 1 {
+		hits = mmr(hits, k, *d.Lambda)
+	}
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	for i := range hits {
+		hits[i].Vector = nil
+		hits[i].WikiID = ""
+		hits[i].TitleKey = ""
+	}
+	return hits
+}
+
+// collapse keeps the first hit for each key, counting the rest in its
+// Collapsed field. Hits without a key are kept as they are.
+func collapse(hits []Result, by string) []Result {
+	first := make(map[string]int, len(hits))
+	out := hits[:0]
+	for _, h := range hits {
+		key := h.WikiID
+		if by == collapseTitle {
+			key = h.TitleKey
+		}
+		if key == "" {
+			out = append(out, h)
+			continue
+		}
+		if i, ok := first[key]; ok {
+			out[i].Collapsed++
+			continue
+		}
+		first[key] = len(out)
+		out = append(out, h)
+	}
+	return out
+}
+
+// mmr greedily picks k hits from hits, which are in relevance order.
+// Relevance is the hit score scaled by the best score, so it is on the
+// same 0-1 range as cosine similarity. Hits without a vector count as
+// unlike everything.
+func mmr(hits []Result, k int, lambda float64) []Result {
+	if len(hits) < 2 {
+		return hits
+	}
+	top := hits[0].Score
+	for _, h := range hits {
+		top = max(top, h.Score)
+	}
+	if top <= 0 {
+		top = 1
+	}
+
+	picked := make([]Result, 0, min(k, len(hits)))
+	// maxSim[i] is hit i's highest similarity to anything picked so far
+	maxSim := make([]float64, len(hits))
+	used := make([]bool, len(hits))
+	for len(picked) < k && len(picked) < len(hits) {
+		best, bestVal := -1, 0.0
+		for i, h := range hits {
+			if used[i] {
+				continue
+			}
+			val := lambda*h.Score/top - (1-lambda)*maxSim[i]
+			if best < 0 || val > bestVal {
+				best, bestVal = i, val
+			}
+		}
+		used[best] = true
+		p := hits[best]
+		picked = append(picked, p)
+		if len(p.Vector) == 0 {
+			continue
+		}
+		for i, h := range hits {
+			if !used[i] && len(h.Vector) == len(p.Vector) {
+				maxSim[i] = max(maxSim[i], dot(h.Vector, p.Vector))
+			}
+		}
+	}
+	return picked
+}
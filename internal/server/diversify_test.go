@@ -0,0 +1,90 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ids(hits []Result) []string {
+	out := make([]string, len(hits))
+	for i, h := range hits {
+		out[i] = h.DocID
+	}
+	return out
+}
+
+func TestCollapse(t *testing.T) {
+	hits := []Result{
+		{DocID: "a", WikiID: "1", TitleKey: "mercury"},
+		{DocID: "b", WikiID: "2", TitleKey: "mercury"},
+		{DocID: "c", WikiID: "1", TitleKey: "venus"},
+		{DocID: "d"},
+		{DocID: "e", WikiID: "3", TitleKey: "mercury"},
+	}
+	for _, tc := range []struct {
+		by        string
+		want      []string
+		collapsed []int
+	}{
+		{collapseID, []string{"a", "b", "d", "e"}, []int{1, 0, 0, 0}},
+		{collapseTitle, []string{"a", "c", "d"}, []int{2, 0, 0}},
+	} {
+		got := collapse(append([]Result(nil), hits...), tc.by)
+		if !reflect.DeepEqual(ids(got), tc.want) {
+			t.Errorf("collapse by %s = %v, want %v", tc.by, ids(got), tc.want)
+			continue
+		}
+		for i, h := range got {
+			if h.Collapsed != tc.collapsed[i] {
+				t.Errorf("collapse by %s: %s collapsed %d, want %d", tc.by, h.DocID, h.Collapsed, tc.collapsed[i])
+			}
+		}
+	}
+}
+
+func TestMMR(t *testing.T) {
+	x := []float32{1, 0}
+	y := []float32{0, 1}
+	hits := []Result{
+		{DocID: "a", Score: 1.0, Vector: x},
+		{DocID: "a2", Score: 0.95, Vector: x},
+		{DocID: "b", Score: 0.9, Vector: y},
+		{DocID: "n", Score: 0.5},
+	}
+	for _, tc := range []struct {
+		name   string
+		lambda float64
+		k      int
+		want   []string
+	}{
+		{"lambda 1 keeps relevance order", 1, 4, []string{"a", "a2", "b", "n"}},
+		{"near duplicate gives way", 0.5, 4, []string{"a", "b", "n", "a2"}},
+		{"lambda 0 ignores relevance after the first", 0, 4, []string{"a", "b", "n", "a2"}},
+		{"k bounds the picks", 0.5, 2, []string{"a", "b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mmr(append([]Result(nil), hits...), tc.k, tc.lambda)
+			if !reflect.DeepEqual(ids(got), tc.want) {
+				t.Fatalf("mmr = %v, want %v", ids(got), tc.want)
+			}
+		})
+	}
+}
+
+func TestDiversifyClearsShardAttachments(t *testing.T) {
+	lambda := 0.5
+	hits := []Result{
+		{DocID: "a", Score: 1, Vector: []float32{1, 0}, WikiID: "1", TitleKey: "a"},
+		{DocID: "b", Score: 1, Vector: []float32{1, 0}, WikiID: "1", TitleKey: "a"},
+		{DocID: "c", Score: 0.5, Vector: []float32{0, 1}, WikiID: "2", TitleKey: "c"},
+	}
+	got := diversify(hits, 5, &Diversify{Lambda: &lambda, Collapse: collapseID})
+	if !reflect.DeepEqual(ids(got), []string{"a", "c"}) {
+		t.Fatalf("diversify = %v", ids(got))
+	}
+	for _, h := range got {
+		if h.Vector != nil || h.WikiID != "" || h.TitleKey != "" {
+			t.Fatalf("%s still carries shard attachments", h.DocID)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"turbo-query/internal/experiment"
+)
+
+// Headers that identify the visitor for experiment assignment.
+const (
+	userIDHeader    = "X-User-ID"
+	sessionIDHeader = "X-Session-ID"
+)
+
+// servedTTL is how long a served search can still receive feedback.
+const servedTTL = 24 * time.Hour
+
+// armInterleaved stands in for the arm of an interleaved search.
+const armInterleaved = "interleaved"
+
+// experimentInfo is added to the response of a search in an experiment.
+// Clients send SearchID back with feedback.
+type experimentInfo struct {
+	SearchID string `json:"search_id"`
+	Name     string `json:"name"`
+	Arm      string `json:"arm"`
+}
+
+// servedSearch is kept in Redis so feedback can be checked against what
+// was shown and credited to an arm. Docs holds the global ID shown at each
+// position, and Teams the arm that placed each position of an interleaved
+// list.
+type servedSearch struct {
+	Query      string   `json:"query"`
+	Docs       []string `json:"docs"`
+	Experiment string   `json:"experiment,omitempty"`
+	Arm        string   `json:"arm,omitempty"`
+	Teams      []string `json:"teams,omitempty"`
+}
+
+// searchEvent is the event log record of a served search.
+type searchEvent struct {
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	SearchID   string         `json:"search_id"`
+	Experiment string         `json:"experiment"`
+	Arm        string         `json:"arm"`
+	Unit       string         `json:"unit"`
+	Query      string         `json:"query"`
+	Results    []servedResult `json:"results"`
+}
+
+type servedResult struct {
+	Position int    `json:"position"`
+	ShardID  string `json:"shard_id"`
+	DocID    string `json:"doc_id"`
+	Arm      string `json:"arm,omitempty"`
+}
+
+// assign enrols the request in an experiment. Requests that pick a
+// pipeline themselves are never enrolled, so a client override can't skew
+// an arm.
+func (s *Server) assign(r *http.Request, pipeline string) *experiment.Assignment {
+	if pipeline != "" {
+		return nil
+	}
+	return s.experiments.Load().Assign(headerID(r, userIDHeader), headerID(r, sessionIDHeader))
+}
+
+// interleavedSearch runs both arms of an interleaving experiment and shows
+// their team-draft interleaving. The list depends on the visitor, so it is
+// not cached.
+func (s *Server) interleavedSearch(w http.ResponseWriter, r *http.Request, req SearchRequest, asg *experiment.Assignment) {
+	var reqs [2]SearchRequest
+	for i, arm := range asg.Arms {
+		reqs[i] = req
+		reqs[i].Pipeline, reqs[i].assigned = arm.Pipeline, true
+		if err := s.prepare(&reqs[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := s.searchContext(r, req.TimeoutMs)
+	defer cancel()
+
+	var resps [2]*SearchResponse
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i := range reqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i], errs[i] = s.FanoutSearch(ctx, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+	if writeSearchError(w, errors.Join(errs[0], errs[1])) {
+		return
+	}
+
+	var keys [2][]string
+	byKey := make(map[string]Result)
+	for i, resp := range resps {
+		for _, h := range resp.Hits {
+			k := h.ShardID + "/" + h.DocID
+			keys[i] = append(keys[i], k)
+			if _, ok := byKey[k]; !ok {
+				byKey[k] = h
+			}
+		}
+	}
+	seed := experiment.Hash(asg.Unit, reqs[0].Query)
+	merged, picks := experiment.TeamDraft(keys[0], keys[1], reqs[0].TopK, seed)
+
+	out := *resps[0]
+	out.Hits = make([]Result, len(merged))
+	teams := make([]string, len(merged))
+	for i, k := range merged {
+		out.Hits[i] = byKey[k]
+		teams[i] = asg.Arms[picks[i]].Name
+	}
+	out.TimedOut = resps[0].TimedOut || resps[1].TimedOut
+	out.Pipeline = ""
+
+	body, err := json.Marshal(out)
+	if writeSearchError(w, err) {
+		return
+	}
+	s.writeSearch(w, "BYPASS", withRewrite(body, reqs[0].rewrite), reqs[0], asg, teams)
+}
+
+// recordServed gives the search an ID, unless it already has one, and
+// stores the results shown so feedback on them can be checked. Experiment
+// searches are also counted for their arm and logged with the results. The
+// ID goes back in the response.
+func (s *Server) recordServed(body []byte, req SearchRequest, asg *experiment.Assignment, teams []string) []byte {
+	id := req.searchID
+	if id == "" {
+		id = newSearchID()
+	}
+	var shown struct {
+		Hits []Result `json:"hits"`
+	}
+	json.Unmarshal(body, &shown)
+	rec := servedSearch{Query: req.Query, Docs: make([]string, len(shown.Hits)), Teams: teams}
+	for i, h := range shown.Hits {
+		rec.Docs[i] = h.WikiID
+	}
+	if asg != nil {
+		rec.Experiment, rec.Arm = asg.Experiment, asg.Arm.Name
+		if asg.Interleave {
+			rec.Arm = armInterleaved
+		}
+	}
+
+	// written before the response goes out, so feedback can't arrive
+	// ahead of the record
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	raw, _ := json.Marshal(rec)
+	if err := s.redisClient.Set(ctx, servedKey(id), raw, servedTTL); err != nil {
+		log.Println("search: record served:", err)
+	}
+	body = withField(body, "search_id", id)
+	if asg == nil {
+		return body
+	}
+	s.redisClient.HIncrBy(ctx, experimentKey(asg.Experiment), rec.Arm+":searches", 1)
+
+	ev := searchEvent{
+		Type:       "search",
+		Time:       time.Now().UTC(),
+		SearchID:   id,
+		Experiment: asg.Experiment,
+		Arm:        rec.Arm,
+		Unit:       asg.Unit,
+		Query:      req.Query,
+		Results:    make([]servedResult, len(shown.Hits)),
+	}
+	for i, h := range shown.Hits {
+		ev.Results[i] = servedResult{Position: i + 1, ShardID: h.ShardID, DocID: h.DocID}
+		if i < len(teams) {
+			ev.Results[i].Arm = teams[i]
+		}
+	}
+	s.events.Write(ev)
+
+	return withField(body, "experiment", experimentInfo{SearchID: id, Name: asg.Experiment, Arm: rec.Arm})
+}
+
+// shows reports whether the search showed docID at the 1-based position.
+func (rec *servedSearch) shows(docID string, position int) bool {
+	return docID != "" && position >= 1 && position <= len(rec.Docs) && rec.Docs[position-1] == docID
+}
+
+func newSearchID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func servedKey(searchID string) string { return "served:" + searchID }
+
+// servedFeedbackKey is the hash of feedback taken on a served search: one
+// field per event type and position, and the click counts of experiments.
+func servedFeedbackKey(searchID string) string { return servedKey(searchID) + ":feedback" }
+
+func experimentKey(name string) string { return "experiment:" + name }
+
+// creditedArm is the arm a click on an experiment search is credited to:
+// the arm that placed the result. Impressions, and clicks beyond an
+// interleaved list, credit no one.
+func creditedArm(fb Feedback, served *servedSearch) string {
+	if served.Experiment == "" || fb.Type != feedbackClick {
+		return ""
+	}
+	if len(served.Teams) > 0 {
+		if fb.Position > len(served.Teams) {
+			return ""
+		}
+		return served.Teams[fb.Position-1]
+	}
+	return served.Arm
+}
+
+// creditClickLua defines credit_click, which credits a click to an arm for
+// feedbackScript. Its arguments are the search's feedback hash, the
+// experiment hash, the arm credited, the arm the search is counted under
+// and '1' for interleaving. For an interleaved search the arm whose results
+// got more clicks wins it; the win moves if a later click changes the lead.
+// Running inside the script means concurrent clicks on a search can't both
+// see themselves as the first or move the win twice.
+const creditClickLua = `
+local function leader(fbKey)
+	local best, bestN, tie = '', 0, false
+	local all = redis.call('HGETALL', fbKey)
+	for i = 1, #all, 2 do
+		if string.sub(all[i], 1, 4) == 'arm:' then
+			local n = tonumber(all[i + 1])
+			if n > bestN then
+				best, bestN, tie = string.sub(all[i], 5), n, false
+			elseif n == bestN and n > 0 then
+				tie = true
+			end
+		end
+	end
+	if tie then
+		return ''
+	end
+	return best
+end
+
+local function credit_click(fbKey, expKey, arm, servedArm, interleaved)
+	redis.call('HINCRBY', expKey, arm .. ':clicks', 1)
+	if redis.call('HINCRBY', fbKey, 'clicks', 1) == 1 then
+		redis.call('HINCRBY', expKey, servedArm .. ':clicked_searches', 1)
+	end
+	if interleaved == '1' then
+		local was = leader(fbKey)
+		redis.call('HINCRBY', fbKey, 'arm:' .. arm, 1)
+		local now = leader(fbKey)
+		if was ~= now then
+			if was ~= '' then
+				redis.call('HINCRBY', expKey, was .. ':wins', -1)
+			end
+			if now ~= '' then
+				redis.call('HINCRBY', expKey, now .. ':wins', 1)
+			end
+		end
+	end
+end
+`
+
+// ArmMetrics are an arm's engagement counts. CTR is the share of its
+// searches with at least one click. Wins is set for interleaving: the
+// searches where this arm's results got more clicks.
+type ArmMetrics struct {
+	Searches        int64   `json:"searches,omitempty"`
+	ClickedSearches int64   `json:"clicked_searches,omitempty"`
+	Clicks          int64   `json:"clicks"`
+	CTR             float64 `json:"ctr,omitempty"`
+	Wins            int64   `json:"wins,omitempty"`
+}
+
+// ExperimentMetrics is the current state of one experiment. For
+// interleaving, Preference is (wins A − wins B) / searches with a click:
+// positive favours the first arm.
+type ExperimentMetrics struct {
+	Name       string                `json:"name"`
+	Interleave bool                  `json:"interleave,omitempty"`
+	Searches   int64                 `json:"searches,omitempty"`
+	Clicked    int64                 `json:"clicked_searches,omitempty"`
+	Preference float64               `json:"preference,omitempty"`
+	Arms       map[string]ArmMetrics `json:"arms"`
+}
+
+// ExperimentsHandler reports per-arm metrics for the running experiments.
+func (s *Server) ExperimentsHandler(w http.ResponseWriter, r *http.Request) {
+	var out []ExperimentMetrics
+	for _, e := range s.experiments.Load().Experiments() {
+		counts, err := s.redisClient.HGetAll(r.Context(), experimentKey(e.Name))
+		if err != nil {
+			http.Error(w, "metrics store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		get := func(arm, field string) int64 {
+			n, _ := strconv.ParseInt(counts[arm+":"+field], 10, 64)
+			return n
+		}
+
+		m := ExperimentMetrics{Name: e.Name, Interleave: e.Interleave, Arms: make(map[string]ArmMetrics)}
+		for _, a := range e.Arms {
+			am := ArmMetrics{Clicks: get(a.Name, "clicks")}
+			if e.Interleave {
+				am.Wins = get(a.Name, "wins")
+			} else {
+				am.Searches = get(a.Name, "searches")
+				am.ClickedSearches = get(a.Name, "clicked_searches")
+				if am.Searches > 0 {
+					am.CTR = float64(am.ClickedSearches) / float64(am.Searches)
+				}
+			}
+			m.Arms[a.Name] = am
+		}
+		if e.Interleave {
+			m.Searches = get(armInterleaved, "searches")
+			m.Clicked = get(armInterleaved, "clicked_searches")
+			if m.Clicked > 0 {
+				a, b := m.Arms[e.Arms[0].Name], m.Arms[e.Arms[1].Name]
+				m.Preference = float64(a.Wins-b.Wins) / float64(m.Clicked)
+			}
+		}
+		out = append(out, m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"experiments": out})
+}
+
+// headerID trims a visitor ID header value.
+func headerID(r *http.Request, name string) string {
+	return strings.TrimSpace(r.Header.Get(name))
+}
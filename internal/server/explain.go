@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"turbo-query/internal/deadline"
+)
+
+// Explanation is a shard's score breakdown for a hit (see shardnode), plus
+// the hit's position after the coordinator merge and any rerank score. Tree is Bleve's BM25
+// explanation, passed through as is.
+type Explanation struct {
+	BM25         float64 `json:"bm25"`
+	BM25Max      float64 `json:"bm25_max"`
+	BM25Norm     float64 `json:"bm25_norm"`
+	Cosine       float64 `json:"cosine"`
+	CosineNorm   float64 `json:"cosine_norm"`
+	WeightBM25   float64 `json:"weight_bm25"`
+	WeightVector float64 `json:"weight_vector"`
+	// Popularity is the doc's prior, added with WeightPopularity
+	Popularity       float64 `json:"popularity,omitempty"`
+	WeightPopularity float64 `json:"weight_popularity,omitempty"`
+	// Features are the LTR features, when computed
+	Features   map[string]float64 `json:"features,omitempty"`
+	BM25Rank   int                `json:"bm25_rank,omitempty"`
+	VectorRank int                `json:"vector_rank,omitempty"`
+	ShardRank  int                `json:"shard_rank,omitempty"`
+	MergeRank  int                `json:"merge_rank,omitempty"`
+	// Hybrid is the score before cross-encoder reranking, which replaces
+	// it with CrossEncoder
+	Hybrid       float64         `json:"hybrid,omitempty"`
+	CrossEncoder float64         `json:"cross_encoder,omitempty"`
+	Tree         json.RawMessage `json:"tree,omitempty"`
+}
+
+// Coordinator stages for /search/whynot, on top of the shard stages.
+const (
+	stageReturned    = "returned"
+	stagePinned      = "pinned"
+	stageLostInMerge = "lost_in_merge"
+	stageInShardTopK = "in_shard_top_k"
+	stageNotFound    = "not_found"
+	stageUnavailable = "shard_unavailable"
+)
+
+// WhyNotRequest is a search plus the global ID of a doc expected in it.
+type WhyNotRequest struct {
+	SearchRequest
+	DocID string `json:"doc_id"`
+}
+
+// WhyNotResponse reports the stage at which the doc dropped out of the
+// pipeline, or "returned" with its final rank. Cutoff is the score it
+// would have needed to beat at that stage.
+type WhyNotResponse struct {
+	DocID   string       `json:"doc_id"`
+	ShardID string       `json:"shard_id,omitempty"`
+	LocalID string       `json:"local_id,omitempty"`
+	Stage   string       `json:"stage"`
+	Rank    int          `json:"rank,omitempty"`
+	Cutoff  float64      `json:"cutoff,omitempty"`
+	Explain *Explanation `json:"explain,omitempty"`
+}
+
+type shardWhyNotRequest struct {
+	shardRequest
+	WikiID string `json:"wiki_id"`
+}
+
+type shardWhyNotResponse struct {
+	DocID   string       `json:"doc_id,omitempty"`
+	Stage   string       `json:"stage"`
+	Cutoff  float64      `json:"cutoff,omitempty"`
+	Explain *Explanation `json:"explain,omitempty"`
+}
+
+// WhyNotHandler runs a search and traces one doc through it: every shard
+// is asked whether it holds the doc and where the doc fell out locally,
+// and the merged results say whether it survived the merge.
+func (s *Server) WhyNotHandler(w http.ResponseWriter, r *http.Request) {
+	var req WhyNotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DocID == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := s.prepare(&req.SearchRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Explain = true
+	req.Fields = []string{}
+	req.Highlight = nil
+	req.Facets = nil
+
+	ctx, cancel := deadline.FromRequest(r)
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.searchTimeout)
+		defer cancelTimeout()
+	}
+
+	resp, err := s.whyNot(ctx, req)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "search timed out", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) whyNot(ctx context.Context, req WhyNotRequest) (*WhyNotResponse, error) {
+	qvec, err := s.embedQuery(ctx, req.Query)
+	if err != nil {
+		return nil, err
+	}
+	final, err := s.fanout(ctx, req.SearchRequest, qvec)
+	if err != nil {
+		return nil, err
+	}
+	sreq := s.shardRequest(req.SearchRequest, qvec)
+
+	type outcome struct {
+		shardID string
+		resp    *shardWhyNotResponse
+		err     error
+	}
+	groups := s.shardGroups()
+	outcomes := make([]outcome, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		wg.Add(1)
+		go func(i int, g shardGroup) {
+			defer wg.Done()
+			resp, err := s.whyNotShard(ctx, g, shardWhyNotRequest{shardRequest: sreq, WikiID: req.DocID})
+			outcomes[i] = outcome{shardID: g.ID, resp: resp, err: err}
+		}(i, g)
+	}
+	wg.Wait()
+
+	resp := &WhyNotResponse{DocID: req.DocID, Stage: stageNotFound}
+	for _, o := range outcomes {
+		if o.err != nil {
+			resp.Stage = stageUnavailable
+			continue
+		}
+		if o.resp.Stage == stageNotFound {
+			continue
+		}
+		resp.ShardID = o.shardID
+		resp.LocalID = o.resp.DocID
+		resp.Stage = o.resp.Stage
+		resp.Cutoff = o.resp.Cutoff
+		resp.Explain = o.resp.Explain
+		break
+	}
+	if resp.ShardID == "" {
+		return resp, nil
+	}
+
+	// a pinned doc is returned whatever its shard made of it
+	for i, h := range final.Hits {
+		if h.ShardID == resp.ShardID && h.DocID == resp.LocalID {
+			resp.Stage = stageReturned
+			if h.Pinned {
+				resp.Stage = stagePinned
+			}
+			resp.Rank = i + 1
+			resp.Cutoff = 0
+			if h.Explain != nil {
+				resp.Explain = h.Explain
+			}
+			return resp, nil
+		}
+	}
+	if resp.Stage != stageInShardTopK {
+		return resp, nil
+	}
+	resp.Stage = stageLostInMerge
+	if n := len(final.Hits); n > 0 {
+		resp.Cutoff = final.Hits[n-1].Score
+	}
+	return resp, nil
+}
+
+// whyNotShard asks each healthy replica of the shard in turn.
+func (s *Server) whyNotShard(ctx context.Context, g shardGroup, req shardWhyNotRequest) (*shardWhyNotResponse, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	next := s.replicaPicker(g)
+	lastErr := errShardUnavailable
+	for url, ok := next(); ok; url, ok = next() {
+		var out shardWhyNotResponse
+		err := s.postShard(ctx, url+"/whynot", buf, &out)
+		if ctx.Err() == nil || err == nil {
+			s.breakerFor(url).record(err)
+		}
+		if err == nil {
+			return &out, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// postShard POSTs a JSON body to a shard endpoint and decodes the reply.
+func (s *Server) postShard(ctx context.Context, url string, body []byte, out interface{}) error {
+	return s.postShardAs(ctx, url, "", body, out)
+}
+
+// postShardAs is postShard with token, when set, sent as a bearer token,
+// for the shards' admin-only endpoints.
+func (s *Server) postShardAs(ctx context.Context, url, token string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	deadline.Set(req, ctx, shardDeadlineMargin)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("shard status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	redisclient "turbo-query/internal/redis"
+	"turbo-query/internal/textnorm"
+)
+
+// Feedback types.
+const (
+	feedbackImpression = "impression"
+	feedbackClick      = "click"
+)
+
+// maxFeedbackBatch bounds the events accepted in one /feedback body.
+const maxFeedbackBatch = 100
+
+// Redis keys for the feedback aggregates. Popularity is a sorted set of
+// global doc IDs; query and position CTR are hashes of impression and
+// click counts.
+const (
+	popularityClicksKey      = "popularity:clicks"
+	popularityImpressionsKey = "popularity:impressions"
+	positionCTRKey           = "ctr:positions"
+)
+
+func queryCTRKey(q string) string { return "ctr:query:" + q }
+
+// Feedback is one user action on a search result. SearchID is the
+// search_id of the response, DocID the global (wiki) ID of the result and
+// Position its 1-based rank; both must match what that search showed. The
+// query comes from the served search, which also credits an experiment arm
+// and joins the event to logged features.
+type Feedback struct {
+	SearchID string `json:"search_id"`
+	Type     string `json:"type"`
+	Query    string `json:"query,omitempty"`
+	DocID    string `json:"doc_id"`
+	Position int    `json:"position"`
+}
+
+func (fb *Feedback) validate() error {
+	if fb.Type != feedbackImpression && fb.Type != feedbackClick {
+		return errors.New("type must be impression or click")
+	}
+	if fb.SearchID == "" {
+		return errors.New("search_id is required")
+	}
+	if fb.DocID == "" {
+		return errors.New("doc_id is required")
+	}
+	if fb.Position < 1 {
+		return errors.New("position must be at least 1")
+	}
+	return nil
+}
+
+type feedbackEvent struct {
+	Feedback
+	Time       time.Time `json:"time"`
+	Experiment string    `json:"experiment,omitempty"`
+	Arm        string    `json:"arm,omitempty"`
+}
+
+// FeedbackHandler records impressions and clicks. The body is one event or
+// an array of them, so a client can report a page of impressions at once.
+// Events that don't match what their search showed, or repeat an earlier
+// one, are ignored and counted in the reply.
+func (s *Server) FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := decodeFeedback(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var out struct {
+		Recorded int `json:"recorded"`
+		Ignored  int `json:"ignored"`
+	}
+	for i := range events {
+		ok, err := s.recordFeedback(r.Context(), events[i])
+		if err != nil {
+			log.Println("feedback:", err)
+			http.Error(w, "feedback store unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if ok {
+			out.Recorded++
+		} else {
+			out.Ignored++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(out)
+}
+
+func decodeFeedback(body io.Reader) ([]Feedback, error) {
+	raw, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var events []Feedback
+	if raw = bytes.TrimSpace(raw); len(raw) > 0 && raw[0] == '[' {
+		err = json.Unmarshal(raw, &events)
+	} else {
+		events = make([]Feedback, 1)
+		err = json.Unmarshal(raw, &events[0])
+	}
+	if err != nil {
+		return nil, errors.New("bad request")
+	}
+	if len(events) == 0 || len(events) > maxFeedbackBatch {
+		return nil, errors.New("between 1 and " + strconv.Itoa(maxFeedbackBatch) + " events are accepted")
+	}
+	for i := range events {
+		if err := events[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// recordFeedback adds one event to the doc popularity, query CTR and
+// position CTR counts, and credits clicks on experiment searches to their
+// arm. It reports false, recording nothing, for an event on a search that
+// is unknown or expired, on a doc the search didn't show at that position,
+// or one already recorded for that position.
+func (s *Server) recordFeedback(ctx context.Context, fb Feedback) (bool, error) {
+	served, err := s.loadServed(ctx, fb.SearchID)
+	if err != nil || served == nil {
+		return false, err
+	}
+	if !served.shows(fb.DocID, fb.Position) {
+		return false, nil
+	}
+	fb.Query = served.Query
+	arm := creditedArm(fb, served)
+	first, err := s.countFeedback(ctx, fb, served, arm)
+	if err != nil || !first {
+		return false, err
+	}
+
+	ev := feedbackEvent{Feedback: fb, Time: time.Now().UTC()}
+	if served.Experiment != "" {
+		ev.Experiment, ev.Arm = served.Experiment, arm
+	}
+	s.events.Write(ev)
+	return true, nil
+}
+
+// feedbackScript records one feedback event unless it is a repeat. KEYS are
+// the search's feedback hash, the popularity sorted set, the position CTR
+// hash, the query CTR hash and the experiment hash, the last two "" when
+// unused. ARGV are the event's field in the feedback hash, that hash's TTL
+// in seconds, the doc ID, the count field, the position count field, then
+// the arm credited ("" for none), the arm the search is counted under and
+// "1" for interleaving. The dedupe mark, the counts and the arm credit are
+// set in one script, so an event that fails is neither half counted nor
+// dropped as a repeat when the client retries it.
+var feedbackScript = redisclient.NewScript(creditClickLua + `
+if redis.call('HSETNX', KEYS[1], ARGV[1], 1) == 0 then
+	return 0
+end
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+redis.call('ZINCRBY', KEYS[2], 1, ARGV[3])
+redis.call('HINCRBY', KEYS[3], ARGV[5], 1)
+if KEYS[4] ~= '' then
+	redis.call('HINCRBY', KEYS[4], ARGV[4], 1)
+end
+if ARGV[6] ~= '' then
+	credit_click(KEYS[1], KEYS[5], ARGV[6], ARGV[7], ARGV[8])
+end
+return 1
+`)
+
+// countFeedback runs feedbackScript for the event, crediting arm if it is
+// set, and reports false if the event was already counted.
+func (s *Server) countFeedback(ctx context.Context, fb Feedback, served *servedSearch, arm string) (bool, error) {
+	popKey, field := popularityImpressionsKey, "impressions"
+	if fb.Type == feedbackClick {
+		popKey, field = popularityClicksKey, "clicks"
+	}
+	queryKey, expKey := "", ""
+	if q := textnorm.Title(fb.Query); q != "" {
+		queryKey = queryCTRKey(q)
+	}
+	interleaved := "0"
+	if arm != "" {
+		expKey = experimentKey(served.Experiment)
+		if len(served.Teams) > 0 {
+			interleaved = "1"
+		}
+	}
+	pos := strconv.Itoa(fb.Position)
+	n, err := s.redisClient.Run(ctx, feedbackScript,
+		[]string{servedFeedbackKey(fb.SearchID), popKey, positionCTRKey, queryKey, expKey},
+		fb.Type+":"+pos, int64(servedTTL/time.Second), fb.DocID, field, pos+":"+field,
+		arm, served.Arm, interleaved)
+	if err != nil {
+		return false, err
+	}
+	return n == int64(1), nil
+}
+
+// loadServed returns the record of a served search, or nil if it is
+// unknown or has expired.
+func (s *Server) loadServed(ctx context.Context, searchID string) (*servedSearch, error) {
+	vals, err := s.redisClient.MGet(ctx, servedKey(searchID))
+	if err != nil || vals[0] == nil {
+		return nil, err
+	}
+	var served servedSearch
+	if json.Unmarshal(vals[0], &served) != nil {
+		return nil, nil
+	}
+	return &served, nil
+}
+
+// CTR is an impression and click count. Rate is clicks per impression.
+type CTR struct {
+	Impressions int64   `json:"impressions"`
+	Clicks      int64   `json:"clicks"`
+	Rate        float64 `json:"ctr"`
+}
+
+func ctrFrom(counts map[string]string, prefix string) CTR {
+	var c CTR
+	c.Impressions, _ = strconv.ParseInt(counts[prefix+"impressions"], 10, 64)
+	c.Clicks, _ = strconv.ParseInt(counts[prefix+"clicks"], 10, 64)
+	if c.Impressions > 0 {
+		c.Rate = float64(c.Clicks) / float64(c.Impressions)
+	}
+	return c
+}
+
+// FeedbackStatsHandler reports the CTR of the query q, or per position
+// when q is empty.
+func (s *Server) FeedbackStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := textnorm.Title(r.URL.Query().Get("q"))
+	key := positionCTRKey
+	if q != "" {
+		key = queryCTRKey(q)
+	}
+	counts, err := s.redisClient.HGetAll(r.Context(), key)
+	if err != nil {
+		http.Error(w, "feedback store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var out interface{}
+	if q != "" {
+		out = struct {
+			Query string `json:"query"`
+			CTR
+		}{q, ctrFrom(counts, "")}
+	} else {
+		positions := make(map[string]CTR)
+		for pos := 1; ; pos++ {
+			p := strconv.Itoa(pos)
+			if _, ok := counts[p+":impressions"]; !ok {
+				if _, ok := counts[p+":clicks"]; !ok {
+					break
+				}
+			}
+			positions[p] = ctrFrom(counts, p+":")
+		}
+		out = map[string]interface{}{"positions": positions}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// pushPriorsLoop sends popularity priors to the shards every interval.
+func (s *Server) pushPriorsLoop(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := s.pushPriors(ctx); err != nil {
+			log.Println("priors: push failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// pushPriors turns the click counts of the most clicked docs into priors
+// and sends every replica the priors of the docs its shard owns. Each push
+// replaces the last, so a shard that misses one catches up on the next.
+func (s *Server) pushPriors(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	top, err := s.redisClient.ZTop(ctx, popularityClicksKey, int64(s.priorDocs))
+	if err != nil {
+		return err
+	}
+	byShard := make(map[string]map[string]float64)
+	for id, p := range priors(top) {
+		shardID := strconv.Itoa(s.ring.ShardFor(id))
+		if byShard[shardID] == nil {
+			byShard[shardID] = make(map[string]float64)
+		}
+		byShard[shardID][id] = p
+	}
+
+	var wg sync.WaitGroup
+	for _, g := range s.shardGroups() {
+		body, err := json.Marshal(map[string]interface{}{"priors": byShard[g.ID]})
+		if err != nil {
+			return err
+		}
+		for _, url := range g.Replicas {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				var out struct {
+					Loaded int `json:"loaded"`
+				}
+				if err := s.postShardAs(ctx, url+"/priors", s.adminToken, body, &out); err != nil {
+					log.Println("priors: push to", url, "failed:", err)
+				}
+			}(url)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// priors maps click counts onto 0..1 on a log scale: the most clicked doc
+// has 1, and a few runaway docs don't push every other prior towards 0.
+func priors(top []redisclient.ScoredMember) map[string]float64 {
+	out := make(map[string]float64, len(top))
+	if len(top) == 0 || top[0].Score <= 0 {
+		return out
+	}
+	scale := math.Log1p(top[0].Score)
+	for _, m := range top {
+		if m.Score > 0 {
+			out[m.Member] = math.Log1p(m.Score) / scale
+		}
+	}
+	return out
+}
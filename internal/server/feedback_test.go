@@ -0,0 +1,78 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeFeedback(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		n       int
+		wantErr string
+	}{
+		{`{"search_id": "s", "type": "click", "doc_id": "7", "position": 1}`, 1, ""},
+		{`[{"search_id": "s", "type": "impression", "doc_id": "7", "position": 1},
+		   {"search_id": "s", "type": "click", "doc_id": "7", "position": 1}]`, 2, ""},
+		{`{"type": "click", "query": "rome", "doc_id": "7", "position": 1}`, 0, "search_id is required"},
+		{`{"search_id": "s", "type": "view", "doc_id": "7", "position": 1}`, 0, "type must be"},
+		{`{"search_id": "s", "type": "click", "position": 1}`, 0, "doc_id is required"},
+		{`{"search_id": "s", "type": "click", "doc_id": "7"}`, 0, "position must be"},
+		{`[]`, 0, "between 1 and"},
+		{`{`, 0, "bad request"},
+	} {
+		got, err := decodeFeedback(strings.NewReader(tc.body))
+		switch {
+		case tc.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("decodeFeedback(%s) error = %v, want %q", tc.body, err, tc.wantErr)
+			}
+		case err != nil:
+			t.Errorf("decodeFeedback(%s): %v", tc.body, err)
+		case len(got) != tc.n:
+			t.Errorf("decodeFeedback(%s) = %d events, want %d", tc.body, len(got), tc.n)
+		}
+	}
+}
+
+func TestServedShows(t *testing.T) {
+	rec := servedSearch{Docs: []string{"10", "", "30"}}
+	for _, tc := range []struct {
+		doc      string
+		position int
+		want     bool
+	}{
+		{"10", 1, true},
+		{"30", 3, true},
+		{"30", 1, false}, // shown, but not at that position
+		{"99", 1, false}, // never shown
+		{"", 2, false},   // the fetch didn't resolve position 2
+		{"10", 0, false},
+		{"10", 4, false},
+	} {
+		if got := rec.shows(tc.doc, tc.position); got != tc.want {
+			t.Errorf("shows(%q, %d) = %v, want %v", tc.doc, tc.position, got, tc.want)
+		}
+	}
+}
+
+func TestCreditedArm(t *testing.T) {
+	plain := &servedSearch{Experiment: "ltr", Arm: "b"}
+	interleaved := &servedSearch{Experiment: "ltr", Arm: "interleaved", Teams: []string{"a", "b"}}
+	for _, tc := range []struct {
+		name   string
+		fb     Feedback
+		served *servedSearch
+		want   string
+	}{
+		{"no experiment", Feedback{Type: feedbackClick, Position: 1}, &servedSearch{}, ""},
+		{"impression", Feedback{Type: feedbackImpression, Position: 1}, plain, ""},
+		{"click", Feedback{Type: feedbackClick, Position: 1}, plain, "b"},
+		{"interleaved team", Feedback{Type: feedbackClick, Position: 2}, interleaved, "b"},
+		{"beyond the teams", Feedback{Type: feedbackClick, Position: 3}, interleaved, ""},
+	} {
+		if got := creditedArm(tc.fb, tc.served); got != tc.want {
+			t.Errorf("%s: creditedArm = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/snippet"
+)
+
+// fetchRequest is the body sent to a shard's /fetch.
+type fetchRequest struct {
+	DocIDs     []string          `json:"doc_ids"`
+	Fields     []string          `json:"fields"`
+	TextLength int               `json:"text_length,omitempty"`
+	Query      string            `json:"query,omitempty"`
+	DSL        *dsl.Query        `json:"dsl,omitempty"`
+	Syntax     string            `json:"syntax,omitempty"`
+	Highlight  *HighlightOptions `json:"highlight,omitempty"`
+}
+
+type fetchResponse struct {
+	Docs       map[string]map[string]interface{} `json:"docs"`
+	Highlights map[string]map[string][]string    `json:"highlights,omitempty"`
+}
+
+// fetchPhase fills in stored fields and highlights for the final hits, and
+// returns the shards whose fields couldn't be loaded.
+func (s *Server) fetchPhase(ctx context.Context, hits []Result, req SearchRequest, qvec []float32) []string {
+	tmpl := fetchRequest{Fields: req.Fields, TextLength: req.TextLength}
+	// every hit carries its global ID, which feedback names it by
+	keepWikiID := contains(req.Fields, "wiki_id")
+	if !keepWikiID {
+		tmpl.Fields = append(append([]string(nil), tmpl.Fields...), "wiki_id")
+	}
+
+	hl := req.Highlight
+	semantic := hl != nil && hl.Mode == highlightSemantic
+	switch {
+	case semantic:
+		// passages are picked from the full text, so fetch it untruncated
+		// and trim afterwards
+		tmpl.TextLength = 0
+		if !contains(tmpl.Fields, "text") {
+			tmpl.Fields = append(append([]string(nil), tmpl.Fields...), "text")
+		}
+	case hl != nil:
+		tmpl.Query = req.lexicalQuery()
+		tmpl.DSL = req.DSL
+		tmpl.Syntax = req.Syntax
+		tmpl.Highlight = hl
+	}
+
+	failed := s.fetchFields(ctx, hits, tmpl)
+	if !keepWikiID {
+		for i := range hits {
+			delete(hits[i].Fields, "wiki_id")
+			if len(hits[i].Fields) == 0 {
+				hits[i].Fields = nil
+			}
+		}
+	}
+
+	if semantic {
+		s.semanticSnippets(ctx, hits, qvec, hl)
+		keepText := contains(req.Fields, "text")
+		for i := range hits {
+			switch {
+			case !keepText:
+				hits[i].Text = ""
+			case req.TextLength > 0:
+				hits[i].Text = snippet.Truncate(hits[i].Text, req.TextLength)
+			}
+		}
+	}
+	return failed
+}
+
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchFields loads stored fields for the merged hits from the shards that
+// own them, one request per shard. A shard that can't be reached leaves its
+// hits without fields rather than failing the search; the IDs of those
+// shards are returned, sorted.
+func (s *Server) fetchFields(ctx context.Context, hits []Result, tmpl fetchRequest) []string {
+	byShard := make(map[string][]int)
+	for i, h := range hits {
+		byShard[h.ShardID] = append(byShard[h.ShardID], i)
+	}
+
+	groups := make(map[string]shardGroup)
+	for _, g := range s.shardGroups() {
+		groups[g.ID] = g
+	}
+
+	var mu sync.Mutex
+	var failed []string
+	fail := func(shardID string) {
+		mu.Lock()
+		failed = append(failed, shardID)
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for shardID, idx := range byShard {
+		g, ok := groups[shardID]
+		if !ok {
+			log.Println("fetch: shard left routing table:", shardID)
+			fail(shardID)
+			continue
+		}
+
+		wg.Add(1)
+		go func(g shardGroup, idx []int) {
+			defer wg.Done()
+
+			req := tmpl
+			req.DocIDs = nil
+			for _, i := range idx {
+				req.DocIDs = append(req.DocIDs, hits[i].DocID)
+			}
+			fr, err := s.fetchShard(ctx, g, req)
+			if err != nil {
+				log.Println("fetch error:", g.ID, err)
+				fail(g.ID)
+				return
+			}
+			// each goroutine writes a disjoint set of hits
+			for _, i := range idx {
+				applyFields(&hits[i], fr.Docs[hits[i].DocID])
+				if h := fr.Highlights[hits[i].DocID]; len(h) > 0 {
+					hits[i].Highlights = h
+				}
+			}
+		}(g, idx)
+	}
+	wg.Wait()
+	sort.Strings(failed)
+	return failed
+}
+
+// fetchShard tries each healthy replica of the shard in turn.
+func (s *Server) fetchShard(ctx context.Context, g shardGroup, req fetchRequest) (*fetchResponse, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	next := s.replicaPicker(g)
+	lastErr := errShardUnavailable
+	for url, ok := next(); ok; url, ok = next() {
+		fr, err := s.fetchReplica(ctx, url, buf)
+		if ctx.Err() == nil || err == nil {
+			s.breakerFor(url).record(err)
+		}
+		if err == nil {
+			return fr, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (s *Server) fetchReplica(ctx context.Context, url string, body []byte) (*fetchResponse, error) {
+	var fr fetchResponse
+	if err := s.postShard(ctx, url+"/fetch", body, &fr); err != nil {
+		return nil, err
+	}
+	return &fr, nil
+}
+
+func applyFields(h *Result, fields map[string]interface{}) {
+	for name, v := range fields {
+		switch name {
+		case "title":
+			h.Title, _ = v.(string)
+		case "text":
+			h.Text, _ = v.(string)
+		case "wiki_id":
+			h.WikiID, _ = v.(string)
+			fallthrough
+		default:
+			if h.Fields == nil {
+				h.Fields = make(map[string]interface{})
+			}
+			h.Fields[name] = v
+		}
+	}
+}
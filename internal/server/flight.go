@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// flightGroup wraps singleflight so that the shared pipeline run is
+// cancelled only once every caller waiting on it has gone away. The run is
+// bounded by the deadline of the caller that started it; a caller with time
+// left when that deadline passes runs the search again under its own.
+type flightGroup struct {
+	sf      singleflight.Group
+	mu      sync.Mutex
+	flights map[string]*flight
+	seq     uint64
+}
+
+type flight struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+	// sfKey is unique per flight, so a caller that arrives after a flight
+	// was cancelled starts a new run rather than joining the dying one
+	sfKey string
+}
+
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	for {
+		f, started := g.join(ctx, key)
+		val, err := g.wait(ctx, key, f, fn)
+		if !started && ctx.Err() == nil && isContextErr(err) {
+			// the flight we joined ran out of its starter's time
+			continue
+		}
+		return val, err
+	}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// join returns the live flight for key, starting one if there is none.
+func (g *flightGroup) join(ctx context.Context, key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, ok := g.flights[key]
+	if ok && f.ctx.Err() != nil {
+		delete(g.flights, key)
+		ok = false
+	}
+	if !ok {
+		fctx := context.WithoutCancel(ctx)
+		var cancel context.CancelFunc
+		if d, ok := ctx.Deadline(); ok {
+			fctx, cancel = context.WithDeadline(fctx, d)
+		} else {
+			fctx, cancel = context.WithCancel(fctx)
+		}
+		g.seq++
+		f = &flight{ctx: fctx, cancel: cancel, sfKey: key + "#" + strconv.FormatUint(g.seq, 10)}
+		g.flights[key] = f
+	}
+	f.waiters++
+	return f, !ok
+}
+
+func (g *flightGroup) wait(ctx context.Context, key string, f *flight, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	defer g.leave(key, f)
+
+	ch := g.sf.DoChan(f.sfKey, func() (interface{}, error) {
+		return fn(f.ctx)
+	})
+	select {
+	case res := <-ch:
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightGroup) leave(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	f.cancel()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
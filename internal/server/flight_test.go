@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightSharesLiveCall(t *testing.T) {
+	var g flightGroup
+	var runs atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		runs.Add(1)
+		<-release
+		return "ok", nil
+	}
+
+	done := make(chan interface{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			v, _ := g.Do(context.Background(), "k", fn)
+			done <- v
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if v := <-done; v != "ok" {
+			t.Fatalf("got %v, want ok", v)
+		}
+	}
+	if n := runs.Load(); n != 1 {
+		t.Fatalf("%d runs, want 1", n)
+	}
+}
+
+func TestFlightLateJoinerAfterCancel(t *testing.T) {
+	var g flightGroup
+	started := make(chan struct{}, 2)
+	fn := func(ctx context.Context) (interface{}, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			// linger as a cancelled run that has not returned yet
+			time.Sleep(50 * time.Millisecond)
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+			return "fresh", nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "k", func(ctx context.Context) (interface{}, error) {
+			started <- struct{}{}
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond)
+			return nil, ctx.Err()
+		})
+		first <- err
+	}()
+	<-started
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("first caller got %v, want context.Canceled", err)
+	}
+
+	v, err := g.Do(context.Background(), "k", fn)
+	if err != nil || v != "fresh" {
+		t.Fatalf("late joiner got %v, %v; want a fresh run", v, err)
+	}
+}
+
+func TestFlightJoinerOutlivesStarterDeadline(t *testing.T) {
+	var g flightGroup
+	var runs atomic.Int32
+	fn := func(ctx context.Context) (interface{}, error) {
+		if runs.Add(1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return "retried", nil
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go g.Do(short, "k", fn)
+	time.Sleep(5 * time.Millisecond)
+
+	v, err := g.Do(context.Background(), "k", fn)
+	if err != nil || v != "retried" {
+		t.Fatalf("joiner got %v, %v; want a retry under its own context", v, err)
+	}
+}
@@ -2,16 +2,29 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"sync"
 	"time"
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/dsl"
 	"turbo-query/internal/embed"
+	"turbo-query/internal/experiment"
+	"turbo-query/internal/facets"
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/rewrite"
+	"turbo-query/internal/sorting"
 )
 
+// shardDeadlineMargin is kept back from the budget passed to shards so their
+// replies arrive before the coordinator's own deadline.
+const shardDeadlineMargin = 5 * time.Millisecond
+
 func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	defer func() {
@@ -19,33 +32,52 @@ func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 			time.Since(start),
 		)
 	}()
-	var req struct {
-		Query  string    `json:"query"`
-		TopK   int       `json:"top_k"`
-		Vector []float32 `json:"vector"`
-	}
+	var req SearchRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	if req.TopK <= 0 {
-		req.TopK = 10
+	asg := s.assign(r, req.Pipeline)
+	if asg != nil && asg.Interleave {
+		s.interleavedSearch(w, r, req, asg)
+		return
+	}
+	if asg != nil && asg.Arm.Pipeline != "" {
+		req.Pipeline, req.assigned = asg.Arm.Pipeline, true
 	}
-	ctx := r.Context()
-	cacheKey := "search:" + req.Query
+	if err := s.prepare(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.sampleFeatures() {
+		s.featureSearch(w, r, req, asg)
+		return
+	}
+
+	ctx, cancel := s.searchContext(r, req.TimeoutMs)
+	defer cancel()
+	cacheKey := req.cacheKey()
 
+	if s.eval {
+		// evaluation always ranks afresh
+		results, err := s.FanoutSearch(ctx, req)
+		if writeSearchError(w, err) {
+			return
+		}
+		body, _ := json.Marshal(results)
+		s.writeSearch(w, "BYPASS", withRewrite(body, req.rewrite), req, asg, nil)
+		return
+	}
 	if cached, err := s.redisClient.Get(ctx, cacheKey); err == nil {
 		log.Printf("cache HIT query=%q", req.Query)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("X-Cache", "HIT")
-		w.Write(cached)
+		s.writeSearch(w, "HIT", withRewrite(cached, req.rewrite), req, asg, nil)
 		return
 	}
-	val, err, _ := s.sf.Do(cacheKey, func() (interface{}, error) {
+	val, err := s.sf.Do(ctx, cacheKey, func(ctx context.Context) (interface{}, error) {
 
-		results, err := s.FanoutSearch(req.Query)
+		results, err := s.FanoutSearch(ctx, req)
 		if err != nil {
 			return nil, err
 		}
@@ -55,62 +87,329 @@ func (s *Server) SearchHandler(w http.ResponseWriter, r *http.Request) {
 			return nil, err
 		}
 
-		s.redisClient.Set(ctx, cacheKey, encoded, 5*time.Minute)
+		// partial results, including hits missing their stored fields, are
+		// not cached so a recovered shard is seen at once, nor are results
+		// whose rerank or learned ranking fell back
+		reranked := results.Rerank != rerankOverBudget && results.Rerank != rerankFailed
+		if results.Shards.complete() && reranked && results.LTR != ltrUnavailable {
+			s.redisClient.Set(ctx, cacheKey, encoded, 5*time.Minute)
+		}
 
 		return encoded, nil
 	})
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	if writeSearchError(w, err) {
 		return
 	}
 
-	encoded := val.([]byte)
+	s.writeSearch(w, "MISS", withRewrite(val.([]byte), req.rewrite), req, asg, nil)
+}
+
+// searchContext is the search budget: timeout_ms from the body, else the
+// X-Timeout-Ms header, else the server default, and never more than
+// maxSearchTimeout.
+func (s *Server) searchContext(r *http.Request, timeoutMs int) (context.Context, context.CancelFunc) {
+	ctx, cancel := deadline.FromRequest(r)
+	if d, ok := ctx.Deadline(); ok && timeoutMs <= 0 && time.Until(d) <= maxSearchTimeout {
+		return ctx, cancel
+	}
+	timeout := s.searchTimeout
+	if _, ok := ctx.Deadline(); ok && timeoutMs <= 0 {
+		timeout = maxSearchTimeout
+	}
+	if timeoutMs > 0 {
+		timeout = min(time.Duration(timeoutMs)*time.Millisecond, maxSearchTimeout)
+	}
+	tctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	return tctx, func() {
+		cancelTimeout()
+		cancel()
+	}
+}
 
+// writeSearchError reports a failed search, and whether there was one.
+func writeSearchError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "search timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		// usually the client went away; if not, it still gets an answer
+		http.Error(w, "search cancelled", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+	return true
+}
+
+// writeSearch records the search, so feedback on it can be checked, and
+// sends the encoded response. Eval searches get no feedback and aren't
+// recorded.
+func (s *Server) writeSearch(w http.ResponseWriter, cache string, body []byte, req SearchRequest, asg *experiment.Assignment, teams []string) {
+	if !s.eval {
+		body = s.recordServed(body, req, asg, teams)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Cache", "MISS")
-	w.Write(encoded)
+	w.Header().Set("X-Cache", cache)
+	w.Write(body)
+}
+
+// withRewrite adds the rewrite that fired for this request to an encoded
+// response. It is kept out of the cached body because different queries
+// can rewrite to the same form.
+func withRewrite(body []byte, rw *rewrite.Result) []byte {
+	if rw == nil {
+		return body
+	}
+	return withField(body, "rewrite", rw)
+}
+
+// withField adds a top-level field to an encoded JSON object.
+func withField(body []byte, name string, v interface{}) []byte {
+	if len(body) < 2 || body[0] != '{' {
+		return body
+	}
+	info, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	out := make([]byte, 0, len(body)+len(name)+len(info)+4)
+	out = append(out, '{', '"')
+	out = append(out, name...)
+	out = append(out, '"', ':')
+	out = append(out, info...)
+	if body[1] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, body[1:]...)
+}
+func (s *Server) FanoutSearch(ctx context.Context, req SearchRequest) (*SearchResponse, error) {
+	qvec, err := s.embedQuery(ctx, req.Query)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.fanout(ctx, req, qvec)
+	if err != nil || !*req.AutoCorrect || resp.Suggestion == "" || !lexicalMiss(resp.Hits) {
+		return resp, err
+	}
+
+	// nothing matched lexically: try the suggestion, keeping the original
+	// results if it does no better
+	creq := req
+	creq.Query = resp.Suggestion
+	creq.rewrite = nil
+	off := false
+	creq.Spellcheck = &off
+	cvec, err := s.embedQuery(ctx, creq.Query)
+	if err != nil {
+		return resp, nil
+	}
+	cresp, err := s.fanout(ctx, creq, cvec)
+	if err != nil || lexicalMiss(cresp.Hits) {
+		return resp, nil
+	}
+	cresp.Suggestion = resp.Suggestion
+	cresp.Corrected = true
+	return cresp, nil
 }
-func (s *Server) FanoutSearch(query string) ([]Result, error) {
-	var wg sync.WaitGroup
-	resultsChan := make(chan []Result, len(s.shards))
 
+func (s *Server) embedQuery(ctx context.Context, q string) ([]float32, error) {
 	embedStart := time.Now()
-	qvec, err := embed.GetEmbedding(query)
+	qvec, err := embed.GetEmbeddingContext(ctx, q)
 	log.Printf("embed latency=%v", time.Since(embedStart))
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil || len(qvec) == 0 {
 		return nil, fmt.Errorf("embedding failed: %w", err)
 	}
+	return qvec, nil
+}
+
+// shardRequest is the query-phase request sent to every shard: shards
+// return IDs and scores only.
+func (s *Server) shardRequest(req SearchRequest, qvec []float32) shardRequest {
+	return shardRequest{
+		Query:      req.lexicalQuery(),
+		Expansions: req.expansions(),
+		DSL:        req.DSL,
+		Syntax:     req.Syntax,
+		TopK:       req.candidates(),
+		Vector:     qvec,
+		QueryOnly:  true,
+
+		Boosts:          req.Boosts,
+		ExactTitleBoost: *req.ExactTitleBoost,
+		Navigational:    req.Navigational,
+
+		Filters: req.Filters,
+		Facets:  req.Facets,
+		Mode:    req.Mode,
+		Sort:    req.Sort,
+		Explain: req.Explain,
+
+		FallbackMinHits: *req.FallbackMinHits,
+		Spell:           req.spellable(),
+		Blocked:         req.pins.Blocked(),
+
+		Vectors: req.mmr(),
+		Keys:    req.Diversify != nil && req.Diversify.Collapse != "",
+		Fusion:  req.Fusion,
+
+		Features: req.searchID != "",
+	}
+}
 
-	for _, shard := range s.shards {
+// fanout runs the query phase on every shard, merges, and fetches stored
+// fields for the merged hits.
+func (s *Server) fanout(ctx context.Context, req SearchRequest, qvec []float32) (*SearchResponse, error) {
+	var wg sync.WaitGroup
+	shards := s.shardGroups()
+	resultsChan := make(chan shardOutcome, len(shards))
+
+	sreq := s.shardRequest(req, qvec)
+	for _, shard := range shards {
 		wg.Add(1)
-		go func(shardURL string) {
+		go func(g shardGroup) {
 			defer wg.Done()
-			res, err := s.queryShard(shardURL, query, qvec)
+			res, err := s.queryShard(ctx, g, sreq)
 			if err != nil {
-				log.Println("shard error:", shardURL, err)
-				return
+				log.Println("shard error:", g.ID, err)
+			} else {
+				log.Println("shard responded:", g.ID, "hits:", len(res.Hits))
 			}
-			log.Println("shard responded:", shardURL, "hits:", len(res))
-			resultsChan <- res
+			resultsChan <- shardOutcome{id: g.ID, resp: res, err: err}
 		}(shard)
 	}
 
 	wg.Wait()
 	close(resultsChan)
 
+	resp := &SearchResponse{Pipeline: req.Pipeline, Shards: ShardsInfo{Total: len(shards)}}
 	var allResults []Result
+	var shardFacets []map[string]facets.Result
+	var shardSpelling [][]spellToken
+	models := make(map[string]bool)
 	for r := range resultsChan {
-		allResults = append(allResults, r...)
+		switch {
+		case errors.Is(r.err, errShardUnavailable):
+			resp.Shards.Skipped = append(resp.Shards.Skipped, r.id)
+		case errors.Is(r.err, context.DeadlineExceeded):
+			resp.Shards.TimedOut = append(resp.Shards.TimedOut, r.id)
+		case r.err != nil:
+			resp.Shards.Failed = append(resp.Shards.Failed, r.id)
+		default:
+			resp.Shards.Successful++
+			if r.resp.TimedOut {
+				resp.Shards.TimedOut = append(resp.Shards.TimedOut, r.id)
+			}
+			allResults = append(allResults, r.resp.Hits...)
+			shardFacets = append(shardFacets, r.resp.Facets)
+			shardSpelling = append(shardSpelling, r.resp.Spelling)
+			if len(r.resp.Hits) > 0 {
+				models[r.resp.Model] = true
+			}
+		}
 	}
+	if req.learned() {
+		if !sameModel(models) {
+			// model scores from different models, or mixed with linear
+			// ones, can't be merged: fuse the whole request linearly
+			resp, err := s.fanout(ctx, req.linear(), qvec)
+			if err == nil {
+				resp.LTR = ltrUnavailable
+			}
+			return resp, err
+		}
+		resp.LTR = ltrApplied
+	}
+	sort.Strings(resp.Shards.Skipped)
+	sort.Strings(resp.Shards.Failed)
+	sort.Strings(resp.Shards.TimedOut)
+	resp.TimedOut = len(resp.Shards.TimedOut) > 0
+
+	if req.Navigational {
+		resp.Hits = mergeNavigational(allResults, req.TopK)
+	} else {
+		// merge the candidate pool, then rerank and diversify it down to
+		// top_k
+		resp.Hits = mergeTopK(allResults, sreq.TopK, req.Sort)
+		if req.Rerank != nil {
+			resp.Hits, resp.Rerank = s.rerank(ctx, req, resp.Hits)
+		}
+		if req.Diversify != nil {
+			resp.Hits = diversify(resp.Hits, req.TopK, req.Diversify)
+		}
+		if len(resp.Hits) > req.TopK {
+			resp.Hits = resp.Hits[:req.TopK]
+		}
+	}
+	resp.Hits = s.splicePinned(ctx, req, resp.Hits)
+	resp.Facets = facets.Merge(req.Facets, shardFacets)
+	if sreq.Spell {
+		resp.Suggestion = mergeSpelling(sreq.Query, shardSpelling)
+	}
+	for i := range resp.Hits {
+		if resp.Hits[i].Explain != nil {
+			resp.Hits[i].Explain.MergeRank = i + 1
+		}
+	}
+
+	// fetch phase: stored fields for the final top-k only
+	resp.Shards.FetchFailed = s.fetchPhase(ctx, resp.Hits, req, qvec)
+	return resp, nil
+}
 
-	return mergeTopK(allResults, 10), nil
+type shardOutcome struct {
+	id   string
+	resp *shardResponse
+	err  error
 }
-func (s *Server) queryShard(shardURL, query string, qvec []float32) ([]Result, error) {
 
-	body := map[string]interface{}{
-		"query":  query,
-		"top_k":  10,
-		"vector": qvec,
+// shardResponse is the body a shard returns from /search.
+type shardResponse struct {
+	Hits     []Result                 `json:"hits"`
+	Facets   map[string]facets.Result `json:"facets,omitempty"`
+	Spelling []spellToken             `json:"spelling,omitempty"`
+	TimedOut bool                     `json:"timed_out"`
+	Model    string                   `json:"model,omitempty"`
+}
+
+// shardRequest is the body sent to a shard's /search. With QueryOnly the
+// shard skips loading stored fields and returns IDs and scores.
+type shardRequest struct {
+	Query      string     `json:"query"`
+	Expansions []string   `json:"expansions,omitempty"`
+	DSL        *dsl.Query `json:"dsl,omitempty"`
+	Syntax     string     `json:"syntax,omitempty"`
+	TopK       int        `json:"top_k"`
+	Vector     []float32  `json:"vector,omitempty"`
+	QueryOnly  bool       `json:"query_only,omitempty"`
+
+	Boosts          map[string]float64 `json:"boosts,omitempty"`
+	ExactTitleBoost float64            `json:"exact_title_boost,omitempty"`
+	Navigational    bool               `json:"navigational,omitempty"`
+
+	Filters []dsl.Filter              `json:"filters,omitempty"`
+	Facets  map[string]facets.Request `json:"facets,omitempty"`
+	Mode    string                    `json:"mode,omitempty"`
+	Sort    []sorting.Field           `json:"sort,omitempty"`
+	Explain bool                      `json:"explain,omitempty"`
+
+	FallbackMinHits int      `json:"fallback_min_hits,omitempty"`
+	Spell           bool     `json:"spell,omitempty"`
+	Blocked         []string `json:"blocked,omitempty"`
+
+	Vectors bool           `json:"vectors,omitempty"`
+	Keys    bool           `json:"keys,omitempty"`
+	Fusion  *fusion.Params `json:"fusion,omitempty"`
+	// Features asks for each hit's LTR feature vector
+	Features bool `json:"features,omitempty"`
+}
+
+func (s *Server) queryReplica(ctx context.Context, shardURL string, body shardRequest) (*shardResponse, error) {
+	if s.useBinary(shardURL) {
+		return s.queryReplicaBinary(ctx, shardURL, body)
 	}
 
 	buf, err := json.Marshal(body)
@@ -118,13 +417,14 @@ func (s *Server) queryShard(shardURL, query string, qvec []float32) ([]Result, e
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", shardURL+"/search", bytes.NewBuffer(buf))
+	req, err := http.NewRequestWithContext(ctx, "POST", shardURL+"/search", bytes.NewBuffer(buf))
 
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	deadline.Set(req, ctx, shardDeadlineMargin)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
@@ -132,21 +432,63 @@ func (s *Server) queryShard(shardURL, query string, qvec []float32) ([]Result, e
 	}
 	defer resp.Body.Close()
 
-	var shardResp struct {
-		Hits []Result `json:"hits"`
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard status %d", resp.StatusCode)
 	}
 
+	var shardResp shardResponse
 	err = json.NewDecoder(resp.Body).Decode(&shardResp)
 	if err != nil {
 		return nil, err
 	}
 
-	return shardResp.Hits, nil
+	return &shardResp, nil
+}
+
+// mergeTopK orders hits by score, or by the sort spec when one is given,
+// with shard ID and doc ID breaking ties. Semantic fallback hits come after
+// every lexical hit: their vector-only score isn't comparable with a hybrid
+// one, and could otherwise beat a weak lexical match from another shard.
+func mergeTopK(results []Result, k int, spec []sorting.Field) []Result {
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if len(spec) > 0 {
+			if c := sorting.Compare(spec, a.Sort, b.Sort, a.Score, b.Score); c != 0 {
+				return c < 0
+			}
+		} else if a.Fallback != b.Fallback {
+			return !a.Fallback
+		} else if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return sorting.TieBreak(a.ShardID, a.DocID, b.ShardID, b.DocID)
+	})
+
+	if len(results) > k {
+		results = results[:k]
+	}
+	for i := range results {
+		results[i].Sort = nil
+	}
+
+	return results
 }
-func mergeTopK(results []Result, k int) []Result {
 
+// mergeNavigational is mergeTopK with exact title matches ranked first.
+func mergeNavigational(results []Result, k int) []Result {
 	sort.Slice(results, func(i, j int) bool {
-		return results[i].Score > results[j].Score
+		a, b := results[i], results[j]
+		if a.ExactTitle != b.ExactTitle {
+			return a.ExactTitle
+		}
+		if a.Fallback != b.Fallback {
+			return !a.Fallback
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return sorting.TieBreak(a.ShardID, a.DocID, b.ShardID, b.DocID)
 	})
 
 	if len(results) > k {
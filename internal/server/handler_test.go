@@ -0,0 +1,37 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeTopKFallbackLast(t *testing.T) {
+	results := []Result{
+		// a shard with no lexical match: its fallback hits score 0.3 × cosine
+		{DocID: "1", ShardID: "shard0", Score: 0.29, Fallback: true},
+		{DocID: "2", ShardID: "shard0", Score: 0.27, Fallback: true},
+		// a weak lexical hit elsewhere scores lower
+		{DocID: "3", ShardID: "shard1", Score: 0.2},
+		{DocID: "4", ShardID: "shard1", Score: 0.9},
+	}
+	var got []string
+	for _, r := range mergeTopK(results, 3, nil) {
+		got = append(got, r.DocID)
+	}
+	if want := []string{"4", "3", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeTopK = %v, want %v", got, want)
+	}
+
+	nav := []Result{
+		{DocID: "1", ShardID: "shard0", Score: 0.29, Fallback: true},
+		{DocID: "2", ShardID: "shard1", Score: 0.1},
+		{DocID: "3", ShardID: "shard1", Score: 0.05, ExactTitle: true},
+	}
+	got = nil
+	for _, r := range mergeNavigational(nav, 3) {
+		got = append(got, r.DocID)
+	}
+	if want := []string{"3", "2", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeNavigational = %v, want %v", got, want)
+	}
+}
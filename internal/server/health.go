@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"turbo-query/internal/wire"
+)
+
+type replicaHealth struct {
+	URL       string    `json:"url"`
+	Protocol  string    `json:"protocol"`
+	Breaker   string    `json:"breaker"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	LastError string    `json:"last_error,omitempty"`
+	LastProbe time.Time `json:"last_probe"`
+}
+
+type shardHealth struct {
+	ID       string          `json:"id"`
+	Status   string          `json:"status"`
+	P95Ms    float64         `json:"p95_ms,omitempty"`
+	Replicas []replicaHealth `json:"replicas"`
+}
+
+type clusterHealth struct {
+	Status string        `json:"status"`
+	Shards []shardHealth `json:"shards"`
+}
+
+const (
+	statusGreen  = "green"
+	statusYellow = "yellow"
+	statusRed    = "red"
+)
+
+// probeShards calls /health on every known replica each interval and feeds
+// the result into that replica's circuit breaker, so a dead shard is marked
+// open before any search has to wait on it.
+func (s *Server) probeShards(ctx context.Context) {
+	interval := 2 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("HEALTH_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes every known replica once, in parallel.
+func (s *Server) probeAll(ctx context.Context) {
+	timeout := 500 * time.Millisecond
+	if v, err := time.ParseDuration(os.Getenv("HEALTH_TIMEOUT")); err == nil && v > 0 {
+		timeout = v
+	}
+	var wg sync.WaitGroup
+	for _, g := range s.shardGroups() {
+		for _, url := range g.Replicas {
+			wg.Add(1)
+			go func(url string) {
+				defer wg.Done()
+				s.breakerFor(url).recordProbe(s.probe(ctx, url, timeout))
+			}(url)
+		}
+	}
+	wg.Wait()
+}
+
+func (s *Server) probe(ctx context.Context, url string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health status %d", resp.StatusCode)
+	}
+	s.noteProtocols(url, resp.Header.Get(wire.ProtocolsHeader))
+	return nil
+}
+
+func (s *Server) clusterHealth() clusterHealth {
+	out := clusterHealth{Status: statusGreen}
+	for _, g := range s.shardGroups() {
+		sh := shardHealth{ID: g.ID, Status: statusGreen}
+		if p95, ok := s.latency.percentile(g.ID, 95); ok {
+			sh.P95Ms = float64(p95.Microseconds()) / 1000
+		}
+
+		healthy := 0
+		for _, url := range g.Replicas {
+			rh := s.breakerFor(url).snapshot()
+			rh.URL = url
+			rh.Protocol = s.protocolFor(url)
+			if rh.Healthy {
+				healthy++
+			}
+			sh.Replicas = append(sh.Replicas, rh)
+		}
+		switch {
+		case healthy == 0:
+			sh.Status = statusRed
+		case healthy < len(g.Replicas):
+			sh.Status = statusYellow
+		}
+
+		if sh.Status == statusRed || (sh.Status == statusYellow && out.Status == statusGreen) {
+			out.Status = sh.Status
+		}
+		out.Shards = append(out.Shards, sh)
+	}
+	return out
+}
+
+func (s *Server) ClusterHealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := s.clusterHealth()
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status == statusRed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hedgeConfig controls when queryShard sends a backup request to a second
+// replica. The delay is the configured percentile of recent latencies for
+// the shard, clamped to [minDelay, maxDelay]; budget is the fraction of
+// primary requests that may be hedged.
+type hedgeConfig struct {
+	enabled    bool
+	percentile float64
+	minDelay   time.Duration
+	maxDelay   time.Duration
+	budget     float64
+}
+
+const (
+	latencySamples    = 256
+	minLatencySamples = 20
+	maxHedgeTokens    = 10
+)
+
+func loadHedgeConfig() hedgeConfig {
+	cfg := hedgeConfig{
+		enabled:    true,
+		percentile: 95,
+		minDelay:   5 * time.Millisecond,
+		maxDelay:   100 * time.Millisecond,
+		budget:     0.1,
+	}
+	if v := os.Getenv("HEDGE_ENABLED"); v != "" {
+		cfg.enabled, _ = strconv.ParseBool(v)
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("HEDGE_PERCENTILE"), 64); err == nil && v > 0 && v < 100 {
+		cfg.percentile = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("HEDGE_MIN_DELAY")); err == nil {
+		cfg.minDelay = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("HEDGE_MAX_DELAY")); err == nil {
+		cfg.maxDelay = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("HEDGE_BUDGET"), 64); err == nil && v >= 0 {
+		cfg.budget = v
+	}
+	return cfg
+}
+
+// latencyTracker keeps a ring of recent successful response times per shard.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+	next    map[string]int
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		samples: make(map[string][]time.Duration),
+		next:    make(map[string]int),
+	}
+}
+
+func (t *latencyTracker) observe(shardID string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buf := t.samples[shardID]
+	if len(buf) < latencySamples {
+		t.samples[shardID] = append(buf, d)
+		return
+	}
+	i := t.next[shardID]
+	buf[i] = d
+	t.next[shardID] = (i + 1) % latencySamples
+}
+
+// percentile returns the p-th percentile latency for the shard, or false if
+// there are not yet enough samples to trust it.
+func (t *latencyTracker) percentile(shardID string, p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	buf := append([]time.Duration(nil), t.samples[shardID]...)
+	t.mu.Unlock()
+
+	if len(buf) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(buf, func(i, j int) bool { return buf[i] < buf[j] })
+	idx := int(float64(len(buf)-1) * p / 100)
+	return buf[idx], true
+}
+
+// hedgeBudget is a token bucket: every primary request deposits budget
+// tokens and every hedge spends one, so at most that fraction is hedged.
+type hedgeBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+func (b *hedgeBudget) deposit(amount float64) {
+	b.mu.Lock()
+	b.tokens += amount
+	if b.tokens > maxHedgeTokens {
+		b.tokens = maxHedgeTokens
+	}
+	b.mu.Unlock()
+}
+
+func (b *hedgeBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *Server) hedgeDelay(shardID string) time.Duration {
+	d, ok := s.latency.percentile(shardID, s.hedge.percentile)
+	if !ok || d > s.hedge.maxDelay {
+		return s.hedge.maxDelay
+	}
+	if d < s.hedge.minDelay {
+		return s.hedge.minDelay
+	}
+	return d
+}
+
+type shardReply struct {
+	resp   *shardResponse
+	err    error
+	hedged bool
+}
+
+// errShardUnavailable means every replica of a shard has its circuit open.
+var errShardUnavailable = errors.New("no healthy replicas")
+
+// callReplica queries one replica and records the outcome in its circuit
+// breaker. Requests cancelled because another replica won, the client went
+// away or the deadline passed don't count as failures; they only give back
+// a half-open trial.
+func (s *Server) callReplica(ctx context.Context, g shardGroup, url string, req shardRequest) (*shardResponse, error) {
+	start := time.Now()
+	resp, err := s.queryReplica(ctx, url, req)
+	if err == nil {
+		s.latency.observe(g.ID, time.Since(start))
+	}
+	if ctx.Err() == nil || err == nil {
+		s.breakerFor(url).record(err)
+	} else {
+		s.breakerFor(url).release()
+	}
+	return resp, err
+}
+
+// replicaPicker returns a function that yields the shard's replicas in
+// round-robin order, skipping those whose circuit breaker is open.
+func (s *Server) replicaPicker(g shardGroup) func() (string, bool) {
+	n := len(g.Replicas)
+	offset := int(s.rr.Add(1) % uint64(n))
+	tried := 0
+	return func() (string, bool) {
+		for tried < n {
+			url := g.Replicas[(offset+tried)%n]
+			tried++
+			if s.breakerFor(url).allow() {
+				return url, true
+			}
+		}
+		return "", false
+	}
+}
+
+// queryShard sends the query to one replica of the shard and, if it has not
+// answered within the hedge delay, a backup request to another replica. The
+// first successful reply wins and the other request is cancelled. Replicas
+// whose circuit breaker is open are skipped.
+func (s *Server) queryShard(ctx context.Context, g shardGroup, req shardRequest) (*shardResponse, error) {
+	shardRequests.Add(1)
+
+	n := len(g.Replicas)
+	next := s.replicaPicker(g)
+
+	primary, ok := next()
+	if !ok {
+		return nil, errShardUnavailable
+	}
+	if n < 2 || !s.hedge.enabled {
+		return s.callReplica(ctx, g, primary, req)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	replies := make(chan shardReply, 2)
+	send := func(url string, hedged bool) {
+		go func() {
+			resp, err := s.callReplica(ctx, g, url, req)
+			replies <- shardReply{resp: resp, err: err, hedged: hedged}
+		}()
+	}
+
+	send(primary, false)
+	s.budget.deposit(s.hedge.budget)
+
+	timer := time.NewTimer(s.hedgeDelay(g.ID))
+	defer timer.Stop()
+
+	inflight, backupSent := 1, false
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			if !backupSent && s.budget.take() {
+				if backup, ok := next(); ok {
+					hedgedRequests.Add(1)
+					send(backup, true)
+					inflight++
+				}
+				backupSent = true
+			}
+		case r := <-replies:
+			inflight--
+			if r.err == nil {
+				if r.hedged {
+					hedgeWins.Add(1)
+				}
+				return r.resp, nil
+			}
+			lastErr = r.err
+			if !backupSent {
+				// primary failed outright: fail over without waiting
+				if backup, ok := next(); ok {
+					send(backup, false)
+					inflight++
+				}
+				backupSent = true
+			}
+			if inflight == 0 {
+				return nil, lastErr
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
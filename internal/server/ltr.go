@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"turbo-query/internal/experiment"
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/ltr"
+)
+
+// Outcomes of learned ranking, reported in SearchResponse.LTR.
+const (
+	ltrApplied     = "applied"
+	ltrUnavailable = "unavailable"
+)
+
+// learned reports whether the request ranks with the shards' LTR model.
+// Semantic searches aren't fused, so they never do.
+func (req *SearchRequest) learned() bool {
+	return req.Fusion != nil && req.Fusion.Method == fusion.LTR && req.Mode != modeSemantic
+}
+
+// linear returns the request with linear fusion in place of ltr, keeping
+// the other fusion settings.
+func (req SearchRequest) linear() SearchRequest {
+	f := *req.Fusion
+	f.Method = fusion.Linear
+	req.Fusion = &f
+	return req
+}
+
+// sameModel reports whether every shard that returned hits scored them
+// with the same LTR model. A shard without one reports "".
+func sameModel(models map[string]bool) bool {
+	return len(models) <= 1 && !models[""]
+}
+
+// sampleFeatures decides whether to log a search's LTR features.
+func (s *Server) sampleFeatures() bool {
+	return s.featureLogRate > 0 && s.events != nil && rand.Float64() < s.featureLogRate
+}
+
+// featureSearch runs a search with LTR features, logs them under a new
+// search ID and serves the response without them. Feedback quoting the
+// search ID joins the log for training. Cached responses carry no
+// features, so the cache is bypassed.
+func (s *Server) featureSearch(w http.ResponseWriter, r *http.Request, req SearchRequest, asg *experiment.Assignment) {
+	req.searchID = newSearchID()
+
+	ctx, cancel := s.searchContext(r, req.TimeoutMs)
+	defer cancel()
+	resp, err := s.FanoutSearch(ctx, req)
+	if writeSearchError(w, err) {
+		return
+	}
+
+	ev := ltr.FeatureEvent{
+		Type:     ltr.EventFeatures,
+		Time:     time.Now().UTC(),
+		SearchID: req.searchID,
+		Query:    req.Query,
+		Results:  make([]ltr.LoggedResult, len(resp.Hits)),
+	}
+	for i := range resp.Hits {
+		h := &resp.Hits[i]
+		ev.Results[i] = ltr.LoggedResult{Position: i + 1, ShardID: h.ShardID, DocID: h.DocID, Features: h.Features}
+		h.Features = nil
+	}
+	s.events.Write(ev)
+
+	body, err := json.Marshal(resp)
+	if writeSearchError(w, err) {
+		return
+	}
+	s.writeSearch(w, "BYPASS", withRewrite(body, req.rewrite), req, asg, nil)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+
+	"turbo-query/internal/fusion"
+)
+
+func TestSameModel(t *testing.T) {
+	for _, tc := range []struct {
+		models []string
+		want   bool
+	}{
+		{nil, true}, // no shard returned hits
+		{[]string{"v1"}, true},
+		{[]string{""}, false},         // scored linearly
+		{[]string{"v1", "v2"}, false}, // mid reload
+		{[]string{"v1", ""}, false},
+	} {
+		models := make(map[string]bool)
+		for _, m := range tc.models {
+			models[m] = true
+		}
+		if got := sameModel(models); got != tc.want {
+			t.Errorf("sameModel(%q) = %v, want %v", tc.models, got, tc.want)
+		}
+	}
+}
+
+func TestLinear(t *testing.T) {
+	w := 0.2
+	req := SearchRequest{Fusion: &fusion.Params{Method: fusion.LTR, WeightPopularity: &w, Window: 500}}
+	got := req.linear()
+	if got.Fusion.Method != fusion.Linear || *got.Fusion.WeightPopularity != w || got.Fusion.Window != 500 {
+		t.Errorf("linear() fusion = %+v", got.Fusion)
+	}
+	if req.Fusion.Method != fusion.LTR {
+		t.Errorf("linear() changed the original request's fusion")
+	}
+}
@@ -0,0 +1,20 @@
+package server
+
+import "expvar"
+
+// Counters are published through expvar and served at /debug/vars.
+var (
+	shardRequests  = expvar.NewInt("shard_requests")
+	hedgedRequests = expvar.NewInt("shard_hedged_requests")
+	hedgeWins      = expvar.NewInt("shard_hedge_wins")
+)
+
+func init() {
+	expvar.Publish("shard_hedge_rate", expvar.Func(func() any {
+		total := shardRequests.Value()
+		if total == 0 {
+			return 0.0
+		}
+		return float64(hedgedRequests.Value()) / float64(total)
+	}))
+}
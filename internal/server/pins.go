@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+
+	"turbo-query/internal/dsl"
+)
+
+// resolveRequest is the body sent to a shard's /resolve.
+type resolveRequest struct {
+	WikiIDs []string     `json:"wiki_ids"`
+	Filters []dsl.Filter `json:"filters,omitempty"`
+}
+
+type resolveResponse struct {
+	IDs map[string]string `json:"ids"`
+}
+
+// pinnedIDs is the global IDs pinned for the request. Sorted requests are
+// never pinned: a pinned doc on top would break the order asked for.
+func (req *SearchRequest) pinnedIDs() []string {
+	if len(req.Sort) > 0 {
+		return nil
+	}
+	return req.pins.Pinned(req.Query)
+}
+
+// splicePinned puts the request's pinned docs, in rule order, ahead of the
+// organic hits and drops their organic copies. Pinned docs are looked up
+// on the shard the hash ring places them on and must pass the request's
+// filters; any that can't be found are skipped.
+func (s *Server) splicePinned(ctx context.Context, req SearchRequest, hits []Result) []Result {
+	ids := req.pinnedIDs()
+	if len(ids) == 0 {
+		return hits
+	}
+	found := s.resolvePinned(ctx, ids, req.Filters)
+
+	pinned := make([]Result, 0, len(ids))
+	seen := make(map[[2]string]bool, len(ids))
+	for _, id := range ids {
+		if r, ok := found[id]; ok {
+			pinned = append(pinned, r)
+			seen[[2]string{r.ShardID, r.DocID}] = true
+		}
+	}
+	if len(pinned) == 0 {
+		return hits
+	}
+	out := pinned
+	for _, h := range hits {
+		if !seen[[2]string{h.ShardID, h.DocID}] {
+			out = append(out, h)
+		}
+	}
+	if len(out) > req.TopK {
+		out = out[:req.TopK]
+	}
+	return out
+}
+
+// resolvePinned finds the shard and local ID of each global ID, asking
+// each owning shard once for all of its IDs.
+func (s *Server) resolvePinned(ctx context.Context, ids []string, filters []dsl.Filter) map[string]Result {
+	byShard := make(map[string][]string)
+	for _, id := range ids {
+		shardID := strconv.Itoa(s.ring.ShardFor(id))
+		byShard[shardID] = append(byShard[shardID], id)
+	}
+	groups := make(map[string]shardGroup)
+	for _, g := range s.shardGroups() {
+		groups[g.ID] = g
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := make(map[string]Result, len(ids))
+	for shardID, wikiIDs := range byShard {
+		g, ok := groups[shardID]
+		if !ok {
+			log.Println("pins: owning shard not routed:", shardID)
+			continue
+		}
+		wg.Add(1)
+		go func(g shardGroup, wikiIDs []string) {
+			defer wg.Done()
+			rr, err := s.resolveShard(ctx, g, resolveRequest{WikiIDs: wikiIDs, Filters: filters})
+			if err != nil {
+				log.Println("pins: resolve error:", g.ID, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for wikiID, local := range rr.IDs {
+				found[wikiID] = Result{DocID: local, ShardID: g.ID, Pinned: true}
+			}
+		}(g, wikiIDs)
+	}
+	wg.Wait()
+	return found
+}
+
+// resolveShard tries each healthy replica of the shard in turn.
+func (s *Server) resolveShard(ctx context.Context, g shardGroup, req resolveRequest) (*resolveResponse, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	next := s.replicaPicker(g)
+	lastErr := errShardUnavailable
+	for url, ok := next(); ok; url, ok = next() {
+		var out resolveResponse
+		err := s.postShard(ctx, url+"/resolve", buf, &out)
+		if ctx.Err() == nil || err == nil {
+			s.breakerFor(url).record(err)
+		}
+		if err == nil {
+			return &out, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
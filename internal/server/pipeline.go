@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+
+	"turbo-query/internal/dsl"
+)
+
+// applyPipeline fills the request's ranking options from the pipeline it
+// names, or from DEFAULT_PIPELINE when it names none. Options the request
+// sets itself win, fusion settings one by one; pipeline filters are added
+// to the request's. A pipeline
+// the client didn't ask for (the default, or an experiment arm's) leaves
+// out stages that can't serve the request, such as reranking a sorted
+// search, so they don't turn into validation errors; a pipeline the client
+// named keeps them, and the conflict is reported.
+func (req *SearchRequest) applyPipeline(s *Server) error {
+	implicit := req.Pipeline == "" || req.assigned
+	// sorted and navigational searches have their own order, which
+	// semantic mode, reranking and diversification would override
+	ordered := len(req.Sort) > 0 || req.Navigational
+	skip := implicit && ordered
+
+	name := req.Pipeline
+	if name == "" {
+		name = s.defaultPipeline
+	}
+	if name == "" {
+		return nil
+	}
+	p, ok := s.pipelines.Load().Get(name)
+	if !ok {
+		if implicit {
+			// a missing default or arm pipeline is a config problem, not
+			// the client's
+			return nil
+		}
+		return fmt.Errorf("unknown pipeline %q", name)
+	}
+	req.Pipeline = name
+
+	if req.Mode == "" && !(skip && p.Mode == modeSemantic) {
+		req.Mode = p.Mode
+	}
+	if l := p.Lexical; l != nil {
+		if req.Boosts == nil {
+			req.Boosts = l.Boosts
+		}
+		if req.ExactTitleBoost == nil {
+			req.ExactTitleBoost = l.ExactTitleBoost
+		}
+	}
+	req.Fusion = req.Fusion.Over(p.Fusion)
+	if len(p.Filters) > 0 {
+		req.Filters = append(append([]dsl.Filter(nil), req.Filters...), p.Filters...)
+	}
+	if req.FallbackMinHits == nil && p.Fallback != nil {
+		n := p.Fallback.MinHits
+		req.FallbackMinHits = &n
+	}
+	if req.Rerank == nil && p.CrossEncoder != nil && !skip {
+		req.Rerank = &RerankOptions{TopN: p.CrossEncoder.TopN, BudgetMs: p.CrossEncoder.BudgetMs}
+	}
+	if req.Diversify == nil && p.MMR != nil && !skip {
+		req.Diversify = &Diversify{
+			Lambda:     p.MMR.Lambda,
+			Collapse:   p.MMR.Collapse,
+			Candidates: p.MMR.Candidates,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/pipeline"
+	"turbo-query/internal/sorting"
+)
+
+func pipelineServer(t *testing.T) *Server {
+	t.Helper()
+	set, err := pipeline.Parse([]byte(`{"pipelines": {
+		"rerank": {"stages": [{"type": "lexical"}, {"type": "cross_encoder", "top_n": 30}, {"type": "mmr", "lambda": 0.5}]},
+		"vector": {"stages": [{"type": "vector"}]}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{mmrLambda: 0.7, rerankTopN: 20}
+	s.pipelines.Store(set)
+	return s
+}
+
+func TestImplicitPipelineSkipsConflictingStages(t *testing.T) {
+	s := pipelineServer(t)
+	sorted := []sorting.Field{{Field: "_score"}}
+	for _, def := range []string{"rerank", "vector"} {
+		s.defaultPipeline = def
+		for name, req := range map[string]SearchRequest{
+			"sorted":        {Query: "rome", Sort: sorted},
+			"navigational":  {Query: "rome", Navigational: true},
+			"arm, sorted":   {Query: "rome", Sort: sorted, Pipeline: def, assigned: true},
+			"arm, navigate": {Query: "rome", Navigational: true, Pipeline: def, assigned: true},
+		} {
+			if err := s.prepare(&req); err != nil {
+				t.Errorf("default %s, %s: %v", def, name, err)
+				continue
+			}
+			if req.Rerank != nil || req.Diversify != nil || req.Mode == modeSemantic {
+				t.Errorf("default %s, %s: conflicting stage applied", def, name)
+			}
+		}
+	}
+}
+
+func TestImplicitPipelineAppliesToPlainSearch(t *testing.T) {
+	s := pipelineServer(t)
+	s.defaultPipeline = "rerank"
+	req := SearchRequest{Query: "rome"}
+	if err := s.prepare(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Rerank == nil || req.Diversify == nil || req.Pipeline != "rerank" {
+		t.Fatalf("default pipeline not applied: %+v", req)
+	}
+}
+
+func TestNamedPipelineConflictIsReported(t *testing.T) {
+	s := pipelineServer(t)
+	req := SearchRequest{Query: "rome", Navigational: true, Pipeline: "rerank"}
+	err := s.prepare(&req)
+	if err == nil || !strings.Contains(err.Error(), "navigational") {
+		t.Fatalf("got %v, want a navigational conflict", err)
+	}
+}
+
+func TestMissingPipeline(t *testing.T) {
+	s := pipelineServer(t)
+	if err := s.prepare(&SearchRequest{Query: "rome", Pipeline: "nope"}); err == nil {
+		t.Fatal("unknown named pipeline accepted")
+	}
+	s.defaultPipeline = "nope"
+	if err := s.prepare(&SearchRequest{Query: "rome"}); err != nil {
+		t.Fatalf("missing default failed the request: %v", err)
+	}
+	if err := s.prepare(&SearchRequest{Query: "rome", Pipeline: "gone", assigned: true}); err != nil {
+		t.Fatalf("missing arm pipeline failed the request: %v", err)
+	}
+}
+
+func TestRequestFusionOverridesPipelineFieldByField(t *testing.T) {
+	set, err := pipeline.Parse([]byte(`{"pipelines": {
+		"rrf": {"stages": [{"type": "lexical", "window": 300}, {"type": "fusion", "method": "rrf", "rrf_k": 30}]}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.pipelines.Store(set)
+	bm25 := 0.4
+	req := SearchRequest{Query: "rome", Pipeline: "rrf", Fusion: &fusion.Params{WeightBM25: &bm25}}
+	if err := s.prepare(&req); err != nil {
+		t.Fatal(err)
+	}
+	f := req.Fusion
+	if f.Method != fusion.RRF || f.RRFK != 30 || f.Window != 300 || f.WeightBM25 == nil || *f.WeightBM25 != 0.4 {
+		t.Errorf("fusion = %+v, want the pipeline's with weight_bm25 0.4", f)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/wire"
+)
+
+const (
+	protocolJSON   = "json"
+	protocolBinary = "binary"
+)
+
+// noteProtocols records the encodings a replica advertised on /health.
+// Replicas are queried over JSON until a probe shows they accept binary.
+func (s *Server) noteProtocols(url, advertised string) {
+	binary := false
+	for _, p := range strings.Split(advertised, ",") {
+		if strings.TrimSpace(p) == protocolBinary {
+			binary = true
+		}
+	}
+	s.binaryShards.Store(url, binary)
+}
+
+func (s *Server) useBinary(url string) bool {
+	if s.shardProtocol == protocolJSON {
+		return false
+	}
+	v, ok := s.binaryShards.Load(url)
+	return ok && v.(bool)
+}
+
+func (s *Server) protocolFor(url string) string {
+	if s.useBinary(url) {
+		return protocolBinary
+	}
+	return protocolJSON
+}
+
+// queryReplicaBinary sends the query vector as raw float32s and decodes the
+// streamed hit frames.
+func (s *Server) queryReplicaBinary(ctx context.Context, shardURL string, body shardRequest) (*shardResponse, error) {
+	vec := body.Vector
+	body.Vector = nil
+	header, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := wire.WriteRequest(&buf, header, vec); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", shardURL+"/search", &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", wire.ContentType)
+	deadline.Set(req, ctx, shardDeadlineMargin)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard status %d", resp.StatusCode)
+	}
+
+	var hits []Result
+	trailer, err := wire.ReadResponse(resp.Body, func(h wire.Hit) error {
+		var r Result
+		if len(h.Ext) > 0 {
+			if err := json.Unmarshal(h.Ext, &r); err != nil {
+				return err
+			}
+		}
+		r.DocID = h.DocID
+		r.ShardID = h.ShardID
+		r.Score = h.Score
+		r.Title = h.Title
+		r.Text = h.Text
+		if len(h.Vector) > 0 {
+			r.Vector = h.Vector
+		}
+		hits = append(hits, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var shardResp shardResponse
+	if err := json.Unmarshal(trailer, &shardResp); err != nil {
+		return nil, err
+	}
+	shardResp.Hits = hits
+	return &shardResp, nil
+}
+
+// newShardTransport builds the coordinator→shard transport. With
+// SHARD_HTTP2=true it speaks HTTP/2 over plain TCP (prior knowledge), which
+// every shard serves alongside HTTP/1.1.
+func newShardTransport() *http.Transport {
+	t := &http.Transport{
+		MaxIdleConns:        600,
+		MaxIdleConnsPerHost: 150,
+		IdleConnTimeout:     90 * time.Second,
+		DisableKeepAlives:   false,
+		// a safety net for a shard that never answers; request deadlines,
+		// at most maxSearchTimeout, normally end the call well before this
+		ResponseHeaderTimeout: 2 * maxSearchTimeout,
+	}
+	if os.Getenv("SHARD_HTTP2") == "true" {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return t
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/facets"
+	"turbo-query/internal/rewrite"
+	"turbo-query/internal/sorting"
+)
+
+var defaultFields = []string{"title", "text"}
+
+const (
+	highlightLexical  = "lexical"
+	highlightSemantic = "semantic"
+
+	modeHybrid   = "hybrid"
+	modeSemantic = "semantic"
+)
+
+// prepare readies a decoded request for the search: pipeline, defaults,
+// validation, then the rewrite and pin rules in effect.
+func (s *Server) prepare(req *SearchRequest) error {
+	if err := req.applyPipeline(s); err != nil {
+		return err
+	}
+	req.normalize()
+	req.applyDefaults(s)
+	if err := req.validate(); err != nil {
+		return err
+	}
+	req.applyRewrite(s.rules.Load())
+	req.pins = s.pins.Load()
+	return nil
+}
+
+// validate rejects queries the shards would fail to translate.
+func (req *SearchRequest) validate() error {
+	if req.Query == "" && req.DSL != nil {
+		// embed the free text of the structured query
+		req.Query = req.DSL.Text()
+	}
+	if _, err := dsl.Build(req.Query, req.Syntax, req.DSL); err != nil {
+		return err
+	}
+	if req.Mode != modeHybrid && req.Mode != modeSemantic {
+		return fmt.Errorf("unknown mode %q", req.Mode)
+	}
+	if req.TimeoutMs < 0 || time.Duration(req.TimeoutMs)*time.Millisecond > maxSearchTimeout {
+		return fmt.Errorf("timeout_ms must be between 0 and %d", maxSearchTimeout.Milliseconds())
+	}
+	if req.FallbackMinHits != nil && *req.FallbackMinHits < 0 {
+		return errors.New("fallback_min_hits must not be negative")
+	}
+	if err := sorting.Validate(req.Sort); err != nil {
+		return err
+	}
+	if err := req.Fusion.Validate(); err != nil {
+		return err
+	}
+	if len(req.Sort) > 0 && (req.Mode == modeSemantic || req.Navigational) {
+		return errors.New("sort can't be combined with semantic mode or navigational")
+	}
+	if o := req.Rerank; o != nil {
+		if len(req.Sort) > 0 || req.Navigational {
+			return errors.New("rerank can't be combined with sort or navigational")
+		}
+		if err := o.validate(); err != nil {
+			return err
+		}
+	}
+	if d := req.Diversify; d != nil {
+		if len(req.Sort) > 0 || req.Navigational {
+			return errors.New("diversify can't be combined with sort or navigational")
+		}
+		if err := d.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := dsl.Filters(req.Filters); err != nil {
+		return err
+	}
+	return facets.Normalize(req.Facets)
+}
+
+// applyDefaults fills ranking options the request left unset from the
+// server configuration.
+func (req *SearchRequest) applyDefaults(s *Server) {
+	if req.Boosts == nil && len(s.fieldBoosts) > 0 {
+		req.Boosts = s.fieldBoosts
+	}
+	if req.ExactTitleBoost == nil {
+		boost := s.exactTitleBoost
+		req.ExactTitleBoost = &boost
+	}
+	if req.FallbackMinHits == nil {
+		n := s.fallbackMinHits
+		req.FallbackMinHits = &n
+	}
+	if req.Spellcheck == nil {
+		v := s.spellcheck
+		req.Spellcheck = &v
+	}
+	if req.AutoCorrect == nil {
+		v := s.autoCorrect
+		req.AutoCorrect = &v
+	}
+	if o := req.Rerank; o != nil {
+		if o.TopN == 0 {
+			o.TopN = s.rerankTopN
+		}
+		if o.BudgetMs == 0 {
+			o.BudgetMs = int(s.rerankBudget / time.Millisecond)
+		}
+	}
+	if d := req.Diversify; d != nil && d.Lambda == nil {
+		v := s.mmrLambda
+		d.Lambda = &v
+	}
+}
+
+func (req *SearchRequest) normalize() {
+	if req.TopK <= 0 {
+		req.TopK = 10
+	}
+	if req.TopK > maxTopK {
+		req.TopK = maxTopK
+	}
+	// an explicit empty list means IDs and scores only
+	if req.Fields == nil {
+		req.Fields = defaultFields
+	}
+	if req.Mode == "" {
+		req.Mode = modeHybrid
+	}
+	if req.TextLength < 0 {
+		req.TextLength = 0
+	}
+	if hl := req.Highlight; hl != nil {
+		if hl.Mode == "" {
+			hl.Mode = highlightLexical
+		}
+		if len(hl.Fields) == 0 {
+			hl.Fields = defaultFields
+		}
+		if hl.FragmentSize <= 0 {
+			hl.FragmentSize = 150
+		}
+		if hl.Fragments <= 0 {
+			hl.Fragments = 3
+		}
+		if hl.PreTag == "" && hl.PostTag == "" {
+			hl.PreTag, hl.PostTag = "<mark>", "</mark>"
+		}
+	}
+}
+
+// applyRewrite runs the synonym and rewrite rules over a plain query. The
+// original text stays in Query for the embedding.
+func (req *SearchRequest) applyRewrite(rules *rewrite.Rules) {
+	if rules == nil || req.DSL != nil || req.Syntax != "" || req.Mode == modeSemantic {
+		return
+	}
+	if res := rules.Apply(req.Query); len(res.Fired) > 0 {
+		req.rewrite = &res
+	}
+}
+
+// lexicalQuery is the text matched by BM25: the rewritten query if any
+// rule fired, else Query.
+func (req *SearchRequest) lexicalQuery() string {
+	if req.rewrite != nil {
+		return req.rewrite.Query
+	}
+	return req.Query
+}
+
+func (req *SearchRequest) expansions() []string {
+	if req.rewrite != nil {
+		return req.rewrite.Expansions
+	}
+	return nil
+}
+
+// cacheKey covers every option that changes the response body. The budget
+// doesn't, so it is left out. The original query stays in the key next to
+// any rewrite of it: BM25 matches the rewrite, but the query vector is
+// always embedded from the original. The rewrite is keyed too, so entries
+// go stale when the rules change, and so does the pin rules version.
+func (req SearchRequest) cacheKey() string {
+	key := req
+	key.TimeoutMs = 0
+	key.Vector = nil
+	var rewritten string
+	if req.rewrite != nil {
+		rewritten = req.rewrite.Query
+	}
+	b, _ := json.Marshal(struct {
+		SearchRequest
+		Rewritten  string   `json:"rewritten,omitempty"`
+		Expansions []string `json:"expansions,omitempty"`
+		Pins       string   `json:"pins,omitempty"`
+	}{key, rewritten, req.expansions(), req.pins.Version()})
+	return "search:" + string(b)
+}
+
+// spellable reports whether the query is plain text that spelling
+// correction can rewrite.
+func (req *SearchRequest) spellable() bool {
+	return *req.Spellcheck && req.DSL == nil && req.Syntax == "" && req.Mode != modeSemantic
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/rewrite"
+)
+
+func TestCacheKeyKeepsOriginalQuery(t *testing.T) {
+	a := SearchRequest{Query: "please nyc", TopK: 10, rewrite: &rewrite.Result{Query: "nyc"}}
+	b := SearchRequest{Query: "nyc please", TopK: 10, rewrite: &rewrite.Result{Query: "nyc"}}
+	if a.cacheKey() == b.cacheKey() {
+		t.Fatal("queries embedded differently share a cache key")
+	}
+
+	plain := SearchRequest{Query: "nyc", TopK: 10}
+	if plain.cacheKey() == (SearchRequest{Query: "nyc", TopK: 10, rewrite: &rewrite.Result{Query: "nyc", Expansions: []string{"new york city"}}}).cacheKey() {
+		t.Fatal("expansions are not part of the key")
+	}
+
+	timed := plain
+	timed.TimeoutMs = 50
+	if plain.cacheKey() != timed.cacheKey() {
+		t.Fatal("the time budget changed the key")
+	}
+}
+
+func TestSearchContextBudget(t *testing.T) {
+	s := &Server{searchTimeout: 2 * time.Second}
+	for _, tc := range []struct {
+		name      string
+		header    string
+		timeoutMs int
+		want      time.Duration
+	}{
+		{"server default", "", 0, 2 * time.Second},
+		{"body beyond the default", "", 5000, 5 * time.Second},
+		{"header", "4000", 0, 4 * time.Second},
+		{"body over header", "4000", 1000, time.Second},
+		{"header capped", "600000", 0, maxSearchTimeout},
+	} {
+		r := httptest.NewRequest("POST", "/search", nil)
+		if tc.header != "" {
+			r.Header.Set(deadline.Header, tc.header)
+		}
+		ctx, cancel := s.searchContext(r, tc.timeoutMs)
+		d, ok := ctx.Deadline()
+		cancel()
+		if got := time.Until(d); !ok || got > tc.want || got < tc.want-time.Second {
+			t.Errorf("%s: budget %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if err := (&SearchRequest{Query: "x", Mode: modeHybrid, TimeoutMs: 60000}).validate(); err == nil {
+		t.Error("timeout_ms over the cap accepted")
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"turbo-query/internal/embed"
+	"turbo-query/internal/sorting"
+)
+
+// Outcomes of the rerank stage, reported in SearchResponse.Rerank.
+const (
+	rerankApplied     = "applied"
+	rerankOverBudget  = "budget_exceeded"
+	rerankUnavailable = "unavailable"
+	rerankFailed      = "failed"
+)
+
+// rerankPassageChars caps the text sent to the cross-encoder per hit; the
+// model truncates long inputs anyway.
+const rerankPassageChars = 1000
+
+// RerankOptions turns on cross-encoder reranking of the merged top TopN
+// (never fewer than top_k). BudgetMs bounds the stage, passage fetch
+// included; past it the hybrid order is kept.
+type RerankOptions struct {
+	TopN     int `json:"top_n,omitempty"`
+	BudgetMs int `json:"budget_ms,omitempty"`
+}
+
+func (o *RerankOptions) validate() error {
+	if o.TopN < 0 || o.TopN > maxTopK {
+		return errors.New("rerank top_n must be between 0 and 100")
+	}
+	if o.BudgetMs < 0 {
+		return errors.New("rerank budget_ms must not be negative")
+	}
+	return nil
+}
+
+// rerank scores the first TopN hits against the query with the
+// cross-encoder and re-orders them by that score, which replaces the hybrid
+// score. Only those hits are returned, so later stages never compare
+// cross-encoder scores with hybrid ones. On any failure, including a hit
+// whose passage couldn't be fetched, the hits are returned as they were.
+func (s *Server) rerank(ctx context.Context, req SearchRequest, hits []Result) ([]Result, string) {
+	if !embed.RerankerReady() {
+		return hits, rerankUnavailable
+	}
+	n := min(len(hits), max(req.Rerank.TopN, req.TopK))
+	if n == 0 {
+		return hits, rerankApplied
+	}
+	rctx, cancel := context.WithTimeout(ctx, time.Duration(req.Rerank.BudgetMs)*time.Millisecond)
+	defer cancel()
+
+	// fetch passages into copies so a fallback leaves hits untouched
+	cands := append([]Result(nil), hits[:n]...)
+	failed := s.fetchFields(rctx, cands, fetchRequest{
+		Fields:     []string{"title", "text"},
+		TextLength: rerankPassageChars,
+	})
+	if rctx.Err() != nil {
+		return hits, rerankOverBudget
+	}
+	if len(failed) > 0 {
+		return hits, rerankFailed
+	}
+	passages := make([]string, n)
+	for i, c := range cands {
+		if c.Title == "" && c.Text == "" {
+			// scoring an empty passage would rank the hit at random
+			return hits, rerankFailed
+		}
+		passages[i] = c.Title + "\n" + c.Text
+	}
+	scores, err := embed.ScorePairs(rctx, req.Query, passages)
+	if rctx.Err() != nil {
+		return hits, rerankOverBudget
+	}
+	if err != nil {
+		return hits, rerankFailed
+	}
+
+	for i := range hits[:n] {
+		if e := hits[i].Explain; e != nil {
+			e.Hybrid = hits[i].Score
+			e.CrossEncoder = float64(scores[i])
+		}
+		hits[i].Score = float64(scores[i])
+	}
+	top := hits[:n]
+	sort.SliceStable(top, func(i, j int) bool {
+		a, b := top[i], top[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return sorting.TieBreak(a.ShardID, a.DocID, b.ShardID, b.DocID)
+	})
+	return top, rerankApplied
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -31,6 +32,13 @@ func (s *Server) RegisterRoutes() http.Handler {
 	})
 
 	r.Post("/search", s.SearchHandler)
+	r.Post("/search/whynot", s.WhyNotHandler)
+	r.Post("/feedback", s.FeedbackHandler)
+	r.Get("/feedback/stats", s.FeedbackStatsHandler)
+	r.Get("/experiments", s.ExperimentsHandler)
+	r.Get("/suggest", s.SuggestHandler)
+	r.Get("/cluster/health", s.ClusterHealthHandler)
+	r.Handle("/debug/vars", expvar.Handler())
 
 	return r
 }
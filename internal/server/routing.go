@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"turbo-query/internal/membership"
+)
+
+const membershipPoll = 5 * time.Second
+
+func (s *Server) shardGroups() []shardGroup {
+	return *s.routes.Load()
+}
+
+// watchMembership rebuilds the routing table whenever the registry reports a
+// change. A shard the registry has never listed keeps its static SHARD_URLS
+// entry, so a partly registered cluster never drops a shard; once a shard
+// has registered, only the registry routes to it, and a node that left for
+// maintenance is not routed to again through the static table. While the
+// registry is unreachable the current table stays in effect.
+func (s *Server) watchMembership(ctx context.Context, reg membership.Registry, static []shardGroup) {
+	s.refreshRoutes(ctx, reg, static)
+	for range reg.Watch(ctx) {
+		s.refreshRoutes(ctx, reg, static)
+	}
+}
+
+// refreshRoutes rebuilds the routing table from the registry's members.
+func (s *Server) refreshRoutes(ctx context.Context, reg membership.Registry, static []shardGroup) {
+	members, err := reg.List(ctx)
+	if err != nil {
+		log.Println("membership list failed:", err)
+		return
+	}
+	if s.registered == nil {
+		s.registered = make(map[string]bool)
+	}
+	for _, m := range members {
+		s.registered[m.ShardID] = true
+	}
+	groups := mergeGroups(static, buildGroups(members), draining(members), s.registered)
+	s.routes.Store(&groups)
+}
+
+// buildGroups turns registry members into a routing table. Draining members
+// are left out, and when replicas of a shard disagree on index generation
+// only the newest generation is routed to.
+func buildGroups(members []membership.Member) []shardGroup {
+	newest := make(map[string]int64)
+	for _, m := range members {
+		if m.Status != membership.StatusUp {
+			continue
+		}
+		if g, ok := newest[m.ShardID]; !ok || m.Generation > g {
+			newest[m.ShardID] = m.Generation
+		}
+	}
+
+	byShard := make(map[string][]string)
+	for _, m := range members {
+		if m.Status != membership.StatusUp || m.Generation != newest[m.ShardID] {
+			continue
+		}
+		byShard[m.ShardID] = append(byShard[m.ShardID], m.Addr)
+	}
+
+	groups := make([]shardGroup, 0, len(byShard))
+	for id, replicas := range byShard {
+		sort.Strings(replicas)
+		groups = append(groups, shardGroup{ID: id, Replicas: replicas})
+	}
+	sortGroups(groups)
+	return groups
+}
+
+// draining is the set of registered addresses that asked to be drained.
+func draining(members []membership.Member) map[string]bool {
+	out := make(map[string]bool)
+	for _, m := range members {
+		if m.Status == membership.StatusDraining {
+			out[m.Addr] = true
+		}
+	}
+	return out
+}
+
+// mergeGroups lays the registry's groups over the static table. A shard
+// the registry has ever listed (seen) takes only its registered replicas,
+// which may be none; any other static shard is kept, minus replicas
+// registered as draining unless that would leave it with none.
+func mergeGroups(static, registered []shardGroup, drained, seen map[string]bool) []shardGroup {
+	byID := make(map[string]shardGroup, len(static)+len(registered))
+	for _, g := range static {
+		if seen[g.ID] {
+			continue
+		}
+		var replicas []string
+		for _, url := range g.Replicas {
+			if !drained[url] {
+				replicas = append(replicas, url)
+			}
+		}
+		if len(replicas) == 0 {
+			replicas = g.Replicas
+		}
+		byID[g.ID] = shardGroup{ID: g.ID, Replicas: replicas}
+	}
+	for _, g := range registered {
+		byID[g.ID] = g
+	}
+
+	groups := make([]shardGroup, 0, len(byID))
+	for _, g := range byID {
+		groups = append(groups, g)
+	}
+	sortGroups(groups)
+	return groups
+}
+
+func sortGroups(groups []shardGroup) {
+	sort.Slice(groups, func(i, j int) bool {
+		a, errA := strconv.Atoi(groups[i].ID)
+		b, errB := strconv.Atoi(groups[j].ID)
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return groups[i].ID < groups[j].ID
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"turbo-query/internal/membership"
+)
+
+func TestMergeGroups(t *testing.T) {
+	static := []shardGroup{
+		{ID: "0", Replicas: []string{"http://a0", "http://a1"}},
+		{ID: "1", Replicas: []string{"http://b0"}},
+		{ID: "2", Replicas: []string{"http://c0"}},
+	}
+	members := []membership.Member{
+		{ShardID: "0", Addr: "http://a2", Status: membership.StatusUp},
+		{ShardID: "1", Addr: "http://b0", Status: membership.StatusDraining},
+		{ShardID: "2", Addr: "http://c0", Status: membership.StatusDraining},
+		{ShardID: "2", Addr: "http://c1", Status: membership.StatusDraining},
+		{ShardID: "10", Addr: "http://k0", Status: membership.StatusUp},
+	}
+	got := mergeGroups(static, buildGroups(members), draining(members), nil)
+	want := []shardGroup{
+		// registered replicas replace the static entry
+		{ID: "0", Replicas: []string{"http://a2"}},
+		// every static replica draining: keep them rather than drop the shard
+		{ID: "1", Replicas: []string{"http://b0"}},
+		{ID: "2", Replicas: []string{"http://c0"}},
+		// only known to the registry
+		{ID: "10", Replicas: []string{"http://k0"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeGroups =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestMergeGroupsDropsDrainingStaticReplica(t *testing.T) {
+	static := []shardGroup{{ID: "0", Replicas: []string{"http://a0", "http://a1"}}}
+	members := []membership.Member{{ShardID: "0", Addr: "http://a1", Status: membership.StatusDraining}}
+	got := mergeGroups(static, buildGroups(members), draining(members), nil)
+	want := []shardGroup{{ID: "0", Replicas: []string{"http://a0"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeGroups = %v, want %v", got, want)
+	}
+}
+
+func TestMergeGroupsEmptyRegistry(t *testing.T) {
+	static := []shardGroup{{ID: "0", Replicas: []string{"http://a0"}}}
+	if got := mergeGroups(static, buildGroups(nil), draining(nil), nil); !reflect.DeepEqual(got, static) {
+		t.Fatalf("mergeGroups = %v, want the static table", got)
+	}
+}
+
+func TestRefreshRoutesForgetsStaticOnceRegistered(t *testing.T) {
+	static := []shardGroup{
+		{ID: "0", Replicas: []string{"http://a0"}},
+		{ID: "1", Replicas: []string{"http://b0"}},
+	}
+	reg := &fakeRegistry{members: []membership.Member{{ShardID: "0", Addr: "http://a0", Status: membership.StatusUp}}}
+	s := &Server{}
+	s.refreshRoutes(context.Background(), reg, static)
+	if got := s.shardGroups(); !reflect.DeepEqual(got, static) {
+		t.Fatalf("routes = %v, want %v", got, static)
+	}
+
+	// a0 drains for maintenance and its registry entry then expires: shard
+	// 0 must not fall back to the static a0, while unregistered shard 1
+	// still uses its static entry
+	reg.members = []membership.Member{{ShardID: "0", Addr: "http://a0", Status: membership.StatusDraining}}
+	s.refreshRoutes(context.Background(), reg, static)
+	reg.members = nil
+	s.refreshRoutes(context.Background(), reg, static)
+	want := []shardGroup{{ID: "1", Replicas: []string{"http://b0"}}}
+	if got := s.shardGroups(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("routes after expiry = %v, want %v", got, want)
+	}
+}
+
+type fakeRegistry struct {
+	membership.Registry
+	members []membership.Member
+}
+
+func (r *fakeRegistry) List(context.Context) ([]membership.Member, error) { return r.members, nil }
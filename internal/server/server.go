@@ -1,15 +1,29 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/sync/singleflight"
-
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/eventlog"
+	"turbo-query/internal/experiment"
+	"turbo-query/internal/facets"
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/membership"
+	"turbo-query/internal/pins"
+	"turbo-query/internal/pipeline"
 	redisclient "turbo-query/internal/redis"
+	"turbo-query/internal/rewrite"
+	"turbo-query/internal/ring"
+	"turbo-query/internal/sorting"
 
 	_ "github.com/joho/godotenv/autoload"
 )
@@ -17,19 +31,237 @@ import (
 type Server struct {
 	port        int
 	httpClient  *http.Client
-	shards      []string
+	routes      atomic.Pointer[[]shardGroup]
 	redisClient *redisclient.Client
-	sf          singleflight.Group
+	sf          flightGroup
+	hedge       hedgeConfig
+	budget      hedgeBudget
+	latency     *latencyTracker
+	rr          atomic.Uint64
+	breakerCfg  breakerConfig
+	breakersMu  sync.Mutex
+	breakers    map[string]*breaker
+	// shards the registry has listed at least once; their static entries
+	// are no longer used. Only refreshRoutes touches it.
+	registered map[string]bool
+	// default budget for a search when the client doesn't set one
+	searchTimeout time.Duration
+	// SHARD_PROTOCOL=json pins every replica to JSON; otherwise replicas
+	// that advertise binary on /health are queried over it
+	shardProtocol string
+	binaryShards  sync.Map
+	// ranking defaults for requests that don't set their own
+	fieldBoosts     map[string]float64
+	exactTitleBoost float64
+	fallbackMinHits int
+	spellcheck      bool
+	autoCorrect     bool
+	mmrLambda       float64
+	rerankTopN      int
+	rerankBudget    time.Duration
+
+	// synonym and rewrite rules, swapped in when REWRITE_RULES changes
+	rules atomic.Pointer[rewrite.Rules]
+	// pinned and blocked docs, swapped in when PIN_RULES changes; ring
+	// finds the shard that owns a pinned doc and must match the indexer's
+	pins atomic.Pointer[pins.Rules]
+	ring *ring.HashRing
+	// named ranking pipelines from PIPELINES, and the one used when a
+	// request names none
+	pipelines       atomic.Pointer[pipeline.Set]
+	defaultPipeline string
+	// experiments from EXPERIMENTS assign visitors to pipelines; served
+	// searches and feedback are appended to EVENT_LOG
+	experiments atomic.Pointer[experiment.Set]
+	events      *eventlog.Log
+	// how many of the most clicked docs get a popularity prior
+	priorDocs int
+	// share of searches whose LTR features are logged, from
+	// FEATURE_LOG_RATE
+	featureLogRate float64
+	// adminToken, from ADMIN_TOKEN, authorises calls to the shards'
+	// admin-only endpoints such as /priors
+	adminToken string
+	// eval marks a coordinator built by NewEvalServer
+	eval bool
+}
+
+// rulesPoll is how often the rewrite, pin, pipeline and experiment files
+// are checked for changes.
+const rulesPoll = 2 * time.Second
+
+// shardGroup is one logical shard and the replica URLs that serve it.
+type shardGroup struct {
+	ID       string
+	Replicas []string
 }
 type Result struct {
 	DocID   string  `json:"doc_id"`
 	Score   float64 `json:"score"`
 	ShardID string  `json:"shard_id"`
-	Title   string  `json:"title"`
-	Text    string  `json:"text"`
+	Title   string  `json:"title,omitempty"`
+	Text    string  `json:"text,omitempty"`
+	// stored fields other than title and text, when requested
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	Highlights map[string][]string    `json:"highlights,omitempty"`
+	ExactTitle bool                   `json:"exact_title,omitempty"`
+	// Sort carries shard sort values for the merge; cleared after it
+	Sort     []string     `json:"sort,omitempty"`
+	Explain  *Explanation `json:"explain,omitempty"`
+	Fallback bool         `json:"fallback,omitempty"`
+	// Pinned marks a doc placed by an editorial rule rather than ranked;
+	// it has no score
+	Pinned bool `json:"pinned,omitempty"`
+	// Collapsed counts the duplicates folded into this hit
+	Collapsed int `json:"collapsed,omitempty"`
+	// Vector, WikiID and TitleKey are attached by shards for
+	// diversification and cleared after it. The fetch phase then sets
+	// WikiID, the global ID feedback names the hit by.
+	Vector   []float32 `json:"vector,omitempty"`
+	WikiID   string    `json:"wiki_id,omitempty"`
+	TitleKey string    `json:"title_key,omitempty"`
+	// Features is the LTR feature vector of a logged search; it goes to
+	// the event log, not the response
+	Features []float64 `json:"features,omitempty"`
+}
+
+const maxTopK = 100
+
+// maxSearchTimeout bounds a search budget however it is asked for; the
+// shard transport's own safety net sits above it.
+const maxSearchTimeout = 30 * time.Second
+
+// SearchRequest is the coordinator /search body. Fields picks the stored
+// fields fetched for the final hits (default title and text; empty for IDs
+// and scores only) and TextLength truncates text to that many characters.
+type SearchRequest struct {
+	Query      string            `json:"query"`
+	TopK       int               `json:"top_k"`
+	Vector     []float32         `json:"vector"`
+	TimeoutMs  int               `json:"timeout_ms"`
+	Fields     []string          `json:"fields,omitempty"`
+	TextLength int               `json:"text_length,omitempty"`
+	Highlight  *HighlightOptions `json:"highlight,omitempty"`
+	// DSL replaces the plain match on Query with a structured query;
+	// Syntax "query_string" reads Query as Bleve query-string syntax
+	DSL    *dsl.Query `json:"dsl,omitempty"`
+	Syntax string     `json:"syntax,omitempty"`
+	// Boosts weights the plain query per field, e.g. {"title": 3, "text": 1};
+	// ExactTitleBoost rewards docs whose normalised title equals the query;
+	// Navigational returns such docs first regardless of score
+	Boosts          map[string]float64 `json:"boosts,omitempty"`
+	ExactTitleBoost *float64           `json:"exact_title_boost,omitempty"`
+	Navigational    bool               `json:"navigational,omitempty"`
+	// Filters restrict hits by metadata without changing scores; Facets
+	// asks for counts over the matching docs, keyed by facet name
+	Filters []dsl.Filter              `json:"filters,omitempty"`
+	Facets  map[string]facets.Request `json:"facets,omitempty"`
+	// Mode "semantic" ranks by vector similarity alone; the default
+	// "hybrid" reranks BM25 candidates
+	Mode string `json:"mode,omitempty"`
+	// Sort orders hits by stored fields; "_score" adds relevance as a
+	// key. Ties always fall back to shard ID then doc ID
+	Sort []sorting.Field `json:"sort,omitempty"`
+	// Explain attaches a score breakdown to every hit
+	Explain bool `json:"explain,omitempty"`
+	// FallbackMinHits: shards with fewer lexical hits than this add
+	// nearest neighbours, marked fallback; 0 turns it off
+	FallbackMinHits *int `json:"fallback_min_hits,omitempty"`
+	// Spellcheck returns a "did you mean" suggestion for plain queries;
+	// AutoCorrect also re-runs the suggestion when nothing matched
+	// lexically
+	Spellcheck  *bool `json:"spellcheck,omitempty"`
+	AutoCorrect *bool `json:"auto_correct,omitempty"`
+	// Diversify collapses near-duplicates and spreads the top hits over
+	// different topics
+	Diversify *Diversify `json:"diversify,omitempty"`
+	// Rerank re-scores the merged top hits with a cross-encoder
+	Rerank *RerankOptions `json:"rerank,omitempty"`
+	// Fusion sets how shards combine BM25 and cosine, and how many BM25
+	// candidates they rerank
+	Fusion *fusion.Params `json:"fusion,omitempty"`
+	// Pipeline names a configured pipeline whose stages fill the options
+	// above that the request leaves unset
+	Pipeline string `json:"pipeline,omitempty"`
+
+	// rewrite is the lexical form of Query after synonym and rewrite
+	// rules, set by the handler when any rule fired
+	rewrite *rewrite.Result
+	// pins is the pin rules snapshot the request is served with
+	pins *pins.Rules
+	// searchID is set when the search's LTR features are logged, which
+	// asks shards for them
+	searchID string
+	// assigned marks a Pipeline picked by an experiment arm rather than
+	// the client
+	assigned bool
+}
+
+// HighlightOptions asks for query-focused fragments per hit. In lexical
+// mode shards mark query terms with Bleve's highlighter; in semantic mode
+// the coordinator returns the passages of text closest to the query vector.
+type HighlightOptions struct {
+	Mode         string   `json:"mode,omitempty"`
+	Fields       []string `json:"fields,omitempty"`
+	FragmentSize int      `json:"fragment_size,omitempty"`
+	Fragments    int      `json:"fragments,omitempty"`
+	PreTag       string   `json:"pre_tag,omitempty"`
+	PostTag      string   `json:"post_tag,omitempty"`
+}
+
+// SearchResponse is the coordinator /search body. Shards reports which
+// shards answered; skipped shards had every replica's circuit open and were
+// not queried, failed shards were queried and errored.
+type SearchResponse struct {
+	Hits   []Result                 `json:"hits"`
+	Facets map[string]facets.Result `json:"facets,omitempty"`
+	// Suggestion is a spelling correction of the query; Corrected means
+	// the hits are for the suggestion because the query matched nothing
+	Suggestion string `json:"suggestion,omitempty"`
+	Corrected  bool   `json:"corrected,omitempty"`
+	// Rerank says whether the cross-encoder ran: "applied", or why the
+	// hybrid order was kept
+	Rerank string `json:"rerank,omitempty"`
+	// LTR says, for fusion method ltr, whether the shards' model ranked
+	// the hits: "applied", or "unavailable" when the shards didn't all
+	// score with the same model and linear fusion was used instead
+	LTR      string     `json:"ltr,omitempty"`
+	Pipeline string     `json:"pipeline,omitempty"`
+	Shards   ShardsInfo `json:"shards"`
+	TimedOut bool       `json:"timed_out,omitempty"`
+}
+
+// TimedOut lists shards that ran out of budget, whether they returned
+// partial hits or never answered. FetchFailed lists shards whose hits came
+// back without stored fields because the fetch phase couldn't reach them.
+type ShardsInfo struct {
+	Total       int      `json:"total"`
+	Successful  int      `json:"successful"`
+	Skipped     []string `json:"skipped,omitempty"`
+	Failed      []string `json:"failed,omitempty"`
+	TimedOut    []string `json:"timed_out,omitempty"`
+	FetchFailed []string `json:"fetch_failed,omitempty"`
+}
+
+// complete reports whether every shard answered both phases in time.
+func (si ShardsInfo) complete() bool {
+	return si.Successful == si.Total && len(si.TimedOut) == 0 && len(si.FetchFailed) == 0
 }
 
 func NewServer() *http.Server {
+	return newServer(false)
+}
+
+// NewEvalServer builds a coordinator for offline evaluation. It routes and
+// ranks like NewServer, with the registry, the rule, pin and pipeline files
+// and shard health each read once, but has no result cache, no experiments,
+// no feature sampling or event log, doesn't record served searches, and
+// starts no background work: no health probes, prior pushes or watches.
+func NewEvalServer() *http.Server {
+	return newServer(true)
+}
+
+func newServer(eval bool) *http.Server {
 	portStr := os.Getenv("PORT")
 	if portStr == "" {
 		portStr = "8080"
@@ -45,22 +277,108 @@ func NewServer() *http.Server {
 	}
 	srv := &Server{
 		port: port,
-		httpClient: &http.Client{
-			Timeout: 2 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        600,
-				MaxIdleConnsPerHost: 150,
-				IdleConnTimeout:     90 * time.Second,
-				DisableKeepAlives:   false,
-			},
-		},
-		shards: []string{
-			"http://shard0:8080",
-			"http://shard1:8080",
-			"http://shard2:8080",
-			"http://shard3:8080",
-		},
+		// no client timeout: every shard call carries its own deadline
+		httpClient:  &http.Client{Transport: newShardTransport()},
 		redisClient: redisclient.NewClient(redisAddr),
+		hedge:       loadHedgeConfig(),
+		latency:     newLatencyTracker(),
+		breakerCfg:  loadBreakerConfig(),
+		breakers:    make(map[string]*breaker),
+
+		searchTimeout: 2 * time.Second,
+		shardProtocol: os.Getenv("SHARD_PROTOCOL"),
+
+		fieldBoosts:     parseBoosts(os.Getenv("FIELD_BOOSTS")),
+		exactTitleBoost: 2,
+		fallbackMinHits: 1,
+		mmrLambda:       0.7,
+		rerankTopN:      20,
+		rerankBudget:    150 * time.Millisecond,
+		priorDocs:       10000,
+		eval:            eval,
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("EXACT_TITLE_BOOST"), 64); err == nil && v >= 0 {
+		srv.exactTitleBoost = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("FALLBACK_MIN_HITS")); err == nil && v >= 0 {
+		srv.fallbackMinHits = v
+	}
+	srv.spellcheck = true
+	if v, err := strconv.ParseBool(os.Getenv("SPELLCHECK")); err == nil {
+		srv.spellcheck = v
+	}
+	srv.autoCorrect, _ = strconv.ParseBool(os.Getenv("SPELL_AUTO_CORRECT"))
+	if v, err := strconv.ParseFloat(os.Getenv("MMR_LAMBDA"), 64); err == nil && v >= 0 && v <= 1 {
+		srv.mmrLambda = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("RERANK_TOP_N")); err == nil && v > 0 && v <= maxTopK {
+		srv.rerankTopN = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("RERANK_BUDGET")); err == nil && v > 0 {
+		srv.rerankBudget = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SEARCH_TIMEOUT")); err == nil && v > 0 && v <= maxSearchTimeout {
+		srv.searchTimeout = v
+	}
+	ringShards, ringVNodes := ring.DefaultShards, ring.DefaultVNodes
+	if v, err := strconv.Atoi(os.Getenv("RING_SHARDS")); err == nil && v > 0 {
+		ringShards = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("RING_VNODES")); err == nil && v > 0 {
+		ringVNodes = v
+	}
+	srv.ring = ring.NewHashRing(ringShards, ringVNodes)
+
+	static := parseShardURLs(os.Getenv("SHARD_URLS"))
+	srv.routes.Store(&static)
+	if os.Getenv("MEMBERSHIP") != "static" {
+		reg := membership.NewRedisRegistry(srv.redisClient, membershipPoll)
+		if eval {
+			srv.refreshRoutes(context.Background(), reg, static)
+		} else {
+			go srv.watchMembership(context.Background(), reg, static)
+		}
+	}
+	if eval {
+		srv.probeAll(context.Background())
+	} else {
+		go srv.probeShards(context.Background())
+	}
+	if path := os.Getenv("REWRITE_RULES"); path != "" {
+		srv.watch(func(ctx context.Context) { rewrite.Watch(ctx, path, rulesPoll, srv.rules.Store) })
+	}
+	if path := os.Getenv("PIN_RULES"); path != "" {
+		srv.watch(func(ctx context.Context) { pins.Watch(ctx, path, rulesPoll, srv.pins.Store) })
+	}
+	srv.defaultPipeline = os.Getenv("DEFAULT_PIPELINE")
+	if path := os.Getenv("PIPELINES"); path != "" {
+		srv.watch(func(ctx context.Context) { pipeline.Watch(ctx, path, rulesPoll, srv.pipelines.Store) })
+	}
+	srv.adminToken = os.Getenv("ADMIN_TOKEN")
+	if eval {
+		return &http.Server{Handler: srv.RegisterRoutes()}
+	}
+
+	if path := os.Getenv("EXPERIMENTS"); path != "" {
+		go experiment.Watch(context.Background(), path, rulesPoll, srv.experiments.Store)
+	}
+	if v, err := strconv.Atoi(os.Getenv("PRIOR_DOCS")); err == nil && v > 0 {
+		srv.priorDocs = v
+	}
+	priorInterval := 5 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("PRIOR_PUSH_INTERVAL")); err == nil && v > 0 {
+		priorInterval = v
+	}
+	go srv.pushPriorsLoop(context.Background(), priorInterval)
+	if v, err := strconv.ParseFloat(os.Getenv("FEATURE_LOG_RATE"), 64); err == nil && v >= 0 && v <= 1 {
+		srv.featureLogRate = v
+	}
+	if path := os.Getenv("EVENT_LOG"); path != "" {
+		events, err := eventlog.Open(path)
+		if err != nil {
+			log.Println("event log disabled:", err)
+		}
+		srv.events = events
 	}
 
 	server := &http.Server{
@@ -73,3 +391,60 @@ func NewServer() *http.Server {
 
 	return server
 }
+
+// watch starts a config file watch. An eval coordinator loads the file once
+// instead: the watch runs under a cancelled context, so it returns after its
+// first read.
+func (s *Server) watch(run func(ctx context.Context)) {
+	if !s.eval {
+		go run(context.Background())
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	run(ctx)
+}
+
+// parseShardURLs reads SHARD_URLS, where shards are separated by ';' and the
+// replicas of a shard by ',', e.g. "http://a0:8080,http://a1:8080;http://b0:8080".
+// Shard IDs are assigned by position.
+func parseShardURLs(spec string) []shardGroup {
+	if spec == "" {
+		spec = "http://shard0:8080;http://shard1:8080;http://shard2:8080;http://shard3:8080"
+	}
+	var groups []shardGroup
+	for _, part := range strings.Split(spec, ";") {
+		var replicas []string
+		for _, u := range strings.Split(part, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				replicas = append(replicas, u)
+			}
+		}
+		if len(replicas) == 0 {
+			continue
+		}
+		groups = append(groups, shardGroup{
+			ID:       strconv.Itoa(len(groups)),
+			Replicas: replicas,
+		})
+	}
+	return groups
+}
+
+// parseBoosts reads FIELD_BOOSTS, e.g. "title=3,text=1".
+func parseBoosts(spec string) map[string]float64 {
+	if spec == "" {
+		return nil
+	}
+	boosts := make(map[string]float64)
+	for _, part := range strings.Split(spec, ",") {
+		field, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		if b, err := strconv.ParseFloat(val, 64); err == nil && b > 0 {
+			boosts[field] = b
+		}
+	}
+	return boosts
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"html"
+	"log"
+	"sort"
+
+	"turbo-query/internal/embed"
+	"turbo-query/internal/snippet"
+)
+
+// Every passage costs a model pass, and the model is shared with query
+// embedding, so passages are embedded snippetBatch at a time and queries
+// can get the model in between.
+const snippetBatch = 16
+
+type scoredPassage struct {
+	text  string
+	score float64
+}
+
+// semanticSnippets splits each hit's text into passages, embeds them in
+// small batches, and keeps the passages closest to the query vector as the
+// hit's text highlights. Every passage of a hit is a candidate, so the best
+// one can come from late in a long article. The search deadline bounds the
+// work: hits whose passages weren't embedded before it get no highlights,
+// and a hit cut off midway is highlighted from the passages embedded.
+func (s *Server) semanticSnippets(ctx context.Context, hits []Result, qvec []float32, hl *HighlightOptions) {
+	var owner []int
+	var texts []string
+	for i, h := range hits {
+		for _, p := range snippet.Passages(h.Text, hl.FragmentSize) {
+			owner = append(owner, i)
+			texts = append(texts, p)
+		}
+	}
+	if len(texts) == 0 {
+		return
+	}
+
+	// batches run in hit order, so a deadline cuts off the lowest hits
+	var vecs [][]float32
+	for start := 0; start < len(texts); start += snippetBatch {
+		batch, err := embed.GetEmbeddingsContext(ctx, texts[start:min(start+snippetBatch, len(texts))])
+		if err != nil {
+			log.Println("snippet embedding failed:", err)
+			break
+		}
+		vecs = append(vecs, batch...)
+	}
+
+	perHit := make(map[int][]scoredPassage)
+	for i, vec := range vecs {
+		perHit[owner[i]] = append(perHit[owner[i]], scoredPassage{text: texts[i], score: dot(qvec, vec)})
+	}
+	for i, cands := range perHit {
+		hits[i].Highlights = map[string][]string{"text": bestPassages(cands, hl.Fragments)}
+	}
+}
+
+// bestPassages returns the n closest passages, best first, HTML-escaped
+// like the lexical fragments Bleve returns.
+func bestPassages(cands []scoredPassage, n int) []string {
+	sort.SliceStable(cands, func(a, b int) bool { return cands[a].score > cands[b].score })
+	if len(cands) > n {
+		cands = cands[:n]
+	}
+	frags := make([]string, len(cands))
+	for j, c := range cands {
+		frags[j] = html.EscapeString(c.text)
+	}
+	return frags
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		sum += float64(a[i] * b[i])
+	}
+	return sum
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBestPassages(t *testing.T) {
+	cands := []scoredPassage{
+		{"Intro.", 0.2},
+		{"Early life.", 0.4},
+		{"A <script> tag & more.", 0.5},
+		{"Legacy.", 0.1},
+		// the best passage comes late in the article
+		{"Nobel Prize in Physics.", 0.9},
+	}
+	got := bestPassages(cands, 2)
+	want := []string{"Nobel Prize in Physics.", "A &lt;script&gt; tag &amp; more."}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bestPassages = %q, want %q", got, want)
+	}
+
+	if got := bestPassages([]scoredPassage{{"only", 0}}, 3); !reflect.DeepEqual(got, []string{"only"}) {
+		t.Errorf("bestPassages with fewer candidates = %q", got)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sort"
+)
+
+// spellRatio is how many times more frequent a correction must be than the
+// token it replaces, when the token does occur in the index.
+const spellRatio = 10
+
+// spellToken is a shard's correction candidates for one query token (see
+// shardnode.SpellToken).
+type spellToken struct {
+	Token      string           `json:"token"`
+	Start      int              `json:"start"`
+	End        int              `json:"end"`
+	DocFreq    uint64           `json:"df"`
+	Candidates []spellCandidate `json:"candidates,omitempty"`
+}
+
+type spellCandidate struct {
+	Term     string `json:"term"`
+	DocFreq  uint64 `json:"df"`
+	Distance int    `json:"distance"`
+}
+
+// mergeSpelling sums each token's and candidate's document frequencies
+// across shards and rewrites the query with the most frequent candidate
+// for every token that is missing from the index or far rarer than it. It
+// returns "" when nothing needs correcting.
+func mergeSpelling(query string, shards [][]spellToken) string {
+	type span struct{ start, end int }
+	tokens := make(map[span]*spellToken)
+	for _, toks := range shards {
+		for _, t := range toks {
+			key := span{t.Start, t.End}
+			merged, ok := tokens[key]
+			if !ok {
+				merged = &spellToken{Token: t.Token, Start: t.Start, End: t.End}
+				tokens[key] = merged
+			}
+			merged.DocFreq += t.DocFreq
+			for _, c := range t.Candidates {
+				found := false
+				for i := range merged.Candidates {
+					if merged.Candidates[i].Term == c.Term {
+						merged.Candidates[i].DocFreq += c.DocFreq
+						found = true
+						break
+					}
+				}
+				if !found {
+					merged.Candidates = append(merged.Candidates, c)
+				}
+			}
+		}
+	}
+
+	var fixes []spellToken
+	for _, t := range tokens {
+		if len(t.Candidates) == 0 {
+			continue
+		}
+		sort.Slice(t.Candidates, func(i, j int) bool {
+			a, b := t.Candidates[i], t.Candidates[j]
+			if a.DocFreq != b.DocFreq {
+				return a.DocFreq > b.DocFreq
+			}
+			if a.Distance != b.Distance {
+				return a.Distance < b.Distance
+			}
+			return a.Term < b.Term
+		})
+		best := t.Candidates[0]
+		if t.DocFreq == 0 || best.DocFreq >= spellRatio*t.DocFreq {
+			fixes = append(fixes, spellToken{Token: best.Term, Start: t.Start, End: t.End})
+		}
+	}
+	if len(fixes) == 0 {
+		return ""
+	}
+
+	// replace from the end so earlier offsets stay valid
+	sort.Slice(fixes, func(i, j int) bool { return fixes[i].Start > fixes[j].Start })
+	out := query
+	for _, f := range fixes {
+		if f.Start < 0 || f.End > len(out) || f.Start > f.End {
+			continue
+		}
+		out = out[:f.Start] + f.Token + out[f.End:]
+	}
+	return out
+}
+
+// lexicalMiss reports whether no hit matched the query lexically.
+func lexicalMiss(hits []Result) bool {
+	for _, h := range hits {
+		if !h.Fallback {
+			return false
+		}
+	}
+	return true
+}
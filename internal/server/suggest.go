@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// suggestTimeout bounds /suggest; completions are only useful while the
+// user is still typing.
+const suggestTimeout = 100 * time.Millisecond
+
+// Suggestion is a title completion (see shardnode.Suggestion).
+type Suggestion struct {
+	Key        string  `json:"key"`
+	Title      string  `json:"title"`
+	Popularity float64 `json:"popularity"`
+	Mentions   uint64  `json:"mentions"`
+}
+
+type suggestResponse struct {
+	Suggestions []Suggestion `json:"suggestions"`
+}
+
+// SuggestHandler completes a title prefix from every shard's title FST.
+// Shards that don't answer in time are left out rather than failing the
+// request.
+func (s *Server) SuggestHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		size = 10
+	}
+	if size > 50 {
+		size = 50
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), suggestTimeout)
+	defer cancel()
+
+	q := url.Values{"prefix": {prefix}, "size": {strconv.Itoa(size)}}.Encode()
+	var (
+		mu  sync.Mutex
+		all [][]Suggestion
+		wg  sync.WaitGroup
+	)
+	for _, g := range s.shardGroups() {
+		wg.Add(1)
+		go func(g shardGroup) {
+			defer wg.Done()
+			next := s.replicaPicker(g)
+			for u, ok := next(); ok; u, ok = next() {
+				sr, err := s.suggestReplica(ctx, u+"/suggest?"+q)
+				if err == nil {
+					mu.Lock()
+					all = append(all, sr.Suggestions)
+					mu.Unlock()
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestResponse{Suggestions: mergeSuggestions(all, size)})
+}
+
+func (s *Server) suggestReplica(ctx context.Context, u string) (*suggestResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shard status %d", resp.StatusCode)
+	}
+	var sr suggestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, err
+	}
+	return &sr, nil
+}
+
+// mergeSuggestions combines titles that several shards return and ranks
+// like the shards do: by popularity, then mentions, then shortest title.
+// Priors are global, so popularity takes the highest; mention counts are
+// per shard, so they add up.
+func mergeSuggestions(shards [][]Suggestion, n int) []Suggestion {
+	byKey := make(map[string]*Suggestion)
+	for _, list := range shards {
+		for _, sg := range list {
+			if e, ok := byKey[sg.Key]; ok {
+				e.Popularity = max(e.Popularity, sg.Popularity)
+				e.Mentions += sg.Mentions
+				continue
+			}
+			sg := sg
+			byKey[sg.Key] = &sg
+		}
+	}
+	out := make([]Suggestion, 0, len(byKey))
+	for _, e := range byKey {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Popularity != b.Popularity {
+			return a.Popularity > b.Popularity
+		}
+		if a.Mentions != b.Mentions {
+			return a.Mentions > b.Mentions
+		}
+		if len(a.Key) != len(b.Key) {
+			return len(a.Key) < len(b.Key)
+		}
+		return a.Key < b.Key
+	})
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeSuggestions(t *testing.T) {
+	shards := [][]Suggestion{
+		{
+			{Key: "paris", Title: "Paris", Mentions: 900},
+			{Key: "paris hilton", Title: "Paris Hilton", Popularity: 0.4, Mentions: 10},
+		},
+		{
+			{Key: "paris", Title: "Paris", Popularity: 0.9, Mentions: 800},
+			{Key: "parish", Title: "Parish", Mentions: 1700},
+			{Key: "parisian", Title: "Parisian", Mentions: 1700},
+		},
+	}
+	got := mergeSuggestions(shards, 4)
+	want := []Suggestion{
+		// popularity first, the highest any shard saw; mentions add up
+		{Key: "paris", Title: "Paris", Popularity: 0.9, Mentions: 1700},
+		{Key: "paris hilton", Title: "Paris Hilton", Popularity: 0.4, Mentions: 10},
+		// equal mentions: shorter title first
+		{Key: "parish", Title: "Parish", Mentions: 1700},
+		{Key: "parisian", Title: "Parisian", Mentions: 1700},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeSuggestions =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := mergeSuggestions(shards, 1); len(got) != 1 || got[0].Key != "paris" {
+		t.Fatalf("size 1 = %+v", got)
+	}
+}
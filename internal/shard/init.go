@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
 	mmap "github.com/edsrzf/mmap-go"
 )
 
@@ -48,7 +49,65 @@ func initShardStorage(baseDir string, shardID int) (*os.File, mmap.MMap, error)
 	return file, mm, nil
 }
 
-func initBleve(shardDir string) (bleve.Index, error) {
+// metadataSchema maps each metadata field a doc may carry to its type:
+// "keyword" (exact strings such as categories), "text", "number", "date"
+// (RFC 3339) or "bool".
+type metadataSchema map[string]string
+
+// reservedFields are the built-in fields metadata may not shadow.
+var reservedFields = map[string]bool{
+	"wiki_id": true, "title": true, "text": true, "title_exact": true,
+	"doc_length": true,
+}
+
+func loadMetadataSchema(path string) (metadataSchema, error) {
+	if path == "" {
+		return metadataSchema{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema metadataSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	for name, typ := range schema {
+		if reservedFields[name] {
+			return nil, fmt.Errorf("metadata field %q is reserved", name)
+		}
+		if _, err := metadataFieldMapping(typ); err != nil {
+			return nil, fmt.Errorf("metadata field %q: %w", name, err)
+		}
+	}
+	return schema, nil
+}
+
+func metadataFieldMapping(typ string) (*mapping.FieldMapping, error) {
+	var fm *mapping.FieldMapping
+	switch typ {
+	case "keyword":
+		fm = bleve.NewKeywordFieldMapping()
+	case "text":
+		fm = bleve.NewTextFieldMapping()
+	case "number":
+		fm = bleve.NewNumericFieldMapping()
+	case "date":
+		fm = bleve.NewDateTimeFieldMapping()
+	case "bool":
+		fm = bleve.NewBooleanFieldMapping()
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+	fm.Store = true
+	// facets need doc values; keep metadata out of the _all field so it
+	// doesn't leak into match queries
+	fm.DocValues = true
+	fm.IncludeInAll = false
+	return fm, nil
+}
+
+func initBleve(shardDir string, schema metadataSchema) (bleve.Index, error) {
 	indexPath := filepath.Join(shardDir, "index.bleve")
 
 	titleField := bleve.NewTextFieldMapping()
@@ -57,10 +116,30 @@ func initBleve(shardDir string) (bleve.Index, error) {
 	textField := bleve.NewTextFieldMapping()
 	textField.Store = true
 
+	// normalised title as a single token, for exact-title matching
+	titleExactField := bleve.NewKeywordFieldMapping()
+	titleExactField.Store = false
+	titleExactField.IncludeInAll = false
+	titleExactField.IncludeTermVectors = false
+
+	// characters of text, stored so ranking features don't load the text
+	docLengthField := bleve.NewNumericFieldMapping()
+	docLengthField.Index = false
+	docLengthField.IncludeInAll = false
+	docLengthField.DocValues = false
 
 	docMapping := bleve.NewDocumentMapping()
 	docMapping.AddFieldMappingsAt("title", titleField)
 	docMapping.AddFieldMappingsAt("text", textField)
+	docMapping.AddFieldMappingsAt("title_exact", titleExactField)
+	docMapping.AddFieldMappingsAt("doc_length", docLengthField)
+	for name, typ := range schema {
+		fm, err := metadataFieldMapping(typ)
+		if err != nil {
+			return nil, err
+		}
+		docMapping.AddFieldMappingsAt(name, fm)
+	}
 
 	indexMapping := bleve.NewIndexMapping()
 	indexMapping.DefaultMapping = docMapping
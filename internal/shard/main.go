@@ -3,22 +3,29 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"sync"
 	"turbo-query/internal/embed"
+	"turbo-query/internal/ring"
 )
 
 var shardWg sync.WaitGroup
 
 func main() {
-	numShards := 4
+	numShards := ring.DefaultShards
 	numWorkers := 4
-	vnodes := 128
+	vnodes := ring.DefaultVNodes
 	if err := embed.Init(); err != nil {
 		log.Fatalf("failed to init embedding model: %v", err)
 	}
 	//hash ring
-	ring := NewHashRing(numShards, vnodes)
+	hashRing := ring.NewHashRing(numShards, vnodes)
+
+	schema, err := loadMetadataSchema(os.Getenv("METADATA_SCHEMA"))
+	if err != nil {
+		log.Fatalf("failed to load metadata schema: %v", err)
+	}
 
 	jobs := make(chan IndexJob, 1000) // channels
 	prepared := make(chan PreparedDoc, 1000)
@@ -36,7 +43,7 @@ func main() {
 			panic(err)
 		}
 
-		index, err := initBleve(shardDir)
+		index, err := initBleve(shardDir, schema)
 		if err != nil {
 			panic(err)
 		}
@@ -54,7 +61,7 @@ func main() {
 		shardWg.Add(1)
 		go func(s *Shard, ch chan PreparedDoc) {
 			defer shardWg.Done()
-			shardWriter(s, ch)
+			shardWriter(s, schema, ch)
 		}(shards[i], shardChans[i])
 	}
 	var workerWg sync.WaitGroup
@@ -69,7 +76,7 @@ func main() {
 		workerWg.Wait()
 		close(prepared)
 	}()
-	go router(ring, prepared, shardChans)
+	go router(hashRing, prepared, shardChans)
 
 	go func() {
 		err := ingestWiki("filtered.json", jobs)
@@ -4,12 +4,13 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"hash/fnv"
 	"os"
-	"sort"
 	"strconv"
+	"unicode/utf8"
 
 	"turbo-query/internal/embed"
+	"turbo-query/internal/ring"
+	"turbo-query/internal/textnorm"
 	"unsafe"
 
 	"github.com/blevesearch/bleve/v2"
@@ -26,27 +27,26 @@ type Shard struct {
 }
 
 type IndexJob struct {
-	ID    string
-	Title string
-	Text  string
+	ID       string
+	Title    string
+	Text     string
+	Metadata map[string]interface{}
 }
 
 type WikiDoc struct {
-	ID    string `json:"id"`
-	Title string `json:"title"`
-	Text  string `json:"text"`
+	ID       string                 `json:"id"`
+	Title    string                 `json:"title"`
+	Text     string                 `json:"text"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
 }
 
 type PreparedDoc struct {
 	GlobalID string
 	Title    string
 	Text     string
+	Metadata map[string]interface{}
 	Vector   []float32
 }
-type HashRing struct {
-	positions []uint32       // sorted
-	shardMap  map[uint32]int // position -> shardID
-}
 
 const (
 	vectorDim       = embed.Dim
@@ -54,12 +54,6 @@ const (
 	maxDocsPerShard = 100000
 )
 
-func hash32(key string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(key))
-	return h.Sum32()
-}
-
 func float32SliceToBytes(f []float32) []byte {
 	if len(f) == 0 {
 		return nil
@@ -69,45 +63,6 @@ func float32SliceToBytes(f []float32) []byte {
 		len(f)*4,
 	)
 }
-func NewHashRing(numShards int, vnodes int) *HashRing {
-	r := &HashRing{
-		shardMap: make(map[uint32]int),
-	}
-
-	for shardID := 0; shardID < numShards; shardID++ {
-		for v := 0; v < vnodes; v++ {
-
-			key := fmt.Sprintf("shard-%d-vnode-%d", shardID, v)
-			pos := hash32(key)
-
-			r.positions = append(r.positions, pos)
-			r.shardMap[pos] = shardID
-		}
-	}
-
-	sort.Slice(r.positions, func(i, j int) bool {
-		return r.positions[i] < r.positions[j]
-	})
-
-	return r
-}
-func (r *HashRing) ShardFor(key string) int {
-	h := hash32(key)
-
-	// binary search
-	idx := sort.Search(len(r.positions), func(i int) bool {
-		return r.positions[i] >= h
-	})
-
-	// wrap around ring
-	if idx == len(r.positions) {
-		idx = 0
-	}
-
-	pos := r.positions[idx]
-	return r.shardMap[pos]
-}
-
 func ingestWiki(path string, jobs chan<- IndexJob) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -130,9 +85,10 @@ func ingestWiki(path string, jobs chan<- IndexJob) error {
 		}
 
 		jobs <- IndexJob{
-			ID:    doc.ID,
-			Text:  doc.Text,
-			Title: doc.Title,
+			ID:       doc.ID,
+			Text:     doc.Text,
+			Title:    doc.Title,
+			Metadata: doc.Metadata,
 		}
 	}
 
@@ -158,12 +114,13 @@ func worker(jobs <-chan IndexJob, out chan<- PreparedDoc) {
 			GlobalID: job.ID,
 			Title:    job.Title,
 			Text:     job.Text,
+			Metadata: job.Metadata,
 			Vector:   vec,
 		}
 	}
 }
 
-func router(ring *HashRing, in <-chan PreparedDoc, shardChans []chan PreparedDoc) {
+func router(ring *ring.HashRing, in <-chan PreparedDoc, shardChans []chan PreparedDoc) {
 	for doc := range in {
 		shardID := ring.ShardFor(doc.GlobalID)
 		shardChans[shardID] <- doc
@@ -186,7 +143,7 @@ func writeVector(s *Shard, id uint32, vec []float32) {
 
 const batchSize = 100
 
-func shardWriter(s *Shard, ch <-chan PreparedDoc) {
+func shardWriter(s *Shard, schema metadataSchema, ch <-chan PreparedDoc) {
 
 	for doc := range ch {
 
@@ -194,11 +151,21 @@ func shardWriter(s *Shard, ch <-chan PreparedDoc) {
 		s.NextDocID++
 
 		writeVector(s, localID, doc.Vector)
-		s.Batch.Index(strconv.Itoa(int(localID)), map[string]interface{}{
-			"wiki_id": doc.GlobalID,
-			"title":   doc.Title,
-			"text":    doc.Text,
-		})
+		fields := map[string]interface{}{
+			"wiki_id":     doc.GlobalID,
+			"title":       doc.Title,
+			"text":        doc.Text,
+			"title_exact": textnorm.Title(doc.Title),
+			"doc_length":  float64(utf8.RuneCountInString(doc.Text)),
+		}
+		// only fields declared in the schema are indexed, so every
+		// metadata field has a proper mapping
+		for name, v := range doc.Metadata {
+			if _, ok := schema[name]; ok {
+				fields[name] = v
+			}
+		}
+		s.Batch.Index(strconv.Itoa(int(localID)), fields)
 
 		if s.Batch.Size() >= batchSize {
 			s.Index.Batch(s.Batch)
@@ -0,0 +1,49 @@
+package shardnode
+
+import (
+	"context"
+	"strconv"
+
+	"turbo-query/internal/textnorm"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// annotate attaches what the coordinator needs to diversify the merged
+// hits: the embedding, and the global ID and title key for collapsing
+// duplicates. A failed key lookup leaves the hits without keys.
+func (s *Server) annotate(ctx context.Context, req SearchRequest, hits []SearchHit) {
+	if req.Vectors {
+		for i := range hits {
+			id, _ := strconv.ParseUint(hits[i].DocID, 10, 32)
+			hits[i].Vector = s.getVector(uint32(id))
+		}
+	}
+	if !req.Keys || len(hits) == 0 {
+		return
+	}
+
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.DocID
+	}
+	keyReq := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(ids), len(ids), 0, false)
+	keyReq.Fields = []string{"wiki_id", "title"}
+	res, err := s.index.SearchInContext(ctx, keyReq)
+	if err != nil {
+		return
+	}
+	byID := make(map[string]int, len(hits))
+	for i, h := range hits {
+		byID[h.DocID] = i
+	}
+	for _, hit := range res.Hits {
+		i, ok := byID[hit.ID]
+		if !ok {
+			continue
+		}
+		hits[i].WikiID, _ = hit.Fields["wiki_id"].(string)
+		title, _ := hit.Fields["title"].(string)
+		hits[i].TitleKey = textnorm.TitleKey(title)
+	}
+}
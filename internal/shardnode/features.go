@@ -0,0 +1,167 @@
+package shardnode
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/ltr"
+	"turbo-query/internal/textnorm"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// rankFeatures computes the LTR features of the hits, attaching them when
+// the request logs them and rescoring with the model when the request
+// fuses with ltr. It returns the version of the model that scored the
+// hits, or "" when the fused scores stand: without a loaded model, or when
+// the features can't be computed in time.
+func (s *Server) rankFeatures(ctx context.Context, req SearchRequest, fp fusion.Params, bq query.Query, hits []SearchHit) string {
+	feats, err := s.features(ctx, req, bq, hits)
+	if err != nil {
+		log.Println("ltr features:", err)
+		return ""
+	}
+	model := s.model.Load()
+	if fp.Method != fusion.LTR {
+		model = nil
+	}
+	for i := range hits {
+		if req.Features {
+			hits[i].Features = feats[i]
+		}
+		if model != nil {
+			hits[i].Score = model.Score(feats[i])
+		}
+		if e := hits[i].Explain; e != nil {
+			e.Features = feats[i].Named()
+			if fp.Method == fusion.LTR && model == nil {
+				e.Fusion = fusion.Linear
+			}
+		}
+	}
+	if model == nil {
+		return ""
+	}
+	return model.Version()
+}
+
+// features computes each hit's feature vector. BM25 is rerun over just the
+// hits, so fallback and exact title hits get theirs too.
+func (s *Server) features(ctx context.Context, req SearchRequest, bq query.Query, hits []SearchHit) ([]ltr.Vector, error) {
+	out := make([]ltr.Vector, len(hits))
+	if len(hits) == 0 {
+		return out, nil
+	}
+	ids := make([]string, len(hits))
+	pos := make(map[string]int, len(hits))
+	for i, h := range hits {
+		ids[i] = h.DocID
+		pos[h.DocID] = i
+		out[i] = ltr.NewVector()
+	}
+
+	scores := func(name string, q query.Query) error {
+		b := bleve.NewBooleanQuery()
+		b.AddMust(q)
+		b.AddFilter(bleve.NewDocIDQuery(ids))
+		res, err := s.index.SearchInContext(ctx, bleve.NewSearchRequestOptions(b, len(ids), 0, false))
+		if err != nil {
+			return err
+		}
+		for _, hit := range res.Hits {
+			if i, ok := pos[hit.ID]; ok {
+				out[i].Set(name, hit.Score)
+			}
+		}
+		return nil
+	}
+	if err := scores(ltr.FeatureBM25, bq); err != nil {
+		return nil, err
+	}
+	if req.Query != "" {
+		for name, field := range map[string]string{ltr.FeatureBM25Title: "title", ltr.FeatureBM25Text: "text"} {
+			mq := bleve.NewMatchQuery(req.Query)
+			mq.SetField(field)
+			if err := scores(name, mq); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	res, err := s.storedFields(ctx, ids, "title", "doc_length")
+	if err != nil {
+		return nil, err
+	}
+	norm := textnorm.Title(req.Query)
+	terms := strings.Fields(norm)
+	// docs indexed before doc_length was stored have their text counted
+	var unsized []string
+	for _, hit := range res.Hits {
+		i, ok := pos[hit.ID]
+		if !ok {
+			continue
+		}
+		title, _ := hit.Fields["title"].(string)
+		normTitle := textnorm.Title(title)
+		out[i].Set(ltr.FeatureTitleMatch, termShare(terms, normTitle))
+		if norm != "" && normTitle == norm {
+			out[i].Set(ltr.FeatureExactTitle, 1)
+		}
+		if n, ok := hit.Fields["doc_length"].(float64); ok {
+			out[i].Set(ltr.FeatureDocLength, n)
+		} else {
+			unsized = append(unsized, hit.ID)
+		}
+	}
+	if len(unsized) > 0 {
+		res, err := s.storedFields(ctx, unsized, "text")
+		if err != nil {
+			return nil, err
+		}
+		for _, hit := range res.Hits {
+			text, _ := hit.Fields["text"].(string)
+			out[pos[hit.ID]].Set(ltr.FeatureDocLength, float64(utf8.RuneCountInString(text)))
+		}
+	}
+
+	for i, h := range hits {
+		id64, _ := strconv.ParseUint(h.DocID, 10, 32)
+		id := uint32(id64)
+		if dvec := s.getVector(id); len(dvec) > 0 {
+			out[i].Set(ltr.FeatureCosine, dot(req.Vector, dvec))
+		}
+		out[i].Set(ltr.FeaturePopularity, s.prior(id))
+		out[i].Set(ltr.FeatureQueryLength, float64(len(terms)))
+	}
+	return out, nil
+}
+
+// storedFields loads the named stored fields of the docs.
+func (s *Server) storedFields(ctx context.Context, ids []string, fields ...string) (*bleve.SearchResult, error) {
+	req := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(ids), len(ids), 0, false)
+	req.Fields = fields
+	return s.index.SearchInContext(ctx, req)
+}
+
+// termShare is the share of terms that appear in the normalised title.
+func termShare(terms []string, title string) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+	words := make(map[string]bool)
+	for _, w := range strings.Fields(title) {
+		words[w] = true
+	}
+	n := 0
+	for _, t := range terms {
+		if words[t] {
+			n++
+		}
+	}
+	return float64(n) / float64(len(terms))
+}
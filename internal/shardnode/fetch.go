@@ -0,0 +1,129 @@
+package shardnode
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/snippet"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/highlight/format/html"
+	"github.com/blevesearch/bleve/v2/search/highlight/fragmenter/simple"
+	simplehl "github.com/blevesearch/bleve/v2/search/highlight/highlighter/simple"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+const maxFetchDocs = 1000
+
+// handleFetch returns stored fields for shard-local doc IDs. It is the
+// second phase of a search: the coordinator calls it for the merged top-k.
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := deadline.FromRequest(r)
+	defer cancel()
+
+	var req FetchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.DocIDs) > maxFetchDocs {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := s.fetch(ctx, req)
+	if err != nil {
+		http.Error(w, "fetch failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) fetch(ctx context.Context, req FetchRequest) (FetchResponse, error) {
+	resp := FetchResponse{Docs: make(map[string]map[string]interface{}, len(req.DocIDs))}
+	hl := req.Highlight
+	if hl != nil && ((req.Query == "" && req.DSL == nil) || len(hl.Fields) == 0) {
+		hl = nil
+	}
+	if len(req.DocIDs) == 0 || (len(req.Fields) == 0 && hl == nil) {
+		return resp, nil
+	}
+
+	// when highlighting, the query runs as an optional clause so the hits
+	// carry term locations without it deciding which docs come back
+	var q query.Query = bleve.NewDocIDQuery(req.DocIDs)
+	if hl != nil {
+		match, err := dsl.Build(req.Query, req.Syntax, req.DSL)
+		if err != nil {
+			return resp, err
+		}
+		b := bleve.NewBooleanQuery()
+		b.AddMust(q)
+		b.AddShould(match)
+		q = b
+	}
+
+	searchReq := bleve.NewSearchRequestOptions(q, len(req.DocIDs), 0, false)
+	searchReq.Fields = req.Fields
+	searchReq.IncludeLocations = hl != nil
+	res, err := s.index.SearchInContext(ctx, searchReq)
+	if err != nil {
+		return resp, err
+	}
+
+	for _, hit := range res.Hits {
+		fields := hit.Fields
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		if text, ok := fields["text"].(string); ok && req.TextLength > 0 {
+			fields["text"] = snippet.Truncate(text, req.TextLength)
+		}
+		resp.Docs[hit.ID] = fields
+	}
+
+	if hl != nil {
+		resp.Highlights = s.highlight(res, hl)
+	}
+	return resp, nil
+}
+
+// highlight builds query-term fragments for each hit with Bleve's simple
+// highlighter, configured per request.
+func (s *Server) highlight(res *bleve.SearchResult, hl *HighlightRequest) map[string]map[string][]string {
+	size := hl.FragmentSize
+	if size <= 0 {
+		size = 150
+	}
+	num := hl.Fragments
+	if num <= 0 {
+		num = 3
+	}
+	pre, post := hl.PreTag, hl.PostTag
+	if pre == "" && post == "" {
+		pre, post = "<mark>", "</mark>"
+	}
+	highlighter := simplehl.NewHighlighter(simple.NewFragmenter(size), html.NewFragmentFormatter(pre, post), "…")
+
+	out := make(map[string]map[string][]string, len(res.Hits))
+	for _, hit := range res.Hits {
+		if len(hit.Locations) == 0 {
+			continue
+		}
+		doc, err := s.index.Document(hit.ID)
+		if err != nil || doc == nil {
+			continue
+		}
+		frags := make(map[string][]string)
+		for _, field := range hl.Fields {
+			if f := highlighter.BestFragmentsInField(hit, doc, field, num); len(f) > 0 {
+				frags[field] = f
+			}
+		}
+		if len(frags) > 0 {
+			out[hit.ID] = frags
+		}
+	}
+	return out
+}
@@ -0,0 +1,72 @@
+package shardnode
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"turbo-query/internal/deadline"
+)
+
+// resolveBatch bounds the global IDs looked up per Bleve query when
+// loading priors.
+const resolveBatch = 500
+
+// PriorsRequest replaces the popularity priors of this shard's docs, by
+// global ID. Docs left out have a prior of 0.
+type PriorsRequest struct {
+	Priors map[string]float64 `json:"priors"`
+}
+
+// PriorsResponse reports how many of the pushed priors matched a doc here.
+type PriorsResponse struct {
+	Loaded int `json:"loaded"`
+}
+
+func (s *Server) handlePriors(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := deadline.FromRequest(r)
+	defer cancel()
+
+	var req PriorsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	wikiIDs := make([]string, 0, len(req.Priors))
+	for id := range req.Priors {
+		wikiIDs = append(wikiIDs, id)
+	}
+	priors := make(map[uint32]float64, len(wikiIDs))
+	for start := 0; start < len(wikiIDs); start += resolveBatch {
+		end := min(start+resolveBatch, len(wikiIDs))
+		ids, err := s.localIDs(ctx, wikiIDs[start:end])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for wikiID, local := range ids {
+			id, err := strconv.ParseUint(local, 10, 32)
+			if err != nil {
+				continue
+			}
+			if p := req.Priors[wikiID]; p > 0 {
+				priors[uint32(id)] = min(p, 1)
+			}
+		}
+	}
+	s.priors.Store(&priors)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PriorsResponse{Loaded: len(priors)})
+}
+
+// prior is the doc's popularity prior, 0 until the coordinator has pushed
+// one.
+func (s *Server) prior(docID uint32) float64 {
+	m := s.priors.Load()
+	if m == nil {
+		return 0
+	}
+	return (*m)[docID]
+}
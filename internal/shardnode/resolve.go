@@ -0,0 +1,143 @@
+package shardnode
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/dsl"
+
+	"github.com/RoaringBitmap/roaring/v2"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// ResolveRequest asks which of the global IDs this shard holds. With
+// Filters, only docs passing them are returned.
+type ResolveRequest struct {
+	WikiIDs []string     `json:"wiki_ids"`
+	Filters []dsl.Filter `json:"filters,omitempty"`
+}
+
+// ResolveResponse maps the global IDs found here to local IDs.
+type ResolveResponse struct {
+	IDs map[string]string `json:"ids"`
+}
+
+func (s *Server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := deadline.FromRequest(r)
+	defer cancel()
+
+	var req ResolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	ids, err := s.localIDs(ctx, req.WikiIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(req.Filters) > 0 && len(ids) > 0 {
+		allowed, err := s.allowedDocs(ctx, req.Filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for wikiID, local := range ids {
+			id, _ := strconv.ParseUint(local, 10, 32)
+			if !allowed.Contains(uint32(id)) {
+				delete(ids, wikiID)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ResolveResponse{IDs: ids})
+}
+
+// localID finds the shard-local ID of a global doc ID, or "" if the doc is
+// not on this shard.
+func (s *Server) localID(ctx context.Context, wikiID string) (string, error) {
+	ids, err := s.localIDs(ctx, []string{wikiID})
+	return ids[wikiID], err
+}
+
+// localIDs maps the global IDs held by this shard to local IDs; IDs held
+// elsewhere are left out.
+func (s *Server) localIDs(ctx context.Context, wikiIDs []string) (map[string]string, error) {
+	ids := make(map[string]string, len(wikiIDs))
+	if len(wikiIDs) == 0 {
+		return ids, nil
+	}
+	want := make(map[string]bool, len(wikiIDs))
+	dis := bleve.NewDisjunctionQuery()
+	for _, id := range wikiIDs {
+		want[id] = true
+		q := bleve.NewMatchQuery(id)
+		q.SetField("wiki_id")
+		q.SetOperator(query.MatchQueryOperatorAnd)
+		dis.AddQuery(q)
+	}
+	searchReq := bleve.NewSearchRequestOptions(dis, 10*len(wikiIDs), 0, false)
+	searchReq.Fields = []string{"wiki_id"}
+	res, err := s.index.SearchInContext(ctx, searchReq)
+	if err != nil {
+		return nil, err
+	}
+	// wiki_id is analysed, so confirm the stored value matches exactly
+	for _, hit := range res.Hits {
+		if id, _ := hit.Fields["wiki_id"].(string); want[id] {
+			ids[id] = hit.ID
+		}
+	}
+	return ids, nil
+}
+
+// blockedDocs returns the local IDs of the blocked docs held here, or nil
+// when none are. Bitmaps share the filter cache, since the block list
+// changes about as rarely as a filter set.
+func (s *Server) blockedDocs(ctx context.Context, wikiIDs []string) (*roaring.Bitmap, error) {
+	if len(wikiIDs) == 0 {
+		return nil, nil
+	}
+	raw, _ := json.Marshal(wikiIDs)
+	key := "blocked:" + string(raw)
+
+	bm, ok := s.filters.get(key)
+	if !ok {
+		ids, err := s.localIDs(ctx, wikiIDs)
+		if err != nil {
+			return nil, err
+		}
+		bm = roaring.New()
+		for _, local := range ids {
+			if id, err := strconv.ParseUint(local, 10, 32); err == nil {
+				bm.Add(uint32(id))
+			}
+		}
+		s.filters.put(key, bm)
+	}
+	// callers test for nil, so an empty set must look the same cached or not
+	if bm.IsEmpty() {
+		return nil, nil
+	}
+	return bm, nil
+}
+
+// excludeDocs wraps q so the blocked docs never match.
+func excludeDocs(q query.Query, blocked *roaring.Bitmap) query.Query {
+	if blocked == nil {
+		return q
+	}
+	ids := make([]string, 0, blocked.GetCardinality())
+	it := blocked.Iterator()
+	for it.HasNext() {
+		ids = append(ids, strconv.FormatUint(uint64(it.Next()), 10))
+	}
+	b := bleve.NewBooleanQuery()
+	b.AddMust(q)
+	b.AddMustNot(bleve.NewDocIDQuery(ids))
+	return b
+}
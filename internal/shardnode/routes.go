@@ -4,19 +4,20 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"sort"
-	"strconv"
 	"time"
 	"unsafe"
 
-	"github.com/blevesearch/bleve/v2"
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/wire"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 )
 
 const (
-	rerankWindow = 100 // BM25 candidates
-	vectorDim    = 384
+	vectorDim = 384
+	// how many candidates to rerank between deadline checks
+	deadlineCheckEvery = 16
 )
 
 func (s *Server) getVector(docID uint32) []float32 {
@@ -43,86 +44,43 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
 			time.Since(start),
 		)
 	}()
+	ctx, cancel := deadline.FromRequest(r)
+	defer cancel()
+
+	binary := r.Header.Get("Content-Type") == wire.ContentType
+
 	var req SearchRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var err error
+	if binary {
+		err = readBinaryRequest(r.Body, &req)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&req)
+	}
+	if err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 	log.Println("received search:", req.Query)
-	if req.TopK <= 0 {
-		req.TopK = 10
-	}
-
-	qvec := req.Vector
-	if len(qvec) == 0 {
-		http.Error(w, "embedding failed", http.StatusInternalServerError)
-		return
-	}
 
-	query := bleve.NewMatchQuery(req.Query)
-
-	searchReq := bleve.NewSearchRequestOptions(query, rerankWindow, 0, false)
-	searchReq.Fields = []string{"title", "text"}
-	res, err := s.index.Search(searchReq)
+	resp, status, err := s.search(ctx, req)
 	if err != nil {
-		http.Error(w, "search failed", http.StatusInternalServerError)
-		return
-	}
-
-	if len(res.Hits) == 0 {
-		json.NewEncoder(w).Encode(SearchResponse{})
+		http.Error(w, err.Error(), status)
 		return
 	}
-
-	maxBM25 := res.Hits[0].Score
-	if maxBM25 == 0 {
-		maxBM25 = 1
-	}
-
-	hits := make([]SearchHit, 0, req.TopK)
-
-	for _, hit := range res.Hits {
-		docID64, _ := strconv.ParseUint(hit.ID, 10, 32)
-		docID := uint32(docID64)
-
-		dvec := s.getVector(docID)
-		if len(dvec) == 0 {
-			continue
+	if req.Spell {
+		if resp.Spelling, err = s.spell(req.Query, resp.lexicalHits < s.spellMaxHits); err != nil {
+			log.Println("spell error:", err)
 		}
-
-		cos := dot(qvec, dvec)
-		normCos := (cos + 1) / 2
-
-		normBM25 := hit.Score / maxBM25
-
-		final := 0.7*normBM25 + 0.3*normCos
-
-		var title, text string
-
-		if v, ok := hit.Fields["title"].(string); ok {
-			title = v
-		}
-		if v, ok := hit.Fields["text"].(string); ok {
-			text = v
-		}
-		hits = append(hits, SearchHit{
-			DocID:   hit.ID,
-			Score:   final,
-			ShardID: s.shardID,
-			Title:   title,
-			Text:    text,
-		})
 	}
-
-	sort.Slice(hits, func(i, j int) bool {
-		return hits[i].Score > hits[j].Score
-	})
-
-	if len(hits) > req.TopK {
-		hits = hits[:req.TopK]
+	if req.Vectors || req.Keys {
+		s.annotate(ctx, req, resp.Hits)
 	}
 
-	json.NewEncoder(w).Encode(SearchResponse{Hits: hits})
+	if binary {
+		writeBinaryResponse(w, resp)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 func (s *Server) RegisterRoutes() http.Handler {
 	r := chi.NewRouter()
@@ -136,8 +94,33 @@ func (s *Server) RegisterRoutes() http.Handler {
 	}))
 
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		// advertise the search encodings this node accepts
+		w.Header().Set(wire.ProtocolsHeader, "json,binary")
 		w.WriteHeader(http.StatusOK)
 	})
 	r.Post("/search", s.handleSearch)
+	r.Post("/fetch", s.handleFetch)
+	r.Post("/whynot", s.handleWhyNot)
+	r.Post("/resolve", s.handleResolve)
+	r.Post("/priors", s.adminOnly(s.handlePriors))
+	r.Get("/suggest", s.handleSuggest)
+	r.Post("/admin/drain", s.adminOnly(s.handleDrain(true)))
+	r.Post("/admin/undrain", s.adminOnly(s.handleDrain(false)))
 	return r
 }
+
+// handleDrain takes the node out of (or back into) the coordinator routing
+// table without stopping it, for maintenance.
+func (s *Server) handleDrain(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.draining.Store(drain)
+		if s.registry != nil {
+			if err := s.registry.Register(r.Context(), s.member(), 3*heartbeatInterval); err != nil {
+				http.Error(w, "registry update failed", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.member())
+	}
+}
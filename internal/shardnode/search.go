@@ -0,0 +1,470 @@
+package shardnode
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/facets"
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/sorting"
+	"turbo-query/internal/textnorm"
+
+	"github.com/RoaringBitmap/roaring/v2"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// maxExactTitle bounds how many same-titled docs a navigational query pins.
+const maxExactTitle = 3
+
+const modeSemantic = "semantic"
+
+// search runs BM25 retrieval and vector reranking for one request. On error
+// it also returns the HTTP status to report.
+func (s *Server) search(ctx context.Context, req SearchRequest) (SearchResponse, int, error) {
+	if req.TopK <= 0 {
+		req.TopK = 10
+	}
+	fp := req.Fusion.Resolved()
+
+	qvec := req.Vector
+	if len(qvec) == 0 {
+		return SearchResponse{}, http.StatusInternalServerError, errors.New("embedding failed")
+	}
+
+	blocked, err := s.blockedDocs(ctx, req.Blocked)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return SearchResponse{TimedOut: true}, 0, nil
+	}
+	if err != nil {
+		return SearchResponse{}, http.StatusInternalServerError, errors.New("search failed")
+	}
+
+	if req.Mode == modeSemantic {
+		return s.semanticSearch(ctx, req, blocked)
+	}
+
+	bq, err := buildQuery(req, blocked)
+	if err != nil {
+		return SearchResponse{}, http.StatusBadRequest, err
+	}
+
+	res, err := s.window(ctx, req, bq)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return SearchResponse{TimedOut: true}, 0, nil
+	}
+	if err != nil {
+		return SearchResponse{}, http.StatusInternalServerError, errors.New("search failed")
+	}
+
+	facetResults := facets.FromBleve(res.Facets)
+
+	maxBM25 := bm25Max(res)
+
+	hits := make([]SearchHit, 0, len(res.Hits))
+	// fusion inputs for each reranked candidate, in hits order
+	cosines := make([]float64, 0, len(res.Hits))
+	bm25Norms := make([]float64, 0, len(res.Hits))
+	bm25Ranks := make([]int, 0, len(res.Hits))
+	priors := make([]float64, 0, len(res.Hits))
+	timedOut := false
+
+	for i, hit := range res.Hits {
+		// out of budget: return what has been reranked so far
+		if i%deadlineCheckEvery == 0 && ctx.Err() != nil {
+			timedOut = true
+			break
+		}
+
+		docID64, _ := strconv.ParseUint(hit.ID, 10, 32)
+		docID := uint32(docID64)
+
+		dvec := s.getVector(docID)
+		if len(dvec) == 0 {
+			continue
+		}
+
+		cos := dot(qvec, dvec)
+		normCos := (cos + 1) / 2
+
+		normBM25 := hit.Score / maxBM25
+
+		var title, text string
+
+		if v, ok := hit.Fields["title"].(string); ok {
+			title = v
+		}
+		if v, ok := hit.Fields["text"].(string); ok {
+			text = v
+		}
+		h := SearchHit{
+			DocID:   hit.ID,
+			ShardID: s.shardID,
+			Title:   title,
+			Text:    text,
+		}
+		if len(req.Sort) > 0 && len(hit.Sort) >= len(req.Sort) {
+			h.Sort = hit.Sort[:len(req.Sort)]
+		}
+		if req.Explain {
+			h.Explain = &Explanation{
+				BM25:             hit.Score,
+				BM25Max:          maxBM25,
+				BM25Norm:         normBM25,
+				Cosine:           cos,
+				CosineNorm:       normCos,
+				WeightBM25:       *fp.WeightBM25,
+				WeightVector:     *fp.WeightVector,
+				Fusion:           fp.Method,
+				BM25Rank:         i + 1,
+				Popularity:       s.prior(docID),
+				WeightPopularity: *fp.WeightPopularity,
+				Tree:             hit.Expl,
+			}
+		}
+		hits = append(hits, h)
+		cosines = append(cosines, cos)
+		bm25Norms = append(bm25Norms, normBM25)
+		bm25Ranks = append(bm25Ranks, i+1)
+		priors = append(priors, s.prior(docID))
+	}
+	vecRanks := cosineRanks(cosines)
+	for i := range hits {
+		hits[i].Score = fp.Score(bm25Norms[i], (cosines[i]+1)/2, bm25Ranks[i], vecRanks[i], priors[i])
+		if hits[i].Explain != nil {
+			hits[i].Explain.VectorRank = vecRanks[i]
+		}
+	}
+
+	if req.Navigational && !timedOut {
+		hits = s.addExactTitle(ctx, req, fp, cosines, blocked, hits)
+	}
+	// sorted requests skip the fallback: vector hits have no sort values
+	if len(hits) < req.FallbackMinHits && len(req.Sort) == 0 && !timedOut {
+		hits = s.addFallback(ctx, req, fp, blocked, hits)
+	}
+	var model string
+	if (req.Features || fp.Method == fusion.LTR) && !timedOut {
+		model = s.rankFeatures(ctx, req, fp, bq, hits)
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if len(req.Sort) > 0 {
+			if c := sorting.Compare(req.Sort, a.Sort, b.Sort, a.Score, b.Score); c != 0 {
+				return c < 0
+			}
+		} else {
+			if a.ExactTitle != b.ExactTitle {
+				return a.ExactTitle
+			}
+			if a.Fallback != b.Fallback {
+				return !a.Fallback
+			}
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+		}
+		return sorting.TieBreak(a.ShardID, a.DocID, b.ShardID, b.DocID)
+	})
+
+	if len(hits) > req.TopK {
+		hits = hits[:req.TopK]
+	}
+	for i := range hits {
+		if hits[i].Explain != nil {
+			hits[i].Explain.ShardRank = i + 1
+		}
+	}
+
+	return SearchResponse{Hits: hits, Facets: facetResults, TimedOut: timedOut, Model: model, lexicalHits: res.Total}, 0, nil
+}
+
+// window runs the BM25 stage: the fusion window's best matches, or the
+// first in sort order when the request sorts by fields.
+func (s *Server) window(ctx context.Context, req SearchRequest, bq query.Query) (*bleve.SearchResult, error) {
+	searchReq := bleve.NewSearchRequestOptions(bq, req.Fusion.Resolved().Window, 0, req.Explain)
+	if !req.QueryOnly {
+		searchReq.Fields = []string{"title", "text"}
+	}
+	if len(req.Sort) > 0 {
+		// the window is the first matches in sort order, not the best
+		// BM25 matches
+		searchReq.SortByCustom(sorting.Bleve(req.Sort))
+	}
+	facets.AddTo(searchReq, req.Facets)
+	return s.index.SearchInContext(ctx, searchReq)
+}
+
+// bm25Max is the top BM25 score in the window, used to normalise the rest.
+func bm25Max(res *bleve.SearchResult) float64 {
+	m := 0.0
+	for _, hit := range res.Hits {
+		m = max(m, hit.Score)
+	}
+	if m == 0 {
+		m = 1
+	}
+	return m
+}
+
+// cosineRanks returns each candidate's 1-based rank by cosine among the
+// candidates.
+func cosineRanks(cosines []float64) []int {
+	idx := make([]int, len(cosines))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return cosines[idx[a]] > cosines[idx[b]]
+	})
+	ranks := make([]int, len(cosines))
+	for r, i := range idx {
+		ranks[i] = r + 1
+	}
+	return ranks
+}
+
+// cosineRank is where a doc outside the candidates would rank among them
+// by cosine.
+func cosineRank(cosines []float64, cos float64) int {
+	r := 1
+	for _, c := range cosines {
+		if c > cos {
+			r++
+		}
+	}
+	return r
+}
+
+// buildQuery is the BM25 query for a request. A plain query with Boosts
+// becomes one match per boosted field; ExactTitleBoost adds an optional
+// clause on the normalised title. Synonym expansions are matched as
+// phrases alongside the query. Filters and blocked docs are applied last so
+// they gate every clause.
+func buildQuery(req SearchRequest, blocked *roaring.Bitmap) (query.Query, error) {
+	var q query.Query
+	if req.DSL == nil && req.Syntax == "" && len(req.Boosts) > 0 {
+		dis := bleve.NewDisjunctionQuery()
+		for field, boost := range req.Boosts {
+			if boost <= 0 {
+				continue
+			}
+			mq := bleve.NewMatchQuery(req.Query)
+			mq.SetField(field)
+			mq.SetBoost(boost)
+			dis.AddQuery(mq)
+		}
+		if len(dis.Disjuncts) == 0 {
+			return nil, errors.New("no positive field boosts")
+		}
+		q = dis
+	} else {
+		var err error
+		if q, err = dsl.Build(req.Query, req.Syntax, req.DSL); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(req.Expansions) > 0 {
+		dis := bleve.NewDisjunctionQuery(q)
+		for _, p := range req.Expansions {
+			dis.AddQuery(bleve.NewMatchPhraseQuery(p))
+		}
+		q = dis
+	}
+
+	norm := textnorm.Title(req.Query)
+	if req.ExactTitleBoost > 0 && norm != "" {
+		exact := bleve.NewTermQuery(norm)
+		exact.SetField("title_exact")
+		exact.SetBoost(req.ExactTitleBoost)
+		b := bleve.NewBooleanQuery()
+		b.AddMust(q)
+		b.AddShould(exact)
+		q = b
+	}
+	return dsl.WithFilters(excludeDocs(q, blocked), req.Filters)
+}
+
+// addExactTitle marks hits whose normalised title equals the query and adds
+// any such docs the BM25 window missed, scored as if they had topped BM25.
+func (s *Server) addExactTitle(ctx context.Context, req SearchRequest, fp fusion.Params, cosines []float64, blocked *roaring.Bitmap, hits []SearchHit) []SearchHit {
+	norm := textnorm.Title(req.Query)
+	if norm == "" {
+		return hits
+	}
+	exact := bleve.NewTermQuery(norm)
+	exact.SetField("title_exact")
+	q, err := dsl.WithFilters(excludeDocs(exact, blocked), req.Filters)
+	if err != nil {
+		return hits
+	}
+	searchReq := bleve.NewSearchRequestOptions(q, maxExactTitle, 0, false)
+	if !req.QueryOnly {
+		searchReq.Fields = []string{"title", "text"}
+	}
+	res, err := s.index.SearchInContext(ctx, searchReq)
+	if err != nil {
+		return hits
+	}
+
+	pos := make(map[string]int, len(hits))
+	for i, h := range hits {
+		pos[h.DocID] = i
+	}
+	for _, hit := range res.Hits {
+		if i, ok := pos[hit.ID]; ok {
+			hits[i].ExactTitle = true
+			continue
+		}
+		docID64, _ := strconv.ParseUint(hit.ID, 10, 32)
+		dvec := s.getVector(uint32(docID64))
+		if len(dvec) == 0 {
+			continue
+		}
+		cos := dot(req.Vector, dvec)
+		h := SearchHit{
+			DocID:      hit.ID,
+			Score:      fp.Score(1, (cos+1)/2, 1, cosineRank(cosines, cos), s.prior(uint32(docID64))),
+			ShardID:    s.shardID,
+			ExactTitle: true,
+		}
+		h.Title, _ = hit.Fields["title"].(string)
+		h.Text, _ = hit.Fields["text"].(string)
+		hits = append(hits, h)
+	}
+	return hits
+}
+
+// semanticSearch is pure vector retrieval. Filters become a bitmap of
+// allowed docs that the scan is restricted to, rather than a post-filter on
+// the top k.
+func (s *Server) semanticSearch(ctx context.Context, req SearchRequest, blocked *roaring.Bitmap) (SearchResponse, int, error) {
+	allowed, err := s.allowedDocs(ctx, req.Filters)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return SearchResponse{TimedOut: true}, 0, nil
+	}
+	if err != nil {
+		return SearchResponse{}, http.StatusBadRequest, err
+	}
+
+	top, timedOut := s.vectorSearch(ctx, req.Vector, req.TopK, allowed, blocked)
+	hits := make([]SearchHit, len(top))
+	for i, d := range top {
+		hits[i] = SearchHit{
+			DocID:   strconv.FormatUint(uint64(d.id), 10),
+			Score:   (d.cos + 1) / 2,
+			ShardID: s.shardID,
+		}
+		if req.Explain {
+			hits[i].Explain = &Explanation{
+				Cosine:       d.cos,
+				CosineNorm:   (d.cos + 1) / 2,
+				WeightVector: 1,
+				VectorRank:   i + 1,
+				ShardRank:    i + 1,
+			}
+		}
+	}
+
+	resp := SearchResponse{Hits: hits, TimedOut: timedOut}
+	if timedOut {
+		return resp, 0, nil
+	}
+	if len(req.Facets) > 0 {
+		var fq query.Query = bleve.NewMatchAllQuery()
+		if q, err := dsl.Filters(req.Filters); err == nil && q != nil {
+			fq = q
+		}
+		facetReq := bleve.NewSearchRequestOptions(excludeDocs(fq, blocked), 0, 0, false)
+		facets.AddTo(facetReq, req.Facets)
+		if res, err := s.index.SearchInContext(ctx, facetReq); err == nil {
+			resp.Facets = facets.FromBleve(res.Facets)
+		}
+	}
+	if !req.QueryOnly {
+		s.loadFields(ctx, resp.Hits)
+	}
+	return resp, 0, nil
+}
+
+// loadFields fills in title and text for hits that came from the vector
+// store rather than a Bleve search.
+func (s *Server) loadFields(ctx context.Context, hits []SearchHit) {
+	byID := make(map[string]int)
+	ids := make([]string, 0, len(hits))
+	for i, h := range hits {
+		if h.Title == "" && h.Text == "" {
+			byID[h.DocID] = i
+			ids = append(ids, h.DocID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	fieldReq := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(ids), len(ids), 0, false)
+	fieldReq.Fields = []string{"title", "text"}
+	res, err := s.index.SearchInContext(ctx, fieldReq)
+	if err != nil {
+		return
+	}
+	for _, hit := range res.Hits {
+		i := byID[hit.ID]
+		hits[i].Title, _ = hit.Fields["title"].(string)
+		hits[i].Text, _ = hit.Fields["text"].(string)
+	}
+}
+
+// addFallback tops up a shard with too few lexical hits from the vector
+// store. Fallback hits are scored with no BM25 or popularity term; the
+// score orders them among themselves, and the sort here and the
+// coordinator's merge put them after every lexical hit.
+func (s *Server) addFallback(ctx context.Context, req SearchRequest, fp fusion.Params, blocked *roaring.Bitmap, hits []SearchHit) []SearchHit {
+	allowed, err := s.allowedDocs(ctx, req.Filters)
+	if err != nil {
+		return hits
+	}
+	seen := make(map[string]bool, len(hits))
+	for _, h := range hits {
+		seen[h.DocID] = true
+	}
+
+	top, _ := s.vectorSearch(ctx, req.Vector, req.TopK+len(hits), allowed, blocked)
+	var added []SearchHit
+	for i, d := range top {
+		if len(hits)+len(added) >= req.TopK {
+			break
+		}
+		id := strconv.FormatUint(uint64(d.id), 10)
+		if seen[id] {
+			continue
+		}
+		normCos := (d.cos + 1) / 2
+		h := SearchHit{
+			DocID:    id,
+			Score:    fp.Score(0, normCos, 0, i+1, 0),
+			ShardID:  s.shardID,
+			Fallback: true,
+		}
+		if req.Explain {
+			h.Explain = &Explanation{
+				Cosine:       d.cos,
+				CosineNorm:   normCos,
+				WeightBM25:   *fp.WeightBM25,
+				WeightVector: *fp.WeightVector,
+				Fusion:       fp.Method,
+				VectorRank:   i + 1,
+			}
+		}
+		added = append(added, h)
+	}
+	if !req.QueryOnly {
+		s.loadFields(ctx, added)
+	}
+	return append(hits, added...)
+}
@@ -1,32 +1,72 @@
 package shardnode
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"turbo-query/internal/ltr"
+	"turbo-query/internal/membership"
+	redisclient "turbo-query/internal/redis"
+
 	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/mmap-go"
 	_ "github.com/joho/godotenv/autoload"
 )
 
 type Server struct {
-	port    int
-	shardID string
-	index   bleve.Index
-	mmapBuf mmap.MMap
+	port       int
+	shardID    string
+	addr       string
+	generation int64
+	index      bleve.Index
+	mmapBuf    mmap.MMap
+	registry   membership.Registry
+	draining   atomic.Bool
+	leave      func()
+	// adminToken guards the admin endpoints; see adminOnly
+	adminToken string
+	// spellMaxHits turns the spelling walk off for queries matching at
+	// least this many docs
+	spellMaxHits uint64
+
+	// numDocs is the number of vectors; local doc IDs run 0..numDocs-1
+	numDocs uint64
+	filters filterCache
+	suggest atomic.Pointer[suggester]
+	// popularity priors by local doc ID, pushed by the coordinator
+	priors atomic.Pointer[map[uint32]float64]
+	// learned ranking model from LTR_MODEL, for fusion method ltr
+	model atomic.Pointer[ltr.Model]
+}
+
+const heartbeatInterval = 5 * time.Second
+
+// modelPoll is how often the LTR model file is checked for changes.
+const modelPoll = 2 * time.Second
+
+// Leave stops heartbeating and removes the node from the membership
+// registry, so the coordinator stops routing to it.
+func (s *Server) Leave() {
+	if s.leave != nil {
+		s.leave()
+		s.leave = nil
+	}
 }
 
 func (s *Server) Close() {
+	s.Leave()
 	if s.mmapBuf != nil {
 		s.mmapBuf.Unmap()
 	}
 }
 
-func NewServer() *http.Server {
+func NewServer() (*http.Server, *Server) {
 	portStr := os.Getenv("PORT")
 	if portStr == "" {
 		portStr = "8080"
@@ -59,18 +99,86 @@ func NewServer() *http.Server {
 		log.Fatalf("mmap failed: %v", err)
 	}
 
+	// address the coordinator should use to reach this node
+	addr := os.Getenv("SHARD_ADDR")
+	if addr == "" {
+		host, _ := os.Hostname()
+		addr = fmt.Sprintf("http://%s:%d", host, port)
+	}
+	generation, _ := strconv.ParseInt(os.Getenv("INDEX_GENERATION"), 10, 64)
+
+	numDocs, err := idx.DocCount()
+	if err != nil {
+		log.Fatalf("failed to count docs: %v", err)
+	}
+
 	s := &Server{
-		port:    port,
-		shardID: shardID,
-		index:   idx,
+		port:       port,
+		shardID:    shardID,
+		addr:       addr,
+		generation: generation,
+		index:      idx,
 
-		mmapBuf: mmapBuf,
+		mmapBuf:    mmapBuf,
+		numDocs:    numDocs,
+		adminToken: os.Getenv("ADMIN_TOKEN"),
+
+		spellMaxHits: defaultSpellMaxHits,
+	}
+	if v, err := strconv.ParseUint(os.Getenv("SPELL_MAX_HITS"), 10, 64); err == nil {
+		s.spellMaxHits = v
+	}
+
+	go s.buildSuggester()
+	if path := os.Getenv("LTR_MODEL"); path != "" {
+		go ltr.Watch(context.Background(), path, modelPoll, s.model.Store)
 	}
 
-	return &http.Server{
+	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
 		Handler:      s.RegisterRoutes(),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
+	// serve HTTP/2 without TLS alongside HTTP/1.1 for coordinators that
+	// opt into it
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	if os.Getenv("MEMBERSHIP") != "static" {
+		redisAddr := os.Getenv("REDIS_ADDR")
+		if redisAddr == "" {
+			redisAddr = "redis:6379"
+		}
+		s.registry = membership.NewRedisRegistry(redisclient.NewClient(redisAddr), heartbeatInterval)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			membership.Heartbeat(ctx, s.registry, s.member, heartbeatInterval)
+		}()
+		s.leave = func() {
+			cancel()
+			<-done
+		}
+	}
+
+	return server, s
+}
+
+func (s *Server) member() membership.Member {
+	status := membership.StatusUp
+	if s.draining.Load() {
+		status = membership.StatusDraining
+	}
+	docCount, _ := s.index.DocCount()
+	return membership.Member{
+		ShardID:    s.shardID,
+		Addr:       s.addr,
+		Generation: s.generation,
+		DocCount:   docCount,
+		Status:     status,
+	}
 }
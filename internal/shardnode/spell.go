@@ -0,0 +1,116 @@
+package shardnode
+
+import (
+	"context"
+	"sort"
+	"unicode/utf8"
+
+	index "github.com/blevesearch/bleve_index_api"
+)
+
+const (
+	// spellField is the field whose term dictionary supplies corrections
+	spellField = "text"
+	// spellCandidates is how many corrections a shard returns per token
+	spellCandidates = 5
+	// tokens shorter than this are left alone
+	spellMinLength = 3
+	// defaultSpellMaxHits is the lexical match count from which a shard
+	// stops looking for corrections (SPELL_MAX_HITS)
+	defaultSpellMaxHits = 20
+)
+
+// SpellToken is one analysed query token with its document frequency on
+// this shard and the dictionary terms within edit distance of it. Start
+// and End are byte offsets into the query.
+type SpellToken struct {
+	Token      string           `json:"token"`
+	Start      int              `json:"start"`
+	End        int              `json:"end"`
+	DocFreq    uint64           `json:"df"`
+	Candidates []SpellCandidate `json:"candidates,omitempty"`
+}
+
+type SpellCandidate struct {
+	Term     string `json:"term"`
+	DocFreq  uint64 `json:"df"`
+	Distance int    `json:"distance"`
+}
+
+// spell looks up correction candidates for every token of the query with a
+// fuzzy walk of the term dictionary. Short tokens get edit distance 1,
+// longer ones 2. The walk is the expensive part, so when the query already
+// matched plenty (suggest false) only the tokens' own document frequencies
+// are reported; the coordinator still needs them to weigh other shards'
+// candidates.
+func (s *Server) spell(q string, suggest bool) ([]SpellToken, error) {
+	m := s.index.Mapping()
+	analyzer := m.AnalyzerNamed(m.AnalyzerNameForPath(spellField))
+	if analyzer == nil {
+		return nil, nil
+	}
+
+	adv, err := s.index.Advanced()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := adv.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	fuzzy, ok := reader.(index.IndexReaderFuzzy)
+	if !ok {
+		return nil, nil
+	}
+
+	var out []SpellToken
+	for _, tok := range analyzer.Analyze([]byte(q)) {
+		term := string(tok.Term)
+		if utf8.RuneCountInString(term) < spellMinLength {
+			continue
+		}
+		fuzziness := 2
+		if utf8.RuneCountInString(term) <= 4 {
+			fuzziness = 1
+		}
+
+		st := SpellToken{Token: term, Start: tok.Start, End: tok.End}
+		if !suggest {
+			tfr, err := reader.TermFieldReader(context.Background(), tok.Term, spellField, false, false, false)
+			if err != nil {
+				return nil, err
+			}
+			st.DocFreq = tfr.Count()
+			tfr.Close()
+			out = append(out, st)
+			continue
+		}
+		dict, auto, err := fuzzy.FieldDictFuzzyAutomaton(spellField, term, fuzziness, "")
+		if err != nil {
+			return nil, err
+		}
+		for de, err := dict.Next(); err == nil && de != nil; de, err = dict.Next() {
+			if de.Term == term {
+				st.DocFreq = de.Count
+				continue
+			}
+			_, dist := auto.MatchAndDistance(de.Term)
+			st.Candidates = append(st.Candidates, SpellCandidate{Term: de.Term, DocFreq: de.Count, Distance: int(dist)})
+		}
+		dict.Close()
+
+		sort.Slice(st.Candidates, func(i, j int) bool {
+			a, b := st.Candidates[i], st.Candidates[j]
+			if a.DocFreq != b.DocFreq {
+				return a.DocFreq > b.DocFreq
+			}
+			return a.Term < b.Term
+		})
+		if len(st.Candidates) > spellCandidates {
+			st.Candidates = st.Candidates[:spellCandidates]
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
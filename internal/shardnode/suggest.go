@@ -0,0 +1,356 @@
+package shardnode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"turbo-query/internal/textnorm"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/vellum"
+)
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+	// docs read per page while building the FST
+	suggestPageSize = 1000
+)
+
+// Suggestion is a title completion. Key is the normalised title.
+// Popularity is the highest click prior among the docs with that title, 0
+// to 1. Mentions approximates how many docs refer to the title: the number
+// of texts containing its rarest term.
+type Suggestion struct {
+	Key        string  `json:"key"`
+	Title      string  `json:"title"`
+	Popularity float64 `json:"popularity"`
+	Mentions   uint64  `json:"mentions"`
+}
+
+// suggestEntry is a completion with the docs that carry its title, so
+// popularity can follow the priors as they are pushed.
+type suggestEntry struct {
+	Suggestion
+	docs []uint32
+}
+
+// suggester maps normalised titles to completions. The FST value is the
+// index into entries, which are in key order, so the completions of a
+// prefix are a contiguous run of entries.
+type suggester struct {
+	fst     *vellum.FST
+	entries []suggestEntry
+
+	mu     sync.Mutex
+	ranked atomic.Pointer[suggestRank]
+}
+
+// suggestRank is the popularity of every entry under one set of priors,
+// with a max segment tree over entry order so the best completions of any
+// prefix are found without scanning all its entries.
+type suggestRank struct {
+	priors *map[uint32]float64
+	pop    []float64
+	// best[len(pop)+i] is entry i; best[i] is the better of its children
+	best []uint32
+}
+
+// buildSuggester reads every title from the index and compiles the FST.
+// It runs in the background at startup; /suggest answers empty until done.
+func (s *Server) buildSuggester() {
+	start := time.Now()
+	byKey := make(map[string]*suggestEntry)
+
+	var after []string
+	for {
+		req := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), suggestPageSize, 0, false)
+		req.Fields = []string{"title"}
+		req.SortBy([]string{"_id"})
+		req.Score = "none"
+		if after != nil {
+			req.SetSearchAfter(after)
+		}
+		res, err := s.index.Search(req)
+		if err != nil {
+			log.Println("suggest: build failed:", err)
+			return
+		}
+		for _, hit := range res.Hits {
+			title, _ := hit.Fields["title"].(string)
+			key := textnorm.Title(title)
+			if key == "" {
+				continue
+			}
+			docID, err := strconv.ParseUint(hit.ID, 10, 32)
+			if err != nil {
+				continue
+			}
+			if e, ok := byKey[key]; ok {
+				e.docs = append(e.docs, uint32(docID))
+				continue
+			}
+			byKey[key] = &suggestEntry{Suggestion: Suggestion{Key: key, Title: title}, docs: []uint32{uint32(docID)}}
+		}
+		if len(res.Hits) < suggestPageSize {
+			break
+		}
+		after = []string{res.Hits[len(res.Hits)-1].ID}
+	}
+
+	mentions, done, err := s.mentionCounter()
+	if err != nil {
+		log.Println("suggest: build failed:", err)
+		return
+	}
+	entries := make([]suggestEntry, 0, len(byKey))
+	for _, e := range byKey {
+		e.Mentions = mentions(e.Title)
+		entries = append(entries, *e)
+	}
+	done()
+	sg, err := newSuggester(entries)
+	if err != nil {
+		log.Println("suggest: build failed:", err)
+		return
+	}
+	s.suggest.Store(sg)
+	log.Printf("suggest: %d titles indexed in %v", len(entries), time.Since(start))
+}
+
+// newSuggester compiles the FST over entries, sorting them by key first as
+// vellum requires.
+func newSuggester(entries []suggestEntry) (*suggester, error) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	var buf bytes.Buffer
+	b, err := vellum.New(&buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		if err := b.Insert([]byte(e.Key), uint64(i)); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.Close(); err != nil {
+		return nil, err
+	}
+	fst, err := vellum.Load(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &suggester{fst: fst, entries: entries}, nil
+}
+
+// mentionCounter returns a function counting the texts that contain a
+// title's rarest analysed term, with term lookups cached across titles,
+// and a function that releases the index reader it uses.
+func (s *Server) mentionCounter() (func(title string) uint64, func(), error) {
+	m := s.index.Mapping()
+	analyzer := m.AnalyzerNamed(m.AnalyzerNameForPath(spellField))
+	if analyzer == nil {
+		return func(string) uint64 { return 0 }, func() {}, nil
+	}
+	adv, err := s.index.Advanced()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := adv.Reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	cache := make(map[string]uint64)
+	return func(title string) uint64 {
+		var rarest uint64
+		found := false
+		for _, tok := range analyzer.Analyze([]byte(title)) {
+			term := string(tok.Term)
+			df, ok := cache[term]
+			if !ok {
+				if tfr, err := reader.TermFieldReader(context.Background(), tok.Term, spellField, false, false, false); err == nil {
+					df = tfr.Count()
+					tfr.Close()
+				}
+				cache[term] = df
+			}
+			if !found || df < rarest {
+				rarest, found = df, true
+			}
+		}
+		return rarest
+	}, func() { reader.Close() }, nil
+}
+
+// complete returns up to n completions of prefix ranked by popularity,
+// then mentions, then shortest title first. It takes the best entry of the
+// prefix's run from the segment tree, then the best of the runs either side
+// of it, and so on, so each completion costs O(log entries).
+func (s *Server) complete(sg *suggester, prefix string, n int) []Suggestion {
+	rank := sg.rank(s.priors.Load())
+	start := []byte(prefix)
+	lo, hi := sg.lowerBound(start), len(sg.entries)
+	if end := prefixEnd(start); end != nil {
+		hi = sg.lowerBound(end)
+	}
+
+	type run struct{ lo, hi, best int }
+	var runs []run
+	push := func(lo, hi int) {
+		if lo < hi {
+			runs = append(runs, run{lo, hi, rank.argmax(sg, lo, hi)})
+		}
+	}
+	push(lo, hi)
+	var out []Suggestion
+	for len(out) < n && len(runs) > 0 {
+		top := 0
+		for i := range runs {
+			if rank.better(sg, runs[i].best, runs[top].best) {
+				top = i
+			}
+		}
+		r := runs[top]
+		runs[top] = runs[len(runs)-1]
+		runs = runs[:len(runs)-1]
+
+		e := sg.entries[r.best].Suggestion
+		e.Popularity = rank.pop[r.best]
+		out = append(out, e)
+		push(r.lo, r.best)
+		push(r.best+1, r.hi)
+	}
+	return out
+}
+
+// lowerBound is the index of the first entry whose key is not below key.
+func (sg *suggester) lowerBound(key []byte) int {
+	it, err := sg.fst.Iterator(key, nil)
+	if err != nil {
+		return len(sg.entries)
+	}
+	_, v := it.Current()
+	return int(v)
+}
+
+// rank returns the ranking for priors, rebuilding it when the priors have
+// been replaced since the last call.
+func (sg *suggester) rank(priors *map[uint32]float64) *suggestRank {
+	if r := sg.ranked.Load(); r != nil && r.priors == priors {
+		return r
+	}
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	if r := sg.ranked.Load(); r != nil && r.priors == priors {
+		return r
+	}
+
+	n := len(sg.entries)
+	r := &suggestRank{priors: priors, pop: make([]float64, n), best: make([]uint32, 2*n)}
+	for i, e := range sg.entries {
+		if priors != nil {
+			for _, id := range e.docs {
+				r.pop[i] = max(r.pop[i], (*priors)[id])
+			}
+		}
+		r.best[n+i] = uint32(i)
+	}
+	for i := n - 1; i > 0; i-- {
+		r.best[i] = r.pick(sg, r.best[2*i], r.best[2*i+1])
+	}
+	sg.ranked.Store(r)
+	return r
+}
+
+// argmax is the best entry in [lo, hi).
+func (r *suggestRank) argmax(sg *suggester, lo, hi int) int {
+	n := len(r.pop)
+	best := uint32(lo)
+	for lo, hi = lo+n, hi+n; lo < hi; lo, hi = lo/2, hi/2 {
+		if lo&1 == 1 {
+			best = r.pick(sg, best, r.best[lo])
+			lo++
+		}
+		if hi&1 == 1 {
+			hi--
+			best = r.pick(sg, best, r.best[hi])
+		}
+	}
+	return int(best)
+}
+
+func (r *suggestRank) pick(sg *suggester, a, b uint32) uint32 {
+	if r.better(sg, int(b), int(a)) {
+		return b
+	}
+	return a
+}
+
+// better reports whether entry i ranks above entry j: more popular first,
+// then suggestionLess.
+func (r *suggestRank) better(sg *suggester, i, j int) bool {
+	if r.pop[i] != r.pop[j] {
+		return r.pop[i] > r.pop[j]
+	}
+	return suggestionLess(sg.entries[i].Suggestion, sg.entries[j].Suggestion)
+}
+
+// suggestionLess breaks popularity ties: more mentions, then the shorter
+// key, then key order.
+func suggestionLess(a, b Suggestion) bool {
+	if a.Mentions != b.Mentions {
+		return a.Mentions > b.Mentions
+	}
+	if len(a.Key) != len(b.Key) {
+		return len(a.Key) < len(b.Key)
+	}
+	return a.Key < b.Key
+}
+
+// prefixEnd is the smallest key greater than every key starting with p, or
+// nil if there is none.
+func prefixEnd(p []byte) []byte {
+	end := append([]byte(nil), p...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// normalizePrefix normalises a typed prefix like a title, keeping a
+// trailing space so "new " completes to "new york" but not "newark".
+func normalizePrefix(p string) string {
+	norm := textnorm.Title(p)
+	if norm != "" && strings.HasSuffix(p, " ") {
+		norm += " "
+	}
+	return norm
+}
+
+func (s *Server) handleSuggest(w http.ResponseWriter, r *http.Request) {
+	prefix := normalizePrefix(r.URL.Query().Get("prefix"))
+	n, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || n <= 0 {
+		n = defaultSuggestions
+	}
+	n = min(n, maxSuggestions)
+
+	out := []Suggestion{}
+	if sg := s.suggest.Load(); sg != nil && prefix != "" {
+		out = s.complete(sg, prefix, n)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]Suggestion{"suggestions": out})
+}
@@ -0,0 +1,89 @@
+package shardnode
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testSuggester(t *testing.T, keys []string) *suggester {
+	t.Helper()
+	entries := make([]suggestEntry, len(keys))
+	for i, k := range keys {
+		entries[i] = suggestEntry{Suggestion: Suggestion{Key: k, Title: k, Mentions: uint64(i % 7)}, docs: []uint32{uint32(i)}}
+	}
+	sg, err := newSuggester(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sg
+}
+
+func TestCompletePopularBeyondAlphabeticalOrder(t *testing.T) {
+	var keys []string
+	for i := range 6000 {
+		keys = append(keys, fmt.Sprintf("a%04d", i))
+	}
+	keys = append(keys, "azure", "b")
+	sg := testSuggester(t, keys)
+
+	s := &Server{}
+	priors := map[uint32]float64{6000: 0.8, 5999: 0.3, 6001: 1}
+	s.priors.Store(&priors)
+
+	got := s.complete(sg, "a", 2)
+	if len(got) != 2 || got[0].Key != "azure" || got[0].Popularity != 0.8 || got[1].Key != "a5999" {
+		t.Fatalf("complete(a) = %+v, want azure then a5999", got)
+	}
+
+	// new priors are picked up on the next call
+	next := map[uint32]float64{42: 0.5}
+	s.priors.Store(&next)
+	if got := s.complete(sg, "a", 1); len(got) != 1 || got[0].Key != "a0042" {
+		t.Fatalf("after new priors complete(a) = %+v, want a0042", got)
+	}
+}
+
+func TestCompleteMatchesFullSort(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var keys []string
+	for i := range 500 {
+		keys = append(keys, fmt.Sprintf("%c%c%d", 'a'+rng.Intn(3), 'a'+rng.Intn(3), i))
+	}
+	sort.Strings(keys)
+	sg := testSuggester(t, keys)
+
+	s := &Server{}
+	priors := make(map[uint32]float64)
+	for i := range keys {
+		if rng.Intn(3) == 0 {
+			priors[uint32(i)] = float64(rng.Intn(4)) / 4
+		}
+	}
+	s.priors.Store(&priors)
+
+	for _, prefix := range []string{"a", "ab", "c", "cc1", "d", "ba9"} {
+		var want []Suggestion
+		for i, e := range sg.entries {
+			if len(e.Key) >= len(prefix) && e.Key[:len(prefix)] == prefix {
+				sug := e.Suggestion
+				sug.Popularity = priors[uint32(i)]
+				want = append(want, sug)
+			}
+		}
+		sort.Slice(want, func(i, j int) bool {
+			if want[i].Popularity != want[j].Popularity {
+				return want[i].Popularity > want[j].Popularity
+			}
+			return suggestionLess(want[i], want[j])
+		})
+		if len(want) > 10 {
+			want = want[:10]
+		}
+		if got := s.complete(sg, prefix, 10); !reflect.DeepEqual(got, want) {
+			t.Errorf("complete(%q) =\n%+v\nwant\n%+v", prefix, got, want)
+		}
+	}
+}
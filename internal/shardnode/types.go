@@ -1,18 +1,142 @@
 package shardnode
 
+import (
+	"turbo-query/internal/dsl"
+	"turbo-query/internal/facets"
+	"turbo-query/internal/fusion"
+	"turbo-query/internal/sorting"
+
+	"github.com/blevesearch/bleve/v2/search"
+)
+
 type SearchRequest struct {
 	Query string `json:"query"`
-	TopK  int    `json:"top_k"`
-	Vector []float32 `json:"vector"`
+	// Expansions are synonym phrases matched as alternatives to Query
+	Expansions []string `json:"expansions,omitempty"`
+	// DSL, when set, replaces the match query on Query; Syntax
+	// "query_string" parses Query as Bleve query-string syntax
+	DSL    *dsl.Query `json:"dsl,omitempty"`
+	Syntax string     `json:"syntax,omitempty"`
+	TopK   int        `json:"top_k"`
+	Vector []float32  `json:"vector,omitempty"`
+	// QueryOnly skips stored fields; the coordinator fetches them later
+	// for the hits that survive the merge
+	QueryOnly bool `json:"query_only,omitempty"`
+	// Boosts spreads the plain match query over the named fields with
+	// these weights; ExactTitleBoost adds a clause for docs whose
+	// normalised title equals the query
+	Boosts          map[string]float64 `json:"boosts,omitempty"`
+	ExactTitleBoost float64            `json:"exact_title_boost,omitempty"`
+	// Navigational puts exact title matches ahead of everything else
+	Navigational bool `json:"navigational,omitempty"`
+	// Filters restrict candidates before BM25 and reranking; Facets are
+	// counted over every doc that matches
+	Filters []dsl.Filter              `json:"filters,omitempty"`
+	Facets  map[string]facets.Request `json:"facets,omitempty"`
+	// Mode "semantic" skips BM25 and returns the nearest vectors among
+	// the docs that pass Filters
+	Mode string `json:"mode,omitempty"`
+	// Sort orders hits by fields instead of the hybrid score
+	Sort []sorting.Field `json:"sort,omitempty"`
+	// Explain attaches a score breakdown to every hit
+	Explain bool `json:"explain,omitempty"`
+	// FallbackMinHits tops the results up from the vector store when
+	// fewer lexical hits than this match; 0 disables it
+	FallbackMinHits int `json:"fallback_min_hits,omitempty"`
+	// Spell asks for correction candidates for the query's tokens
+	Spell bool `json:"spell,omitempty"`
+	// Blocked lists global IDs that must never be returned
+	Blocked []string `json:"blocked,omitempty"`
+	// Vectors and Keys attach each hit's embedding and its global ID and
+	// title key, for diversification at merge time
+	Vectors bool `json:"vectors,omitempty"`
+	Keys    bool `json:"keys,omitempty"`
+	// Fusion sets how BM25 and cosine combine and how many BM25
+	// candidates are reranked; nil is linear 0.7/0.3 over 100
+	Fusion *fusion.Params `json:"fusion,omitempty"`
+	// Features attaches each hit's LTR feature vector, for logging
+	Features bool `json:"features,omitempty"`
 }
 
 type SearchHit struct {
 	DocID   string  `json:"doc_id"`
 	Score   float64 `json:"score"`
 	ShardID string  `json:"shard_id"`
-	Title   string  `json:"title"`
-	Text    string  `json:"text"`
+	Title   string  `json:"title,omitempty"`
+	Text    string  `json:"text,omitempty"`
+	// ExactTitle marks a doc whose normalised title equals the query
+	ExactTitle bool `json:"exact_title,omitempty"`
+	// Sort holds the hit's Bleve sort values, one per request sort field,
+	// for the coordinator to merge on
+	Sort    []string     `json:"sort,omitempty"`
+	Explain *Explanation `json:"explain,omitempty"`
+	// Fallback marks a nearest-neighbour hit added because too few docs
+	// matched lexically
+	Fallback bool `json:"fallback,omitempty"`
+	// Vector, WikiID and TitleKey are set when the request asks for them
+	Vector   []float32 `json:"vector,omitempty"`
+	WikiID   string    `json:"wiki_id,omitempty"`
+	TitleKey string    `json:"title_key,omitempty"`
+	// Features is the LTR feature vector, laid out as ltr.FeatureNames
+	Features []float64 `json:"features,omitempty"`
+}
+
+// Explanation breaks a hit's score into its parts. Ranks are 1-based:
+// BM25Rank is the position in the BM25 window (sort order when sorting),
+// VectorRank the position by cosine among the reranked candidates and
+// ShardRank the position in this shard's results.
+type Explanation struct {
+	BM25         float64 `json:"bm25"`
+	BM25Max      float64 `json:"bm25_max"`
+	BM25Norm     float64 `json:"bm25_norm"`
+	Cosine       float64 `json:"cosine"`
+	CosineNorm   float64 `json:"cosine_norm"`
+	WeightBM25   float64 `json:"weight_bm25"`
+	WeightVector float64 `json:"weight_vector"`
+	// Popularity is the doc's prior, added with WeightPopularity
+	Popularity       float64 `json:"popularity,omitempty"`
+	WeightPopularity float64 `json:"weight_popularity,omitempty"`
+	// Features are the LTR features, when computed
+	Features   map[string]float64  `json:"features,omitempty"`
+	Fusion     string              `json:"fusion,omitempty"`
+	BM25Rank   int                 `json:"bm25_rank,omitempty"`
+	VectorRank int                 `json:"vector_rank,omitempty"`
+	ShardRank  int                 `json:"shard_rank,omitempty"`
+	Tree       *search.Explanation `json:"tree,omitempty"`
 }
 type SearchResponse struct {
-	Hits []SearchHit `json:"hits"`
+	Hits     []SearchHit              `json:"hits"`
+	Facets   map[string]facets.Result `json:"facets,omitempty"`
+	Spelling []SpellToken             `json:"spelling,omitempty"`
+	TimedOut bool                     `json:"timed_out,omitempty"`
+	// Model is the version of the LTR model that scored the hits; empty
+	// when they kept their fused scores
+	Model string `json:"model,omitempty"`
+
+	// lexicalHits is how many docs matched the BM25 query on this shard
+	lexicalHits uint64
+}
+
+type FetchRequest struct {
+	DocIDs     []string `json:"doc_ids"`
+	Fields     []string `json:"fields"`
+	TextLength int      `json:"text_length,omitempty"`
+	// Query and Highlight ask for highlighted fragments of the query terms
+	Query     string            `json:"query,omitempty"`
+	DSL       *dsl.Query        `json:"dsl,omitempty"`
+	Syntax    string            `json:"syntax,omitempty"`
+	Highlight *HighlightRequest `json:"highlight,omitempty"`
+}
+
+type HighlightRequest struct {
+	Fields       []string `json:"fields"`
+	FragmentSize int      `json:"fragment_size"`
+	Fragments    int      `json:"fragments"`
+	PreTag       string   `json:"pre_tag"`
+	PostTag      string   `json:"post_tag"`
+}
+
+type FetchResponse struct {
+	Docs       map[string]map[string]interface{} `json:"docs"`
+	Highlights map[string]map[string][]string    `json:"highlights,omitempty"`
 }
@@ -0,0 +1,168 @@
+package shardnode
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"turbo-query/internal/dsl"
+
+	"github.com/RoaringBitmap/roaring/v2"
+	"github.com/blevesearch/bleve/v2"
+)
+
+const (
+	// how many vectors to score between deadline checks
+	scanCheckEvery = 1024
+	// filter bitmaps kept; the index is read-only, so they never go stale
+	maxFilterCache = 64
+)
+
+// filterCache holds the allowed-doc bitmap for recently used filter sets,
+// evicting the least recently used once it holds maxFilterCache.
+type filterCache struct {
+	mu      sync.Mutex
+	order   list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type filterEntry struct {
+	key string
+	bm  *roaring.Bitmap
+}
+
+func (c *filterCache) get(key string) (*roaring.Bitmap, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*filterEntry).bm, true
+}
+
+func (c *filterCache) put(key string, bm *roaring.Bitmap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*filterEntry).bm = bm
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	c.entries[key] = c.order.PushFront(&filterEntry{key: key, bm: bm})
+	if c.order.Len() > maxFilterCache {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*filterEntry).key)
+	}
+}
+
+// allowedDocs returns the local IDs of docs matching every filter, or nil
+// when there are no filters and every doc is allowed.
+func (s *Server) allowedDocs(ctx context.Context, filters []dsl.Filter) (*roaring.Bitmap, error) {
+	q, err := dsl.Filters(filters)
+	if err != nil || q == nil {
+		return nil, err
+	}
+	key, _ := json.Marshal(filters)
+
+	if bm, ok := s.filters.get(string(key)); ok {
+		return bm, nil
+	}
+
+	searchReq := bleve.NewSearchRequestOptions(q, int(s.numDocs), 0, false)
+	searchReq.Score = "none"
+	res, err := s.index.SearchInContext(ctx, searchReq)
+	if err != nil {
+		return nil, err
+	}
+	bm := roaring.New()
+	for _, hit := range res.Hits {
+		if id, err := strconv.ParseUint(hit.ID, 10, 32); err == nil {
+			bm.Add(uint32(id))
+		}
+	}
+	bm.RunOptimize()
+
+	s.filters.put(string(key), bm)
+	return bm, nil
+}
+
+type scoredDoc struct {
+	id  uint32
+	cos float64
+}
+
+// docHeap is a min-heap on cosine, so the root is the worst of the top k.
+type docHeap []scoredDoc
+
+func (h docHeap) Len() int            { return len(h) }
+func (h docHeap) Less(i, j int) bool  { return h[i].cos < h[j].cos }
+func (h docHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *docHeap) Push(x interface{}) { *h = append(*h, x.(scoredDoc)) }
+func (h *docHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// vectorSearch scans the shard's vectors for the k nearest to qvec. With a
+// bitmap only those docs are scored, so a filtered query still yields k
+// matching docs when that many exist; blocked docs are skipped the same
+// way. The result is best first; timedOut means the scan stopped early at
+// the deadline.
+func (s *Server) vectorSearch(ctx context.Context, qvec []float32, k int, allowed, blocked *roaring.Bitmap) (top []scoredDoc, timedOut bool) {
+	h := make(docHeap, 0, k)
+	consider := func(id uint32) {
+		if blocked != nil && blocked.Contains(id) {
+			return
+		}
+		dvec := s.getVector(id)
+		if len(dvec) == 0 {
+			return
+		}
+		cos := dot(qvec, dvec)
+		if len(h) < k {
+			heap.Push(&h, scoredDoc{id: id, cos: cos})
+		} else if cos > h[0].cos {
+			h[0] = scoredDoc{id: id, cos: cos}
+			heap.Fix(&h, 0)
+		}
+	}
+
+	n := 0
+	if allowed != nil {
+		it := allowed.Iterator()
+		for it.HasNext() {
+			if n%scanCheckEvery == 0 && ctx.Err() != nil {
+				timedOut = true
+				break
+			}
+			n++
+			consider(it.Next())
+		}
+	} else {
+		for id := uint32(0); id < uint32(s.numDocs); id++ {
+			if n%scanCheckEvery == 0 && ctx.Err() != nil {
+				timedOut = true
+				break
+			}
+			n++
+			consider(id)
+		}
+	}
+
+	top = make([]scoredDoc, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(&h).(scoredDoc)
+	}
+	return top, timedOut
+}
@@ -0,0 +1,47 @@
+package shardnode
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/v2"
+)
+
+func TestFilterCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var c filterCache
+	for i := range maxFilterCache {
+		c.put(strconv.Itoa(i), roaring.BitmapOf(uint32(i)))
+	}
+	// a busy filter stays while others come and go
+	for i := maxFilterCache; i < 3*maxFilterCache; i++ {
+		if _, ok := c.get("0"); !ok {
+			t.Fatalf("busy entry evicted after %d puts", i)
+		}
+		c.put(strconv.Itoa(i), roaring.BitmapOf(uint32(i)))
+	}
+	if _, ok := c.get("1"); ok {
+		t.Error("least recently used entry kept")
+	}
+	if bm, ok := c.get(strconv.Itoa(3*maxFilterCache - 1)); !ok || !bm.Contains(3*maxFilterCache-1) {
+		t.Error("newest entry missing")
+	}
+	if c.order.Len() != maxFilterCache || len(c.entries) != maxFilterCache {
+		t.Errorf("cache holds %d/%d entries, want %d", c.order.Len(), len(c.entries), maxFilterCache)
+	}
+}
+
+func TestBlockedDocsEmptyIsNil(t *testing.T) {
+	s := &Server{}
+	// as cached by an earlier call that found none of the IDs here
+	s.filters.put(`blocked:["42"]`, roaring.New())
+	bm, err := s.blockedDocs(context.Background(), []string{"42"})
+	if err != nil || bm != nil {
+		t.Fatalf("blockedDocs = %v, %v; want nil", bm, err)
+	}
+
+	s.filters.put(`blocked:["7"]`, roaring.BitmapOf(3))
+	if bm, err := s.blockedDocs(context.Background(), []string{"7"}); err != nil || bm == nil || !bm.Contains(3) {
+		t.Fatalf("blockedDocs = %v, %v; want {3}", bm, err)
+	}
+}
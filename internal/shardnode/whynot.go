@@ -0,0 +1,191 @@
+package shardnode
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"turbo-query/internal/deadline"
+	"turbo-query/internal/dsl"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// Stages a document can drop out at on a shard, in pipeline order.
+const (
+	stageNotFound    = "not_found"
+	stageBlocked     = "blocked"
+	stageFilteredOut = "filtered_out"
+	stageNoMatch     = "no_match"
+	stageNotInWindow = "not_in_bm25_window"
+	stageRerankedOut = "reranked_out"
+	stageNotInVector = "not_in_vector_top_k"
+	stageTimedOut    = "timed_out"
+	stageInShardTopK = "in_shard_top_k"
+)
+
+// WhyNotRequest is a search plus the global ID of the doc to trace.
+type WhyNotRequest struct {
+	SearchRequest
+	WikiID string `json:"wiki_id"`
+}
+
+// WhyNotResponse says how far the doc got on this shard. Cutoff is the
+// score of the shard's last returned hit.
+type WhyNotResponse struct {
+	DocID   string       `json:"doc_id,omitempty"`
+	Stage   string       `json:"stage"`
+	Cutoff  float64      `json:"cutoff,omitempty"`
+	Explain *Explanation `json:"explain,omitempty"`
+}
+
+func (s *Server) handleWhyNot(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := deadline.FromRequest(r)
+	defer cancel()
+
+	var req WhyNotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.WikiID == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	resp, status, err := s.whyNot(ctx, req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// whyNot replays the search and reports the first stage the doc failed,
+// with its score breakdown wherever one can be computed.
+func (s *Server) whyNot(ctx context.Context, req WhyNotRequest) (WhyNotResponse, int, error) {
+	localID, err := s.localID(ctx, req.WikiID)
+	if err != nil {
+		return WhyNotResponse{}, http.StatusInternalServerError, err
+	}
+	if localID == "" {
+		return WhyNotResponse{Stage: stageNotFound}, 0, nil
+	}
+	resp := WhyNotResponse{DocID: localID}
+
+	blocked, err := s.blockedDocs(ctx, req.Blocked)
+	if err != nil {
+		return resp, http.StatusInternalServerError, err
+	}
+	if id, _ := strconv.ParseUint(localID, 10, 32); blocked != nil && blocked.Contains(uint32(id)) {
+		resp.Stage = stageBlocked
+		return resp, 0, nil
+	}
+
+	if f, err := dsl.Filters(req.Filters); err != nil {
+		return resp, http.StatusBadRequest, err
+	} else if f != nil {
+		ok, err := s.matches(ctx, f, localID)
+		if err != nil {
+			return resp, http.StatusInternalServerError, err
+		}
+		if !ok {
+			resp.Stage = stageFilteredOut
+			return resp, 0, nil
+		}
+	}
+
+	sreq := req.SearchRequest
+	sreq.Explain = true
+	sreq.QueryOnly = true
+	sreq.Facets = nil
+	sr, status, err := s.search(ctx, sreq)
+	if err != nil {
+		return resp, status, err
+	}
+	for _, h := range sr.Hits {
+		if h.DocID == localID {
+			resp.Stage = stageInShardTopK
+			resp.Explain = h.Explain
+			return resp, 0, nil
+		}
+	}
+	if sr.TimedOut {
+		resp.Stage = stageTimedOut
+		return resp, 0, nil
+	}
+	if n := len(sr.Hits); n > 0 {
+		resp.Cutoff = sr.Hits[n-1].Score
+	}
+
+	id64, _ := strconv.ParseUint(localID, 10, 32)
+	cos := dot(sreq.Vector, s.getVector(uint32(id64)))
+	if sreq.Mode == modeSemantic {
+		resp.Stage = stageNotInVector
+		resp.Explain = &Explanation{Cosine: cos, CosineNorm: (cos + 1) / 2, WeightVector: 1}
+		return resp, 0, nil
+	}
+
+	bq, err := buildQuery(sreq, blocked)
+	if err != nil {
+		return resp, http.StatusBadRequest, err
+	}
+	res, err := s.window(ctx, sreq, bq)
+	if err != nil {
+		return resp, http.StatusInternalServerError, err
+	}
+	fp := sreq.Fusion.Resolved()
+	exp := &Explanation{
+		BM25Max:          bm25Max(res),
+		Cosine:           cos,
+		CosineNorm:       (cos + 1) / 2,
+		WeightBM25:       *fp.WeightBM25,
+		WeightVector:     *fp.WeightVector,
+		Fusion:           fp.Method,
+		Popularity:       s.prior(uint32(id64)),
+		WeightPopularity: *fp.WeightPopularity,
+	}
+	resp.Explain = exp
+	for i, hit := range res.Hits {
+		if hit.ID == localID {
+			exp.BM25Rank = i + 1
+			exp.BM25 = hit.Score
+			exp.Tree = hit.Expl
+			break
+		}
+	}
+
+	if exp.BM25Rank == 0 {
+		// score the doc on its own to show how far below the window it is
+		b := bleve.NewBooleanQuery()
+		b.AddMust(bq)
+		b.AddFilter(bleve.NewDocIDQuery([]string{localID}))
+		one := bleve.NewSearchRequestOptions(b, 1, 0, true)
+		r, err := s.index.SearchInContext(ctx, one)
+		if err != nil {
+			return resp, http.StatusInternalServerError, err
+		}
+		if len(r.Hits) == 0 {
+			resp.Stage = stageNoMatch
+			return resp, 0, nil
+		}
+		exp.BM25 = r.Hits[0].Score
+		exp.Tree = r.Hits[0].Expl
+		resp.Stage = stageNotInWindow
+	} else {
+		resp.Stage = stageRerankedOut
+	}
+	exp.BM25Norm = exp.BM25 / exp.BM25Max
+	return resp, 0, nil
+}
+
+// matches reports whether the doc satisfies q.
+func (s *Server) matches(ctx context.Context, q query.Query, localID string) (bool, error) {
+	b := bleve.NewBooleanQuery()
+	b.AddMust(bleve.NewDocIDQuery([]string{localID}))
+	b.AddFilter(q)
+	res, err := s.index.SearchInContext(ctx, bleve.NewSearchRequestOptions(b, 1, 0, false))
+	if err != nil {
+		return false, err
+	}
+	return len(res.Hits) > 0, nil
+}
@@ -0,0 +1,61 @@
+package shardnode
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"turbo-query/internal/wire"
+)
+
+var emptyHitExt, _ = json.Marshal(SearchHit{})
+
+func readBinaryRequest(body io.Reader, req *SearchRequest) error {
+	header, vec, err := wire.ReadRequest(body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(header, req); err != nil {
+		return err
+	}
+	req.Vector = vec
+	return nil
+}
+
+// writeBinaryResponse streams hits as wire frames. Hit fields without a
+// binary slot go in Ext as JSON, and only when any are set. Vectors, which
+// hits carry only for diversification, go in the frame's vector slot.
+func writeBinaryResponse(w http.ResponseWriter, resp SearchResponse) {
+	w.Header().Set("Content-Type", wire.ContentType)
+	rc := http.NewResponseController(w)
+	ww := wire.NewWriter(w, func() { rc.Flush() })
+
+	for _, h := range resp.Hits {
+		if err := ww.WriteHit(wire.Hit{
+			DocID:   h.DocID,
+			ShardID: h.ShardID,
+			Score:   h.Score,
+			Title:   h.Title,
+			Text:    h.Text,
+			Ext:     hitExt(h),
+			Vector:  h.Vector,
+		}); err != nil {
+			return
+		}
+	}
+
+	resp.Hits = nil
+	trailer, _ := json.Marshal(resp)
+	ww.WriteTrailer(trailer)
+}
+
+func hitExt(h SearchHit) []byte {
+	h.DocID, h.ShardID, h.Title, h.Text, h.Score = "", "", "", "", 0
+	h.Vector = nil
+	ext, err := json.Marshal(h)
+	if err != nil || bytes.Equal(ext, emptyHitExt) {
+		return nil
+	}
+	return ext
+}
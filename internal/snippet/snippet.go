@@ -0,0 +1,81 @@
+// Package snippet cuts article text into display-sized pieces.
+package snippet
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Truncate cuts s to at most n characters, backing up to the last word
+// boundary when there is one nearby.
+func Truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	cut := 0
+	for i := range s {
+		if n == 0 {
+			cut = i
+			break
+		}
+		n--
+	}
+	out := s[:cut]
+	if sp := strings.LastIndexByte(out, ' '); sp > len(out)*4/5 {
+		out = out[:sp]
+	}
+	return out + "…"
+}
+
+// Passages splits text into sentences and packs consecutive sentences into
+// passages of roughly size characters.
+func Passages(text string, size int) []string {
+	var out []string
+	var cur strings.Builder
+	flush := func() {
+		if p := strings.TrimSpace(cur.String()); p != "" {
+			out = append(out, p)
+		}
+		cur.Reset()
+	}
+
+	for _, sent := range sentences(text) {
+		if cur.Len() > 0 && cur.Len()+len(sent) > size {
+			flush()
+		}
+		cur.WriteString(sent)
+		if cur.Len() >= size {
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+// sentences splits on sentence-ending punctuation followed by whitespace,
+// and on newlines. Each sentence keeps its trailing space.
+func sentences(text string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		end := false
+		switch c {
+		case '\n':
+			end = true
+		case '.', '!', '?':
+			end = i+1 < len(text) && (text[i+1] == ' ' || text[i+1] == '\n')
+			if end {
+				i++
+			}
+		}
+		if end {
+			out = append(out, text[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(text) {
+		out = append(out, text[start:])
+	}
+	return out
+}
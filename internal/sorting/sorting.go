@@ -0,0 +1,132 @@
+// Package sorting orders hits by stored fields and relevance, and breaks
+// ties deterministically so repeated queries and pages are stable.
+package sorting
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+// Score is the sort field that stands for the hybrid relevance score.
+const Score = "_score"
+
+const maxFields = 5
+
+// Field is one sort key. Order is "asc" or "desc"; Missing is "first" or
+// "last" (the default) and places docs without a value for the field.
+type Field struct {
+	Field   string `json:"field"`
+	Order   string `json:"order,omitempty"`
+	Missing string `json:"missing,omitempty"`
+}
+
+func (f Field) desc() bool { return f.Order == "desc" }
+
+// Validate fills in defaults and checks a sort spec.
+func Validate(spec []Field) error {
+	if len(spec) > maxFields {
+		return errors.New("sorting: too many sort fields")
+	}
+	for i := range spec {
+		f := &spec[i]
+		if f.Field == "" {
+			return errors.New("sorting: sort needs a field")
+		}
+		if f.Order == "" {
+			f.Order = "asc"
+			if f.Field == Score {
+				f.Order = "desc"
+			}
+		}
+		if f.Order != "asc" && f.Order != "desc" {
+			return fmt.Errorf("sorting: bad order %q", f.Order)
+		}
+		if f.Missing == "" {
+			f.Missing = "last"
+		}
+		if f.Missing != "first" && f.Missing != "last" {
+			return fmt.Errorf("sorting: bad missing %q", f.Missing)
+		}
+	}
+	return nil
+}
+
+// Bleve is the Bleve sort order selecting candidates for spec. Relevance
+// is approximated by the BM25 score; the doc ID makes it total.
+func Bleve(spec []Field) search.SortOrder {
+	order := make(search.SortOrder, 0, len(spec)+1)
+	for _, f := range spec {
+		if f.Field == Score {
+			order = append(order, &search.SortScore{Desc: f.desc()})
+			continue
+		}
+		sf := &search.SortField{Field: f.Field, Desc: f.desc()}
+		if f.Missing == "first" {
+			sf.Missing = search.SortFieldMissingFirst
+		}
+		order = append(order, sf)
+	}
+	return append(order, &search.SortDocID{})
+}
+
+// Compare orders two hits by spec. keys hold each hit's Bleve sort values,
+// one per entry of spec (the entries for Score are ignored); scores are
+// the hybrid scores. It returns <0 if a comes first, >0 if b does, and 0
+// on a tie.
+func Compare(spec []Field, ka, kb []string, sa, sb float64) int {
+	for i, f := range spec {
+		c := 0
+		if f.Field == Score {
+			switch {
+			case sa < sb:
+				c = -1
+			case sa > sb:
+				c = 1
+			}
+		} else if i < len(ka) && i < len(kb) {
+			switch {
+			case ka[i] < kb[i]:
+				c = -1
+			case ka[i] > kb[i]:
+				c = 1
+			}
+		}
+		if f.desc() {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// TieBreak orders hits that compare equal by shard ID, then doc ID. IDs
+// are compared numerically when they are decimal numbers.
+func TieBreak(shardA, docA, shardB, docB string) bool {
+	if shardA != shardB {
+		return idLess(shardA, shardB)
+	}
+	return idLess(docA, docB)
+}
+
+func idLess(a, b string) bool {
+	if len(a) != len(b) && numeric(a) && numeric(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func numeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package sorting
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2/search"
+)
+
+func TestValidate(t *testing.T) {
+	spec := []Field{{Field: "year"}, {Field: Score}, {Field: "views", Order: "asc", Missing: "first"}}
+	if err := Validate(spec); err != nil {
+		t.Fatal(err)
+	}
+	want := []Field{
+		{Field: "year", Order: "asc", Missing: "last"},
+		{Field: Score, Order: "desc", Missing: "last"},
+		{Field: "views", Order: "asc", Missing: "first"},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("Validate filled %+v, want %+v", spec, want)
+	}
+
+	for _, tc := range []struct {
+		spec    []Field
+		wantErr string
+	}{
+		{[]Field{{}}, "sort needs a field"},
+		{[]Field{{Field: "year", Order: "up"}}, `bad order "up"`},
+		{[]Field{{Field: "year", Missing: "middle"}}, `bad missing "middle"`},
+		{make([]Field, maxFields+1), "too many sort fields"},
+	} {
+		if err := Validate(tc.spec); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("Validate(%+v) error %v, want %q", tc.spec, err, tc.wantErr)
+		}
+	}
+}
+
+// Shards send Bleve's sort values, where a missing value is a sentinel
+// chosen by the field's order and missing setting.
+func missing(f Field) string {
+	if (f.Missing == "last") != f.desc() {
+		return search.HighTerm
+	}
+	return search.LowTerm
+}
+
+func TestCompare(t *testing.T) {
+	asc := Field{Field: "year", Order: "asc", Missing: "last"}
+	desc := Field{Field: "year", Order: "desc", Missing: "last"}
+	ascFirst := Field{Field: "year", Order: "asc", Missing: "first"}
+	descFirst := Field{Field: "year", Order: "desc", Missing: "first"}
+	score := Field{Field: Score, Order: "desc"}
+	for _, tc := range []struct {
+		name   string
+		spec   []Field
+		ka, kb []string
+		sa, sb float64
+		want   int
+	}{
+		{"asc", []Field{asc}, []string{"1990"}, []string{"2000"}, 0, 0, -1},
+		{"desc", []Field{desc}, []string{"1990"}, []string{"2000"}, 0, 0, 1},
+		{"equal", []Field{asc}, []string{"1990"}, []string{"1990"}, 0, 0, 0},
+		{"asc missing last", []Field{asc}, []string{missing(asc)}, []string{"2000"}, 0, 0, 1},
+		{"desc missing last", []Field{desc}, []string{missing(desc)}, []string{"1990"}, 0, 0, 1},
+		{"asc missing first", []Field{ascFirst}, []string{missing(ascFirst)}, []string{"1990"}, 0, 0, -1},
+		{"desc missing first", []Field{descFirst}, []string{missing(descFirst)}, []string{"2000"}, 0, 0, -1},
+		{"both missing", []Field{desc}, []string{missing(desc)}, []string{missing(desc)}, 0, 0, 0},
+		{"score desc", []Field{score}, []string{"x"}, []string{"y"}, 0.9, 0.5, -1},
+		{"score asc", []Field{{Field: Score, Order: "asc"}}, nil, nil, 0.9, 0.5, 1},
+		{"next key breaks a tie", []Field{asc, score}, []string{"1990", ""}, []string{"1990", ""}, 0.1, 0.2, 1},
+		{"first key decides", []Field{asc, score}, []string{"1980", ""}, []string{"1990", ""}, 0.1, 0.2, -1},
+		{"no keys sent", []Field{asc}, nil, []string{"1990"}, 0, 0, 0},
+	} {
+		if got := Compare(tc.spec, tc.ka, tc.kb, tc.sa, tc.sb); got != tc.want {
+			t.Errorf("%s: Compare = %d, want %d", tc.name, got, tc.want)
+		}
+		if got := Compare(tc.spec, tc.kb, tc.ka, tc.sb, tc.sa); got != -tc.want {
+			t.Errorf("%s: swapped Compare = %d, want %d", tc.name, got, -tc.want)
+		}
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+	for _, tc := range []struct {
+		shardA, docA, shardB, docB string
+		want                       bool
+	}{
+		{"0", "9", "1", "1", true},     // shard first
+		{"2", "1", "10", "1", true},    // numeric shard IDs
+		{"1", "9", "1", "10", true},    // numeric doc IDs
+		{"1", "10", "1", "9", false},   // and not by string order
+		{"1", "7", "1", "7", false},    // the same hit
+		{"a", "1", "b", "1", true},     // names compare as strings
+		{"1", "b9", "1", "b10", false}, // so do doc IDs that aren't numbers
+	} {
+		if got := TieBreak(tc.shardA, tc.docA, tc.shardB, tc.docB); got != tc.want {
+			t.Errorf("TieBreak(%s/%s, %s/%s) = %v, want %v", tc.shardA, tc.docA, tc.shardB, tc.docB, got, tc.want)
+		}
+	}
+}
+
+func TestOrderIsDeterministic(t *testing.T) {
+	type hit struct {
+		shard, doc string
+		key        string
+		score      float64
+	}
+	spec := []Field{{Field: "year", Order: "desc", Missing: "last"}}
+	want := []hit{
+		{"0", "4", "2000", 1},
+		{"1", "2", "2000", 1},
+		{"1", "10", "2000", 1},
+		{"0", "3", "1990", 5},
+		{"0", "1", missing(spec[0]), 9},
+		{"2", "1", missing(spec[0]), 9},
+	}
+	// every rotation of the input sorts to the same order
+	for r := range want {
+		hits := append(append([]hit(nil), want[r:]...), want[:r]...)
+		sort.Slice(hits, func(i, j int) bool {
+			a, b := hits[i], hits[j]
+			if c := Compare(spec, []string{a.key}, []string{b.key}, a.score, b.score); c != 0 {
+				return c < 0
+			}
+			return TieBreak(a.shard, a.doc, b.shard, b.doc)
+		})
+		if !reflect.DeepEqual(hits, want) {
+			t.Fatalf("rotation %d sorted to %v, want %v", r, hits, want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Package textnorm normalises text the same way at index and query time.
+package textnorm
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Title lowercases s, turns punctuation into spaces and collapses runs of
+// whitespace, so "Byzantine  Empire!" and "byzantine empire" compare equal.
+func Title(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	space := true
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+			space = false
+			continue
+		}
+		if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// TitleKey is Title with a trailing parenthetical qualifier dropped, so
+// "Mercury (planet)" and "Mercury (mythology)" share the key "mercury".
+func TitleKey(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, ")") {
+		if i := strings.LastIndex(s, " ("); i > 0 {
+			s = s[:i]
+		}
+	}
+	return Title(s)
+}
@@ -0,0 +1,256 @@
+// Package wire is the compact binary coordinator↔shard search protocol.
+//
+// A request body is the magic "TQB1", a length-prefixed JSON header carrying
+// every request option except the query vector, and then the vector itself
+// as a length-prefixed run of little-endian float32s.
+//
+// A response is a stream of frames, each a kind byte and a uint32 payload
+// length. Hit frames hold the score and the hit's string fields in binary;
+// fields that have no binary slot travel as JSON in the hit's Ext bytes. A
+// hit frame may end with the hit's embedding as a length-prefixed run of
+// float32s; it is left off when the hit carries none, and readers that
+// predate it ignore it. The stream ends with a single trailer frame whose payload is JSON metadata
+// about the whole response.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ContentType marks a binary request or response body.
+const ContentType = "application/x-turbo-query"
+
+// ProtocolsHeader is set on a shard's /health response to list the search
+// encodings it accepts, e.g. "json,binary". Shards that predate the binary
+// protocol don't set it, and the coordinator keeps using JSON for them.
+const ProtocolsHeader = "X-Shard-Protocols"
+
+const (
+	magic = "TQB1"
+
+	frameHit     byte = 1
+	frameTrailer byte = 2
+
+	// maxFrame guards against a corrupt length allocating unbounded memory.
+	maxFrame = 64 << 20
+)
+
+var ErrBadMagic = errors.New("wire: bad magic")
+
+type Hit struct {
+	DocID   string
+	ShardID string
+	Score   float64
+	Title   string
+	Text    string
+	Ext     []byte
+	// Vector is the hit's embedding, sent only when the coordinator asked
+	// for vectors
+	Vector []float32
+}
+
+func WriteRequest(w io.Writer, header []byte, vec []float32) error {
+	buf := make([]byte, 0, len(magic)+8+len(header)+4*len(vec))
+	buf = append(buf, magic...)
+	buf = appendBytes(buf, header)
+	buf = appendVector(buf, vec)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadRequest(r io.Reader) (header []byte, vec []float32, err error) {
+	br := bufio.NewReader(r)
+
+	var m [len(magic)]byte
+	if _, err := io.ReadFull(br, m[:]); err != nil {
+		return nil, nil, err
+	}
+	if string(m[:]) != magic {
+		return nil, nil, ErrBadMagic
+	}
+	if header, err = readBytes(br); err != nil {
+		return nil, nil, err
+	}
+
+	dim, err := readUint32(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if dim > maxFrame/4 {
+		return nil, nil, fmt.Errorf("wire: vector of %d dims", dim)
+	}
+	raw := make([]byte, 4*int(dim))
+	if _, err := io.ReadFull(br, raw); err != nil {
+		return nil, nil, err
+	}
+	vec = make([]float32, dim)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:]))
+	}
+	return header, vec, nil
+}
+
+// Writer writes response frames, calling flush after each so the receiver
+// can decode hits while later ones are still being written.
+type Writer struct {
+	w     io.Writer
+	flush func()
+	buf   []byte
+}
+
+func NewWriter(w io.Writer, flush func()) *Writer {
+	return &Writer{w: w, flush: flush}
+}
+
+func (w *Writer) WriteHit(h Hit) error {
+	p := binary.LittleEndian.AppendUint64(w.buf[:0], math.Float64bits(h.Score))
+	p = appendBytes(p, []byte(h.DocID))
+	p = appendBytes(p, []byte(h.ShardID))
+	p = appendBytes(p, []byte(h.Title))
+	p = appendBytes(p, []byte(h.Text))
+	p = appendBytes(p, h.Ext)
+	if len(h.Vector) > 0 {
+		p = appendVector(p, h.Vector)
+	}
+	w.buf = p
+	return w.writeFrame(frameHit, p)
+}
+
+func (w *Writer) WriteTrailer(meta []byte) error {
+	return w.writeFrame(frameTrailer, meta)
+}
+
+func (w *Writer) writeFrame(kind byte, payload []byte) error {
+	var head [5]byte
+	head[0] = kind
+	binary.LittleEndian.PutUint32(head[1:], uint32(len(payload)))
+	if _, err := w.w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		return err
+	}
+	if w.flush != nil {
+		w.flush()
+	}
+	return nil
+}
+
+// ReadResponse decodes a frame stream, calling onHit for each hit as it
+// arrives, and returns the trailer payload.
+func ReadResponse(r io.Reader, onHit func(Hit) error) ([]byte, error) {
+	br := bufio.NewReader(r)
+	for {
+		kind, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		payload, err := readBytes(br)
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case frameTrailer:
+			return payload, nil
+		case frameHit:
+			h, err := decodeHit(payload)
+			if err != nil {
+				return nil, err
+			}
+			if err := onHit(h); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("wire: unknown frame kind %d", kind)
+		}
+	}
+}
+
+func decodeHit(p []byte) (Hit, error) {
+	var h Hit
+	if len(p) < 8 {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.Score = math.Float64frombits(binary.LittleEndian.Uint64(p))
+	p = p[8:]
+
+	var fields [5][]byte
+	for i := range fields {
+		if len(p) < 4 {
+			return h, io.ErrUnexpectedEOF
+		}
+		n := binary.LittleEndian.Uint32(p)
+		p = p[4:]
+		if uint32(len(p)) < n {
+			return h, io.ErrUnexpectedEOF
+		}
+		fields[i], p = p[:n], p[n:]
+	}
+	h.DocID = string(fields[0])
+	h.ShardID = string(fields[1])
+	h.Title = string(fields[2])
+	h.Text = string(fields[3])
+	if len(fields[4]) > 0 {
+		h.Ext = append([]byte(nil), fields[4]...)
+	}
+
+	if len(p) == 0 {
+		return h, nil
+	}
+	if len(p) < 4 {
+		return h, io.ErrUnexpectedEOF
+	}
+	dim := binary.LittleEndian.Uint32(p)
+	p = p[4:]
+	if uint64(len(p)) < 4*uint64(dim) {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.Vector = make([]float32, dim)
+	for i := range h.Vector {
+		h.Vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(p[4*i:]))
+	}
+	return h, nil
+}
+
+func appendVector(buf []byte, vec []float32) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(vec)))
+	for _, f := range vec {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(f))
+	}
+	return buf
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrame {
+		return nil, fmt.Errorf("wire: frame of %d bytes", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
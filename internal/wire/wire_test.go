@@ -0,0 +1,179 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		vec    []float32
+	}{
+		{"empty", []byte{}, []float32{}},
+		{"header only", []byte(`{"query":"go"}`), []float32{}},
+		{"vector", []byte(`{}`), []float32{0, 1, -1.5, 3.25e-7}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteRequest(&buf, tc.header, tc.vec); err != nil {
+				t.Fatal(err)
+			}
+			header, vec, err := ReadRequest(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(header, tc.header) || !reflect.DeepEqual(vec, tc.vec) {
+				t.Fatalf("got %q %v, want %q %v", header, vec, tc.header, tc.vec)
+			}
+		})
+	}
+}
+
+func TestReadRequestRejectsBadInput(t *testing.T) {
+	var good bytes.Buffer
+	WriteRequest(&good, []byte(`{"query":"go"}`), []float32{1, 2})
+	full := good.Bytes()
+
+	for n := 0; n < len(full); n++ {
+		if _, _, err := ReadRequest(bytes.NewReader(full[:n])); err == nil {
+			t.Errorf("truncated to %d of %d bytes: no error", n, len(full))
+		}
+	}
+
+	bad := append([]byte("TQB0"), full[4:]...)
+	if _, _, err := ReadRequest(bytes.NewReader(bad)); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("bad magic: got %v", err)
+	}
+
+	huge := append([]byte(magic), 0xff, 0xff, 0xff, 0xff)
+	if _, _, err := ReadRequest(bytes.NewReader(huge)); err == nil {
+		t.Error("oversized header length: no error")
+	}
+}
+
+func encodeResponse(t *testing.T, hits []Hit, trailer []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	flushes := 0
+	w := NewWriter(&buf, func() { flushes++ })
+	for _, h := range hits {
+		if err := w.WriteHit(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTrailer(trailer); err != nil {
+		t.Fatal(err)
+	}
+	if flushes != len(hits)+1 {
+		t.Fatalf("%d flushes for %d frames", flushes, len(hits)+1)
+	}
+	return buf.Bytes()
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	hits := []Hit{
+		{DocID: "12", ShardID: "0", Score: 0.75, Title: "Go", Text: "A language", Ext: []byte(`{"fields":{"year":2009}}`)},
+		{DocID: "7", ShardID: "3", Score: -1},
+		{DocID: "héllo", ShardID: "1", Score: 1e-300, Title: "ünïcode"},
+		{DocID: "9", ShardID: "2", Score: 0.5, Vector: []float32{0.25, -1, 3e-7}},
+	}
+	trailer := []byte(`{"total_hits":4}`)
+	data := encodeResponse(t, hits, trailer)
+
+	var got []Hit
+	meta, err := ReadResponse(bytes.NewReader(data), func(h Hit) error {
+		got = append(got, h)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(meta, trailer) {
+		t.Fatalf("trailer %q, want %q", meta, trailer)
+	}
+	if !reflect.DeepEqual(got, hits) {
+		t.Fatalf("hits\n%+v\nwant\n%+v", got, hits)
+	}
+}
+
+func TestHitVectorIsCompact(t *testing.T) {
+	vec := make([]float32, 384)
+	for i := range vec {
+		vec[i] = float32(i) / 3
+	}
+	plain := encodeResponse(t, []Hit{{DocID: "1", ShardID: "0"}}, nil)
+	with := encodeResponse(t, []Hit{{DocID: "1", ShardID: "0", Vector: vec}}, nil)
+	if got, want := len(with)-len(plain), 4+4*len(vec); got != want {
+		t.Fatalf("vector adds %d bytes, want %d", got, want)
+	}
+
+	// a hit without a vector decodes with none, as frames did before the slot
+	_, err := ReadResponse(bytes.NewReader(plain), func(h Hit) error {
+		if h.Vector != nil {
+			t.Errorf("vector %v on a hit sent without one", h.Vector)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadResponseTruncated(t *testing.T) {
+	data := encodeResponse(t, []Hit{{DocID: "1", ShardID: "0", Score: 1, Title: "t", Vector: []float32{1, 2}}}, []byte(`{}`))
+	for n := 0; n < len(data); n++ {
+		_, err := ReadResponse(bytes.NewReader(data[:n]), func(Hit) error { return nil })
+		if err == nil {
+			t.Errorf("truncated to %d of %d bytes: no error", n, len(data))
+		}
+	}
+}
+
+func TestReadResponseCorrupt(t *testing.T) {
+	frame := func(kind byte, payload []byte) []byte {
+		return append([]byte{kind}, appendBytes(nil, payload)...)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"unknown kind", frame(9, nil)},
+		{"hit shorter than score", frame(frameHit, []byte{1, 2, 3})},
+		{"field length past payload", frame(frameHit, append(make([]byte, 8), 0xff, 0, 0, 0))},
+		{"vector length past payload", frame(frameHit, append(make([]byte, 8+5*4), 3, 0, 0, 0, 1, 2, 3, 4))},
+		{"partial vector length", frame(frameHit, append(make([]byte, 8+5*4), 1, 0))},
+		{"oversized frame", []byte{frameHit, 0xff, 0xff, 0xff, 0xff}},
+		{"no trailer", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadResponse(bytes.NewReader(tc.data), func(Hit) error { return nil }); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestReadResponseStopsOnCallbackError(t *testing.T) {
+	data := encodeResponse(t, []Hit{{DocID: "1"}, {DocID: "2"}}, []byte(`{}`))
+	stop := errors.New("stop")
+	calls := 0
+	_, err := ReadResponse(bytes.NewReader(data), func(Hit) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("err %v after %d calls, want stop after 1", err, calls)
+	}
+}
+
+func TestReadResponseEmptyStreamIsUnexpected(t *testing.T) {
+	_, err := ReadResponse(bytes.NewReader(nil), func(Hit) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}